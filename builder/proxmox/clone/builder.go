@@ -4,10 +4,6 @@
 package proxmoxclone
 
 import (
-	"crypto"
-	"net/netip"
-	"strings"
-
 	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/hcl/v2/hcldec"
 	proxmox "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
@@ -40,16 +36,31 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	state.Put("clone-config", &b.config)
 
 	preSteps := []multistep.Step{
-		&StepSshKeyPair{
+		&proxmox.StepSshKeyPair{
 			Debug:        b.config.PackerDebug,
 			DebugKeyPath: fmt.Sprintf("%s.pem", b.config.PackerBuildName),
 		},
+		&StepResolveCloneSource{},
+		&StepCheckLinkedClone{},
 		&StepMapSourceDisks{},
+		&StepUploadCloudInitSnippets{},
 	}
 	postSteps := []multistep.Step{}
 
+	if b.config.generatedPassword {
+		ui.Say(fmt.Sprintf("Generated a password for ciuser %s, it is stored as cipassword in the artifact state", b.config.CloudInitUser))
+	}
+
 	sb := proxmox.NewSharedBuilder(BuilderID, b.config.Config, preSteps, postSteps, &cloneVMCreator{})
-	return sb.Run(ctx, ui, hook, state)
+	artifact, err := sb.Run(ctx, ui, hook, state)
+	if err != nil {
+		return nil, err
+	}
+	// The generated password is needed to log in to VMs created from the artifact
+	if b.config.generatedPassword {
+		artifact.(*proxmox.Artifact).StateData["cipassword"] = b.config.CloudInitPassword
+	}
+	return artifact, nil
 }
 
 type cloneVMCreator struct{}
@@ -57,7 +68,8 @@ type cloneVMCreator struct{}
 func (*cloneVMCreator) Create(vmRef *proxmoxapi.VmRef, vmConfig proxmoxapi.ConfigQemu, state multistep.StateBag) error {
 	client := state.Get("proxmoxClient").(*proxmoxapi.Client)
 	c := state.Get("clone-config").(*Config)
-	comm := state.Get("config").(*proxmox.Config).Comm
+	// The communicator settings are updated by StepSshKeyPair on the shared config
+	commonConfig := state.Get("config").(*proxmox.Config)
 	ui := state.Get("ui").(packersdk.Ui)
 
 	fullClone := 1
@@ -68,79 +80,13 @@ func (*cloneVMCreator) Create(vmRef *proxmoxapi.VmRef, vmConfig proxmoxapi.Confi
 
 	// cloud-init options
 
-	var nameServers []netip.Addr
-	if c.Nameserver != "" {
-		for _, nameserver := range strings.Split(c.Nameserver, " ") {
-			ip, err := netip.ParseAddr(nameserver)
-			if err != nil {
-				continue
-			}
-			nameServers = append(nameServers, ip)
-		}
+	vmConfig.CloudInit = commonConfig.CloudInitConfig()
+	vmConfig.CloudInit.Username = &c.CloudInitUser
+	if c.CloudInitPassword != "" {
+		vmConfig.CloudInit.UserPassword = &c.CloudInitPassword
 	}
-
-	IpconfigMap := proxmoxapi.CloudInitNetworkInterfaces{}
-	for idx := range c.Ipconfigs {
-		if c.Ipconfigs[idx] != (cloudInitIpconfig{}) {
-
-			// backwards compatibility conversions
-
-			var ipv4cfg proxmoxapi.CloudInitIPv4Config
-			var ipv6cfg proxmoxapi.CloudInitIPv6Config
-
-			// cloudInitIpconfig.Ip accepts a CIDR address or 'dhcp' string
-			switch c.Ipconfigs[idx].Ip {
-			case "dhcp":
-				ipv4cfg.DHCP = true
-			default:
-				if c.Ipconfigs[idx].Ip != "" {
-					addr := proxmoxapi.IPv4CIDR(c.Ipconfigs[idx].Ip)
-					ipv4cfg.Address = &addr
-				}
-			}
-			if c.Ipconfigs[idx].Gateway != "" {
-				gw := proxmoxapi.IPv4Address(c.Ipconfigs[idx].Gateway)
-				ipv4cfg.Gateway = &gw
-			}
-
-			// cloudInitIpconfig.Ip6 accepts a CIDR address, 'auto' or 'dhcp' string
-			switch c.Ipconfigs[idx].Ip6 {
-			case "dhcp":
-				ipv6cfg.DHCP = true
-			case "auto":
-				ipv6cfg.SLAAC = true
-			default:
-				if c.Ipconfigs[idx].Ip6 != "" {
-					addr := proxmoxapi.IPv6CIDR(c.Ipconfigs[idx].Ip6)
-					ipv6cfg.Address = &addr
-				}
-			}
-			if c.Ipconfigs[idx].Gateway6 != "" {
-				addr := proxmoxapi.IPv6Address(c.Ipconfigs[idx].Gateway6)
-				ipv6cfg.Gateway = &addr
-			}
-
-			IpconfigMap[proxmoxapi.QemuNetworkInterfaceID(idx)] = proxmoxapi.CloudInitNetworkConfig{
-				IPv4: &ipv4cfg,
-				IPv6: &ipv6cfg,
-			}
-		}
-	}
-
-	var publicKey []crypto.PublicKey
-
-	if comm.SSHPublicKey != nil {
-		publicKey = append(publicKey, crypto.PublicKey(string(comm.SSHPublicKey)))
-	}
-
-	vmConfig.CloudInit = &proxmoxapi.CloudInit{
-		Username:      &comm.SSHUsername,
-		PublicSSHkeys: &publicKey,
-		DNS: &proxmoxapi.GuestDNS{
-			NameServers:  &nameServers,
-			SearchDomain: &c.Searchdomain,
-		},
-		NetworkInterfaces: IpconfigMap,
+	if custom, ok := state.GetOk("cloud_init_custom"); ok {
+		vmConfig.CloudInit.Custom = custom.(*proxmoxapi.CloudInitCustom)
 	}
 
 	if c.CloudInitDisableUpgradePackages != config.TriUnset {
@@ -169,35 +115,88 @@ func (*cloneVMCreator) Create(vmRef *proxmoxapi.VmRef, vmConfig proxmoxapi.Confi
 		}
 	}
 
-	var sourceVmr *proxmoxapi.VmRef
-	if c.CloneVM != "" {
-		sourceVmrs, err := client.GetVmRefsByName(c.CloneVM)
-		if err != nil {
-			return err
-		}
+	source := state.Get("clone-source").(*cloneSourceRef)
+	sourceVmr := source.vmRef
 
-		// prefer source Vm located on same node
-		sourceVmr = sourceVmrs[0]
-		for _, candVmr := range sourceVmrs {
-			if candVmr.Node() == vmRef.Node() {
-				sourceVmr = candVmr
-			}
+	if source.migrate {
+		// The disks of the source are only available on its own node
+		vmRef.SetNode(sourceVmr.Node())
+	}
+	err := cloneVM(client, c, vmConfig, sourceVmr, vmRef)
+	if err != nil {
+		return err
+	}
+	if err := configureClone(client, c, vmConfig, vmRef, source, ui); err != nil {
+		// The clone isn't known to the cleanup of the build yet
+		if _, derr := client.DeleteVm(vmRef); derr != nil {
+			ui.Error(fmt.Sprintf("Error deleting VM %d, please delete it manually: %s", vmRef.VmId(), derr))
 		}
-	} else if c.CloneVMID != 0 {
-		sourceVmr = proxmoxapi.NewVmRef(c.CloneVMID)
-		err := client.CheckVmRef(sourceVmr)
+		return err
+	}
+	return nil
+}
+
+// configureClone applies the configuration of the build to the freshly
+// cloned VM.
+func configureClone(client *proxmoxapi.Client, c *Config, vmConfig proxmoxapi.ConfigQemu, vmRef *proxmoxapi.VmRef, source *cloneSourceRef, ui packersdk.Ui) error {
+	var err error
+	if source.migrate {
+		ui.Say(fmt.Sprintf("Migrating VM %d to node %s", vmRef.VmId(), c.Node))
+		_, err = client.MigrateNode(vmRef, c.Node, false)
 		if err != nil {
-			return err
+			return fmt.Errorf("error migrating VM %d to node %s: %s", vmRef.VmId(), c.Node, err)
 		}
+		vmRef.SetNode(c.Node)
 	}
-
-	err := vmConfig.CloneVm(sourceVmr, vmRef, client)
+	_, err = vmConfig.Update(false, vmRef, client)
 	if err != nil {
 		return err
 	}
-	_, err = vmConfig.Update(false, vmRef, client)
-	if err != nil {
+	if err := reshapeSourceDisks(client, c.SourceDisks, vmRef); err != nil {
 		return err
 	}
+	if err := reconcileNetworkAdapters(client, c, vmRef, source.macAddresses); err != nil {
+		return err
+	}
+	// citype isn't covered by the Cloud-Init settings of the API client
+	if c.CloudInitType != "" {
+		_, err = client.SetVmConfig(vmRef, map[string]interface{}{
+			"citype": c.CloudInitType,
+		})
+		if err != nil {
+			return fmt.Errorf("error setting citype: %s", err)
+		}
+	}
 	return nil
 }
+
+// cloneVM clones the source VM like proxmoxapi.ConfigQemu.CloneVm does, but
+// also passes the snapshot, target storage and disk format options of the
+// clone API.
+func cloneVM(client *proxmoxapi.Client, c *Config, vmConfig proxmoxapi.ConfigQemu, sourceVmr *proxmoxapi.VmRef, vmRef *proxmoxapi.VmRef) error {
+	vmRef.SetVmType("qemu")
+	fullClone := 1
+	if vmConfig.FullClone != nil {
+		fullClone = *vmConfig.FullClone
+	}
+	params := map[string]interface{}{
+		"newid":  vmRef.VmId(),
+		"target": vmRef.Node(),
+		"name":   vmConfig.Name,
+		"full":   fullClone,
+	}
+	if vmRef.Pool() != "" {
+		params["pool"] = vmRef.Pool()
+	}
+	if c.CloneSnapshot != "" {
+		params["snapname"] = c.CloneSnapshot
+	}
+	if c.CloneTargetStorage != "" {
+		params["storage"] = c.CloneTargetStorage
+	}
+	if c.CloneTargetFormat != "" {
+		params["format"] = c.CloneTargetFormat
+	}
+	_, err := client.CloneQemuVm(sourceVmr, params)
+	return err
+}
@@ -2,20 +2,26 @@
 // SPDX-License-Identifier: MPL-2.0
 
 //go:generate packer-sdc struct-markdown
-//go:generate packer-sdc mapstructure-to-hcl2 -type Config,cloudInitIpconfig
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,cloudInitCustomConfig,sourceDiskConfig
 
 package proxmoxclone
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"net"
-	"net/netip"
+	"math/big"
+	"net/url"
+	"os"
+	"regexp"
 	"strings"
 
 	proxmoxcommon "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/pathing"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
@@ -23,51 +29,200 @@ type Config struct {
 
 	// The name of the VM Packer should clone and build from.
 	// Either `clone_vm` or `clone_vm_id` must be specifed.
+	// If several VMs in the cluster have this name, the one on `node` is
+	// preferred, then one with all its disks on shared storage. A VM on
+	// another node with disks on local storage is cloned on its own node and
+	// the clone is migrated to `node` (full clones only).
 	CloneVM string `mapstructure:"clone_vm" required:"true"`
 	// The ID of the VM Packer should clone and build from.
 	// Proxmox VMIDs are limited to the range 100-999999999.
 	// Either `clone_vm` or `clone_vm_id` must be specifed.
 	CloneVMID int `mapstructure:"clone_vm_id" required:"true"`
 	// Whether to run a full or shallow clone from the base clone_vm. Defaults to `true`.
+	//
+	// A shallow (linked) clone requires the source VM to be a template with
+	// all its disks on storage supporting linked clones (e.g. LVM-thin, ZFS,
+	// Ceph RBD, or qcow2 disks on directory storage), which is checked before
+	// the build starts. The resulting template depends on the source VM, its
+	// ID is recorded in the template description and in the
+	// `linked_clone_parent` artifact state. `-force` refuses to replace a
+	// template that still has linked clones.
 	FullClone config.Trilean `mapstructure:"full_clone" required:"false"`
+	// Name of a snapshot of the source VM to clone from, instead of its
+	// current state. The disks of the new VM are mapped as they were in the
+	// snapshot. Works for both full and linked clones, as long as the
+	// storage of the source VM supports it.
+	CloneSnapshot string `mapstructure:"clone_snapshot" required:"false"`
+	// Name of the Proxmox storage to put the disks of a full clone on.
+	// Defaults to the storage of the source VM's disks. Not available for
+	// linked clones, which always stay on the storage of the source VM.
+	CloneTargetStorage string `mapstructure:"clone_target_storage" required:"false"`
+	// Format of the disks of a full clone on file based storages. Can be
+	// `raw`, `qcow2` or `vmdk`. Defaults to the format of the source VM's
+	// disks. Not available for linked clones.
+	CloneTargetFormat string `mapstructure:"clone_target_format" required:"false"`
+	// How `network_adapters` are applied to the network adapters inherited
+	// from the source VM. With `merge` the adapters are overwritten by
+	// position and additional adapters of the source VM are kept. With
+	// `replace` every adapter of the source VM not declared in
+	// `network_adapters` is removed, along with its `ipconfig`.
+	// Defaults to `merge`.
+	NetworkAdaptersMode string `mapstructure:"network_adapters_mode" required:"false"`
+	// Keep the MAC addresses of the network adapters of the source VM,
+	// unless `mac_address` is set in `network_adapters`. Otherwise Proxmox
+	// generates new MAC addresses for the clone. Make sure the source VM
+	// isn't running on the same network when preserving its MAC addresses.
+	// Defaults to `false`.
+	PreserveSourceMACs bool `mapstructure:"preserve_source_macs" required:"false"`
+	// Change the disks of the source VM on the clone, selected by their slot.
+	// See the [Source Disks](#source-disks) documentation for fields.
+	SourceDisks []sourceDiskConfig `mapstructure:"source_disk" required:"false"`
 
-	// Set nameserver IP address(es) via Cloud-Init.
-	// If not given, the same setting as on the host is used.
-	Nameserver string `mapstructure:"nameserver" required:"false"`
-	// Set the DNS searchdomain via Cloud-Init.
-	// If not given, the same setting as on the host is used.
-	Searchdomain string `mapstructure:"searchdomain" required:"false"`
-	// Set IP address and gateway via Cloud-Init.
-	// See the [CloudInit Ip Configuration](#cloudinit-ip-configuration) documentation for fields.
-	Ipconfigs []cloudInitIpconfig `mapstructure:"ipconfig" required:"false"`
+	// Custom Cloud-Init configuration passed to the VM as snippets (`cicustom`).
+	// See the [Cloud-Init Snippets](#cloud-init-snippets) documentation for fields.
+	CloudInitCustom cloudInitCustomConfig `mapstructure:"cicustom" required:"false"`
+	// User to create via Cloud-Init. Defaults to `ssh_username`, or to
+	// `winrm_username` when using the WinRM communicator.
+	CloudInitUser string `mapstructure:"ciuser" required:"false"`
+	// Password to set for `ciuser` via Cloud-Init, e.g. for logging in on the
+	// console while debugging a build. When using the WinRM communicator this
+	// defaults to `winrm_password`, and if neither is given a random password
+	// is generated and used for both. A generated password is available to
+	// provisioners as `build.Password` and to post-processors in the
+	// `cipassword` entry of the artifact state.
+	CloudInitPassword string `mapstructure:"cipassword" required:"false"`
+	// Format of the Cloud-Init configuration passed to the VM. Can be
+	// `nocloud`, `configdrive2` (e.g. for cloudbase-init on Windows) or
+	// `opennebula`. If not given, the setting of the cloned VM is kept.
+	CloudInitType string `mapstructure:"citype" required:"false"`
+	// Whether Cloud-Init upgrades the packages of the VM on first boot
+	// (`ciupgrade`). Inverse of `cloud_init_disable_upgrade_packages`, so the
+	// two can't both be set. Requires Proxmox 8 or newer.
+	// If not given, the setting of the cloned VM is kept.
+	CloudInitUpgrade config.Trilean `mapstructure:"ciupgrade" required:"false"`
+
+	// Whether CloudInitPassword was generated by Prepare
+	generatedPassword bool
 }
 
-// If you have configured more than one network interface, make sure to match the order of
-// `network_adapters` and `ipconfig`.
+// Changes to a disk the clone inherited from the source VM. The disk is
+// selected by its slot on the source VM, such as `scsi0`. Options that aren't
+// set are kept as they are on the source VM.
+//
+// HCL2 example:
 //
-// Usage example (JSON):
+// ```hcl
 //
-// ```json
-// [
+//	source_disk {
+//	  slot      = "scsi0"
+//	  disk_size = "40G"
+//	  discard   = true
+//	}
 //
-//	{
-//	  "ip": "192.168.1.55/24",
-//	  "gateway": "192.168.1.1",
-//	  "ip6": "fda8:a260:6eda:20::4da/128",
-//	  "gateway6": "fda8:a260:6eda:20::1"
+//	source_disk {
+//	  slot   = "scsi1"
+//	  detach = true
 //	}
 //
-// ]
 // ```
-type cloudInitIpconfig struct {
-	// Either an IPv4 address (CIDR notation) or `dhcp`.
-	Ip string `mapstructure:"ip" required:"false"`
-	// IPv4 gateway.
-	Gateway string `mapstructure:"gateway" required:"false"`
-	// Can be an IPv6 address (CIDR notation), `auto` (enables SLAAC), or `dhcp`.
-	Ip6 string `mapstructure:"ip6" required:"false"`
-	// IPv6 gateway.
-	Gateway6 string `mapstructure:"gateway6" required:"false"`
+type sourceDiskConfig struct {
+	// The slot of the disk on the source VM, such as `scsi0` or `virtio1`.
+	Slot string `mapstructure:"slot" required:"true"`
+	// Grow the disk to this size, including a unit suffix, such as `40G`.
+	// Disks can't be shrunk, a size smaller than the disk on the source VM
+	// fails the build.
+	Size string `mapstructure:"disk_size" required:"false"`
+	// How to cache operations to the disk. Can be
+	// `none`, `writethrough`, `writeback`, `unsafe` or `directsync`.
+	CacheMode string `mapstructure:"cache_mode" required:"false"`
+	// Relay TRIM commands to the underlying storage.
+	Discard config.Trilean `mapstructure:"discard" required:"false"`
+	// Present the disk to the guest as solid-state drive.
+	// This cannot work with virtio disks.
+	SSD config.Trilean `mapstructure:"ssd" required:"false"`
+	// Use a dedicated I/O thread for the disk. Requires the
+	// `virtio-scsi-single` controller for `scsi` disks.
+	IOThread config.Trilean `mapstructure:"io_thread" required:"false"`
+	// Detach the disk from the clone. Detached disks are deleted before the
+	// clone is converted to a template. Can't be combined with other options.
+	Detach bool `mapstructure:"detach" required:"false"`
+}
+
+// Custom Cloud-Init user, network, meta and vendor data, which replace the
+// respective parts Proxmox generates from the Cloud-Init settings of the VM.
+// Every document can be given inline or read from a file, and both are
+// processed with Packer templating.
+//
+// The snippets are written to `snippets_storage_pool`, which must be a
+// file based storage with the `snippets` content type enabled. As the
+// Proxmox API can't upload snippets, they are copied over SFTP to the node,
+// using the `ssh_*` settings of this block. The host key of the node is
+// always verified, against `ssh_host_key` or `ssh_known_hosts_file`.
+//
+// Keep in mind that custom user data replaces the user and SSH keys set by
+// Packer, so it has to set up access for the communicator itself.
+//
+// HCL2 example:
+//
+// ```hcl
+//
+//	cicustom {
+//	  snippets_storage_pool = "local"
+//	  user_data_file        = "./http/user-data"
+//	  ssh_private_key_file  = "~/.ssh/id_ed25519"
+//	  ssh_known_hosts_file  = "~/.ssh/known_hosts"
+//	}
+//
+// ```
+type cloudInitCustomConfig struct {
+	// Name of the Proxmox storage to write the snippets to.
+	SnippetsStoragePool string `mapstructure:"snippets_storage_pool" required:"true"`
+	// Cloud-Init user data.
+	UserData string `mapstructure:"user_data" required:"false"`
+	// Path to a file holding the Cloud-Init user data. Can't be combined with `user_data`.
+	UserDataFile string `mapstructure:"user_data_file" required:"false"`
+	// Cloud-Init network configuration.
+	NetworkConfig string `mapstructure:"network_config" required:"false"`
+	// Path to a file holding the Cloud-Init network configuration. Can't be
+	// combined with `network_config`.
+	NetworkConfigFile string `mapstructure:"network_config_file" required:"false"`
+	// Cloud-Init meta data.
+	MetaData string `mapstructure:"meta_data" required:"false"`
+	// Path to a file holding the Cloud-Init meta data. Can't be combined with `meta_data`.
+	MetaDataFile string `mapstructure:"meta_data_file" required:"false"`
+	// Cloud-Init vendor data.
+	VendorData string `mapstructure:"vendor_data" required:"false"`
+	// Path to a file holding the Cloud-Init vendor data. Can't be combined with `vendor_data`.
+	VendorDataFile string `mapstructure:"vendor_data_file" required:"false"`
+	// Keep the snippets referenced by the final template. Otherwise the
+	// snippets are only used by the build and deleted afterwards. Snippet
+	// names are unique per build, so later builds don't touch the snippets
+	// of earlier templates.
+	// Defaults to `false`.
+	KeepOnTemplate bool `mapstructure:"keep_on_template" required:"false"`
+	// Host to copy the snippets to. Defaults to the host of `proxmox_url`.
+	SSHHost string `mapstructure:"ssh_host" required:"false"`
+	// SSH port of `ssh_host`. Defaults to `22`.
+	SSHPort int `mapstructure:"ssh_port" required:"false"`
+	// User to copy the snippets with. Defaults to `root`.
+	SSHUsername string `mapstructure:"ssh_username" required:"false"`
+	// Password of `ssh_username`.
+	SSHPassword string `mapstructure:"ssh_password" required:"false"`
+	// Path to a private key to authenticate `ssh_username` with. A leading
+	// `~` is expanded to the home directory.
+	SSHPrivateKeyFile string `mapstructure:"ssh_private_key_file" required:"false"`
+	// Public key of `ssh_host` in authorized_keys format, e.g. the content
+	// of `/etc/ssh/ssh_host_ed25519_key.pub` on the node. The connection is
+	// refused if the host presents another key. One of `ssh_host_key` or
+	// `ssh_known_hosts_file` must be specified.
+	SSHHostKey string `mapstructure:"ssh_host_key" required:"false"`
+	// Path to a known_hosts file to verify the key of `ssh_host` against.
+	// Unknown hosts are refused. A leading `~` is expanded to the home
+	// directory.
+	SSHKnownHostsFile string `mapstructure:"ssh_known_hosts_file" required:"false"`
+
+	// Rendered snippets, by cicustom kind
+	snippets map[string]string
 }
 
 func (c *Config) Prepare(raws ...interface{}) ([]string, []string, error) {
@@ -90,65 +245,274 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, []string, error) {
 		errs = packersdk.MultiErrorAppend(errs, errors.New("clone_vm_id must be in range 100-999999999"))
 	}
 
-	// Check validity of given IP addresses
-	if c.Nameserver != "" {
-		for _, nameserver := range strings.Split(c.Nameserver, " ") {
-			_, err := netip.ParseAddr(nameserver)
-			if err != nil {
-				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse nameserver: %s", err))
-			}
+	switch c.CloneTargetFormat {
+	case "", "raw", "qcow2", "vmdk":
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for clone_target_format %q: only one of 'raw', 'qcow2', 'vmdk' is valid", c.CloneTargetFormat))
+	}
+	if c.FullClone.False() {
+		if c.CloneTargetStorage != "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("clone_target_storage can only be used with full clones"))
+		}
+		if c.CloneTargetFormat != "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("clone_target_format can only be used with full clones"))
 		}
 	}
-	for _, i := range c.Ipconfigs {
-		if i.Ip != "" && i.Ip != "dhcp" {
-			_, _, err := net.ParseCIDR(i.Ip)
-			if err != nil {
-				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.ip: %s", err))
+	errs = packersdk.MultiErrorAppend(errs, c.prepareSourceDisks()...)
+	switch c.NetworkAdaptersMode {
+	case "":
+		c.NetworkAdaptersMode = "merge"
+	case "merge":
+	case "replace":
+		if len(c.NICs) == 0 {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("network_adapters_mode replace requires at least one network_adapters block, or the clone has no network"))
+		}
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for network_adapters_mode %q: only one of 'merge', 'replace' is valid", c.NetworkAdaptersMode))
+	}
+	// "current" is how Proxmox lists the current state alongside the snapshots
+	if c.CloneSnapshot == "current" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("clone_snapshot cannot be 'current', leave it empty to clone the current state"))
+	}
+	if c.CloudInitCustom.isSet() {
+		errs = packersdk.MultiErrorAppend(errs, c.CloudInitCustom.prepare(c)...)
+	}
+	errs = packersdk.MultiErrorAppend(errs, c.prepareCloudInitUser()...)
+	switch c.CloudInitType {
+	case "", "nocloud", "configdrive2", "opennebula":
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for citype %q: only one of 'nocloud', 'configdrive2', 'opennebula' is valid", c.CloudInitType))
+	}
+	if c.CloudInitUpgrade != config.TriUnset {
+		if c.CloudInitDisableUpgradePackages != config.TriUnset {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("ciupgrade and cloud_init_disable_upgrade_packages cannot both be specified"))
+		}
+		// Both settings end up as the same Proxmox option, keep using the existing one from here on
+		c.CloudInitDisableUpgradePackages = config.TrileanFromBool(c.CloudInitUpgrade.False())
+	}
+	if errs != nil && len(errs.Errors) > 0 {
+		return nil, warnings, errs
+	}
+	return nil, warnings, nil
+}
+
+var rxSourceDiskSlot = regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`)
+
+// prepareSourceDisks validates the changes to the disks of the source VM.
+// Whether the disks exist and can be grown can only be checked once the
+// source VM is known, by StepMapSourceDisks.
+func (c *Config) prepareSourceDisks() []error {
+	var errs []error
+
+	slots := map[string]bool{}
+	for _, disk := range c.SourceDisks {
+		if !rxSourceDiskSlot.MatchString(disk.Slot) {
+			errs = append(errs, fmt.Errorf("invalid source_disk slot %q: must be a disk slot like scsi0", disk.Slot))
+			continue
+		}
+		if slots[disk.Slot] {
+			errs = append(errs, fmt.Errorf("source_disk %s is defined more than once", disk.Slot))
+		}
+		slots[disk.Slot] = true
+
+		if disk.Detach {
+			if disk.Size != "" || disk.CacheMode != "" || disk.Discard != config.TriUnset ||
+				disk.SSD != config.TriUnset || disk.IOThread != config.TriUnset {
+				errs = append(errs, fmt.Errorf("source_disk %s: detach can't be combined with other options", disk.Slot))
 			}
+			continue
 		}
-		if i.Gateway != "" {
-			_, err := netip.ParseAddr(i.Gateway)
-			if err != nil {
-				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.gateway: %s", err))
+		if disk.Size != "" {
+			if _, err := parseDiskSize(disk.Size); err != nil {
+				errs = append(errs, fmt.Errorf("source_disk %s: %s", disk.Slot, err))
 			}
 		}
-		if i.Ip6 != "" && i.Ip6 != "auto" && i.Ip6 != "dhcp" {
-			_, _, err := net.ParseCIDR(i.Ip6)
-			if err != nil {
-				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.ip6: %s", err))
+		switch disk.CacheMode {
+		case "", "none", "writethrough", "writeback", "unsafe", "directsync":
+		default:
+			errs = append(errs, fmt.Errorf("source_disk %s: invalid value for cache_mode %q", disk.Slot, disk.CacheMode))
+		}
+		if disk.SSD.True() && strings.HasPrefix(disk.Slot, "virtio") {
+			errs = append(errs, fmt.Errorf("source_disk %s: SSD emulation is not supported on virtio disks", disk.Slot))
+		}
+		if disk.IOThread.True() {
+			if !strings.HasPrefix(disk.Slot, "scsi") && !strings.HasPrefix(disk.Slot, "virtio") {
+				errs = append(errs, fmt.Errorf("source_disk %s: io thread option requires scsi or a virtio disk", disk.Slot))
+			} else if strings.HasPrefix(disk.Slot, "scsi") && c.SCSIController != "virtio-scsi-single" {
+				errs = append(errs, fmt.Errorf("source_disk %s: io thread option requires virtio-scsi-single controller", disk.Slot))
 			}
 		}
-		if i.Gateway6 != "" {
-			_, err := netip.ParseAddr(i.Gateway6)
+	}
+	return errs
+}
+
+// prepareCloudInitUser sets the defaults of the Cloud-Init user and password,
+// generating a password for the WinRM communicator if none is given.
+func (c *Config) prepareCloudInitUser() []error {
+	var errs []error
+
+	if c.CloudInitUser == "" {
+		switch c.Comm.Type {
+		case "winrm":
+			c.CloudInitUser = c.Comm.WinRMUser
+		default:
+			c.CloudInitUser = c.Comm.SSHUsername
+		}
+	}
+
+	if c.Comm.Type == "winrm" && c.CloudInitPassword == "" {
+		if c.Comm.WinRMPassword == "" {
+			password, err := generatePassword(cloudInitPasswordLength)
 			if err != nil {
-				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.gateway6: %s", err))
+				errs = append(errs, fmt.Errorf("failed to generate cipassword: %s", err))
 			}
+			c.Comm.WinRMPassword = password
+			c.generatedPassword = true
 		}
+		c.CloudInitPassword = c.Comm.WinRMPassword
 	}
-	if len(c.NICs) < len(c.Ipconfigs) {
-		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("%d ipconfig blocks given, but only %d network interfaces defined", len(c.Ipconfigs), len(c.NICs)))
+	packersdk.LogSecretFilter.Set(c.CloudInitPassword)
+
+	return errs
+}
+
+const cloudInitPasswordLength = 24
+
+// generatePassword returns a random password containing lower and upper case
+// letters, digits and symbols, to satisfy the Windows complexity requirements.
+func generatePassword(length int) (string, error) {
+	classes := []string{
+		"abcdefghijkmnopqrstuvwxyz",
+		"ABCDEFGHJKLMNPQRSTUVWXYZ",
+		"23456789",
+		"-_.+=!",
 	}
+	all := strings.Join(classes, "")
 
-	if errs != nil && len(errs.Errors) > 0 {
-		return nil, warnings, errs
+	password := make([]byte, length)
+	for i := range password {
+		// Take the first characters from each class in turn, so every class is present
+		chars := all
+		if i < len(classes) {
+			chars = classes[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = chars[n.Int64()]
 	}
-	return nil, warnings, nil
+	// Don't keep the classes at fixed positions
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+	return string(password), nil
+}
+
+func (c *cloudInitCustomConfig) isSet() bool {
+	return c.SnippetsStoragePool != "" || c.UserData != "" || c.UserDataFile != "" ||
+		c.NetworkConfig != "" || c.NetworkConfigFile != "" ||
+		c.MetaData != "" || c.MetaDataFile != "" ||
+		c.VendorData != "" || c.VendorDataFile != ""
 }
 
-// Convert Ipconfig attributes into a Proxmox-API compatible string
-func (c cloudInitIpconfig) String() string {
-	options := []string{}
-	if c.Ip != "" {
-		options = append(options, "ip="+c.Ip)
+// prepare validates the snippet settings and renders the snippets
+func (c *cloudInitCustomConfig) prepare(config *Config) []error {
+	var errs []error
+
+	if c.SnippetsStoragePool == "" {
+		errs = append(errs, errors.New("cicustom snippets_storage_pool must be specified"))
+	}
+	if c.SSHHost == "" {
+		if u, err := url.Parse(config.ProxmoxURLRaw); err == nil {
+			c.SSHHost = u.Hostname()
+		}
+	}
+	if c.SSHPort == 0 {
+		c.SSHPort = 22
+	}
+	if c.SSHUsername == "" {
+		c.SSHUsername = "root"
+	}
+	packersdk.LogSecretFilter.Set(c.SSHPassword)
+	if c.SSHPassword == "" && c.SSHPrivateKeyFile == "" {
+		errs = append(errs, errors.New("one of cicustom ssh_password or ssh_private_key_file must be specified"))
+	}
+	// The files are only read once the snippets are uploaded, make sure
+	// they're usable before the build starts
+	for _, file := range []struct {
+		key  string
+		path *string
+	}{
+		{"ssh_private_key_file", &c.SSHPrivateKeyFile},
+		{"ssh_known_hosts_file", &c.SSHKnownHostsFile},
+	} {
+		if *file.path == "" {
+			continue
+		}
+		path, err := pathing.ExpandUser(*file.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error expanding cicustom %s: %s", file.key, err))
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("invalid cicustom %s: %s", file.key, err))
+			continue
+		}
+		*file.path = path
 	}
-	if c.Gateway != "" {
-		options = append(options, "gw="+c.Gateway)
+	switch {
+	case c.SSHHostKey == "" && c.SSHKnownHostsFile == "":
+		errs = append(errs, errors.New("one of cicustom ssh_host_key or ssh_known_hosts_file must be specified"))
+	case c.SSHHostKey != "" && c.SSHKnownHostsFile != "":
+		errs = append(errs, errors.New("cicustom ssh_host_key and ssh_known_hosts_file cannot both be set"))
+	case c.SSHHostKey != "":
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.SSHHostKey)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid cicustom ssh_host_key: %s", err))
+		}
+	}
+
+	c.snippets = map[string]string{}
+	documents := []struct {
+		kind   string
+		key    string
+		inline string
+		file   string
+	}{
+		{"user", "user_data", c.UserData, c.UserDataFile},
+		{"network", "network_config", c.NetworkConfig, c.NetworkConfigFile},
+		{"meta", "meta_data", c.MetaData, c.MetaDataFile},
+		{"vendor", "vendor_data", c.VendorData, c.VendorDataFile},
 	}
-	if c.Ip6 != "" {
-		options = append(options, "ip6="+c.Ip6)
+	for _, doc := range documents {
+		data := doc.inline
+		if doc.file != "" {
+			if doc.inline != "" {
+				errs = append(errs, fmt.Errorf("cicustom %s and %s_file cannot both be set", doc.key, doc.key))
+				continue
+			}
+			raw, err := os.ReadFile(doc.file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error reading cicustom %s_file: %s", doc.key, err))
+				continue
+			}
+			data, err = interpolate.Render(string(raw), &config.Ctx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error processing cicustom %s_file: %s", doc.key, err))
+				continue
+			}
+		}
+		if data != "" {
+			c.snippets[doc.kind] = data
+		}
 	}
-	if c.Gateway6 != "" {
-		options = append(options, "gw6="+c.Gateway6)
+	if len(c.snippets) == 0 {
+		errs = append(errs, errors.New("cicustom requires at least one of user_data, network_config, meta_data or vendor_data"))
 	}
-	return strings.Join(options, ",")
+	return errs
 }
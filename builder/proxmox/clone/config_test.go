@@ -4,11 +4,13 @@
 package proxmoxclone
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
-	proxmox "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
 )
 
 func mandatoryConfig(t *testing.T) map[string]interface{} {
@@ -105,46 +107,335 @@ func TestVMNameOrID(t *testing.T) {
 	}
 }
 
-func TestNameserver(t *testing.T) {
-	ipconfigTest := []struct {
-		name          string
-		nameserver    string
-		expectFailure bool
+const testHostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINhbIaTxNvBWLVJ9+n2wZkFFg44IbRqcZur8qCC5lapN"
+
+func TestCloudInitCustom(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	for _, file := range []string{keyFile, knownHostsFile} {
+		if err := os.WriteFile(file, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		cicustom        map[string]interface{}
+		expectFailure   bool
+		expectedSnippet map[string]string
 	}{
 		{
-			name:          "nameserver empty, no error",
-			expectFailure: false,
-			nameserver:    "",
+			name: "inline user data with password",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_password":          "secret",
+				"ssh_host_key":          testHostKey,
+			},
+			expectedSnippet: map[string]string{"user": "#cloud-config\n"},
 		},
 		{
-			name:          "single valid nameserver, no error",
-			expectFailure: false,
-			nameserver:    "192.168.1.1",
+			name: "network and vendor data with key",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"network_config":        "version: 2",
+				"vendor_data":           "#cloud-config\n",
+				"ssh_private_key_file":  keyFile,
+				"ssh_known_hosts_file":  knownHostsFile,
+			},
+			expectedSnippet: map[string]string{"network": "version: 2", "vendor": "#cloud-config\n"},
 		},
 		{
-			name:          "two valid nameservers, no error",
-			expectFailure: false,
-			nameserver:    "192.168.1.1 192.168.1.2",
+			name: "missing key file, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_private_key_file":  filepath.Join(dir, "missing"),
+				"ssh_known_hosts_file":  knownHostsFile,
+			},
+			expectFailure: true,
+		},
+		{
+			name: "missing known_hosts file, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_password":          "secret",
+				"ssh_known_hosts_file":  "~/packer-missing-known-hosts",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "no snippets, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"ssh_password":          "secret",
+			},
+			expectFailure: true,
 		},
 		{
-			name:          "comma separated nameservers, fail",
+			name: "no storage, fail",
+			cicustom: map[string]interface{}{
+				"user_data":    "#cloud-config\n",
+				"ssh_password": "secret",
+			},
 			expectFailure: true,
-			nameserver:    "192.168.1.1,192.168.1.2",
 		},
 		{
-			name:          "invalid nameserver, fail",
+			name: "no credentials, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "no host key, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_password":          "secret",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "invalid host key, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_password":          "secret",
+				"ssh_host_key":          "ssh-ed25519 not-a-key",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "host key and known_hosts, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"ssh_password":          "secret",
+				"ssh_host_key":          testHostKey,
+				"ssh_known_hosts_file":  knownHostsFile,
+			},
+			expectFailure: true,
+		},
+		{
+			name: "inline and file user data, fail",
+			cicustom: map[string]interface{}{
+				"snippets_storage_pool": "local",
+				"user_data":             "#cloud-config\n",
+				"user_data_file":        "user-data",
+				"ssh_password":          "secret",
+			},
 			expectFailure: true,
-			nameserver:    "192.168.1",
 		},
 	}
 
-	for _, tt := range ipconfigTest {
+	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := mandatoryConfig(t)
-			cfg["nameserver"] = tt.nameserver
+			cfg["cicustom"] = tt.cicustom
 
 			var c Config
-			_, _, err := c.Prepare(&c, cfg)
+			_, _, err := c.Prepare(cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+
+			if c.CloudInitCustom.SSHHost != "my-proxmox.my-domain" {
+				t.Errorf("expected ssh_host to default to the host of proxmox_url, got %q", c.CloudInitCustom.SSHHost)
+			}
+			if c.CloudInitCustom.SSHUsername != "root" || c.CloudInitCustom.SSHPort != 22 {
+				t.Errorf("expected ssh defaults root:22, got %s:%d", c.CloudInitCustom.SSHUsername, c.CloudInitCustom.SSHPort)
+			}
+			if len(c.CloudInitCustom.snippets) != len(tt.expectedSnippet) {
+				t.Errorf("expected %d snippets, got %d", len(tt.expectedSnippet), len(c.CloudInitCustom.snippets))
+			}
+			for kind, expected := range tt.expectedSnippet {
+				if got := c.CloudInitCustom.snippets[kind]; got != expected {
+					t.Errorf("expected %s snippet %q, got %q", kind, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCloudInitUser(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]interface{}
+		expectFailure    bool
+		expectedUser     string
+		expectedPassword string
+		expectGenerated  bool
+		expectedUpgrade  config.Trilean
+	}{
+		{
+			name:         "defaults to the SSH user without password",
+			config:       map[string]interface{}{},
+			expectedUser: "root",
+		},
+		{
+			name: "explicit user and password",
+			config: map[string]interface{}{
+				"ciuser":     "packer",
+				"cipassword": "secret",
+			},
+			expectedUser:     "packer",
+			expectedPassword: "secret",
+		},
+		{
+			name: "WinRM user and password",
+			config: map[string]interface{}{
+				"communicator":   "winrm",
+				"winrm_username": "Administrator",
+				"winrm_password": "secret",
+			},
+			expectedUser:     "Administrator",
+			expectedPassword: "secret",
+		},
+		{
+			name: "WinRM without password generates one",
+			config: map[string]interface{}{
+				"communicator":   "winrm",
+				"winrm_username": "Administrator",
+			},
+			expectedUser:    "Administrator",
+			expectGenerated: true,
+		},
+		{
+			name: "configdrive2",
+			config: map[string]interface{}{
+				"citype": "configdrive2",
+			},
+			expectedUser: "root",
+		},
+		{
+			name: "invalid citype, fail",
+			config: map[string]interface{}{
+				"citype": "ovf",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "ciupgrade",
+			config: map[string]interface{}{
+				"ciupgrade": false,
+			},
+			expectedUser:    "root",
+			expectedUpgrade: config.TriTrue,
+		},
+		{
+			name: "ciupgrade and cloud_init_disable_upgrade_packages, fail",
+			config: map[string]interface{}{
+				"ciupgrade":                           true,
+				"cloud_init_disable_upgrade_packages": false,
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+
+			if c.CloudInitUser != tt.expectedUser {
+				t.Errorf("expected ciuser %q, got %q", tt.expectedUser, c.CloudInitUser)
+			}
+			if c.generatedPassword != tt.expectGenerated {
+				t.Errorf("expected generated password to be recorded as %v, got %v", tt.expectGenerated, c.generatedPassword)
+			}
+			if tt.expectGenerated {
+				if len(c.CloudInitPassword) != cloudInitPasswordLength {
+					t.Errorf("expected a generated password of %d characters, got %q", cloudInitPasswordLength, c.CloudInitPassword)
+				}
+				if c.Comm.WinRMPassword != c.CloudInitPassword {
+					t.Error("expected the generated password to be used by the WinRM communicator")
+				}
+			} else if c.CloudInitPassword != tt.expectedPassword {
+				t.Errorf("expected cipassword %q, got %q", tt.expectedPassword, c.CloudInitPassword)
+			}
+			if c.CloudInitDisableUpgradePackages != tt.expectedUpgrade {
+				t.Errorf("expected cloud_init_disable_upgrade_packages %v, got %v", tt.expectedUpgrade, c.CloudInitDisableUpgradePackages)
+			}
+		})
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		password, err := generatePassword(cloudInitPasswordLength)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(password) != cloudInitPasswordLength {
+			t.Fatalf("expected password of %d characters, got %q", cloudInitPasswordLength, password)
+		}
+		for _, class := range []string{"abcdefghijkmnopqrstuvwxyz", "ABCDEFGHJKLMNPQRSTUVWXYZ", "23456789", "-_.+=!"} {
+			if !strings.ContainsAny(password, class) {
+				t.Errorf("expected password %q to contain one of %q", password, class)
+			}
+		}
+	}
+}
+
+func TestCloneSnapshot(t *testing.T) {
+	tests := []struct {
+		name          string
+		snapshot      string
+		fullClone     interface{}
+		expectFailure bool
+	}{
+		{
+			name:     "full clone from snapshot",
+			snapshot: "pre-hardening",
+		},
+		{
+			name:      "linked clone from snapshot",
+			snapshot:  "pre-hardening",
+			fullClone: false,
+		},
+		{
+			name:          "current, fail",
+			snapshot:      "current",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["clone_snapshot"] = tt.snapshot
+			if tt.fullClone != nil {
+				cfg["full_clone"] = tt.fullClone
+			}
+
+			var c Config
+			_, _, err := c.Prepare(cfg)
 			if err != nil && !tt.expectFailure {
 				t.Fatalf("unexpected failure: %s", err)
 			}
@@ -155,114 +446,113 @@ func TestNameserver(t *testing.T) {
 	}
 }
 
-func TestIpconfig(t *testing.T) {
-	ipconfigTest := []struct {
+func TestCloneTarget(t *testing.T) {
+	tests := []struct {
 		name          string
-		nics          []proxmox.NICConfig
-		ipconfigs     []cloudInitIpconfig
+		config        map[string]interface{}
 		expectFailure bool
 	}{
 		{
-			name:          "ipconfig empty, no error",
-			expectFailure: false,
-			ipconfigs:     []cloudInitIpconfig{},
+			name: "full clone to other storage and format",
+			config: map[string]interface{}{
+				"clone_target_storage": "local-zfs",
+				"clone_target_format":  "raw",
+			},
 		},
 		{
-			name:          "valid ipconfig, no error",
-			expectFailure: false,
-			ipconfigs: []cloudInitIpconfig{
-				{
-					Ip:       "192.168.1.55/24",
-					Gateway:  "192.168.1.1",
-					Ip6:      "fda8:a260:6eda:20::4da/128",
-					Gateway6: "fda8:a260:6eda:20::1",
-				},
-			},
-			nics: []proxmox.NICConfig{
-				{
-					Model:  "virtio",
-					Bridge: "vmbr0",
-				},
+			name: "invalid format, fail",
+			config: map[string]interface{}{
+				"clone_target_format": "vdi",
 			},
+			expectFailure: true,
 		},
 		{
-			name:          "IPv4 invalid CIDR, fail",
+			name: "linked clone to other storage, fail",
+			config: map[string]interface{}{
+				"full_clone":           false,
+				"clone_target_storage": "local-zfs",
+			},
 			expectFailure: true,
-			ipconfigs: []cloudInitIpconfig{
-				{
-					Ip:      "192.168.1.55",
-					Gateway: "192.168.1.1",
-				},
+		},
+		{
+			name: "linked clone with format, fail",
+			config: map[string]interface{}{
+				"full_clone":          false,
+				"clone_target_format": "qcow2",
 			},
-			nics: []proxmox.NICConfig{
-				{
-					Model:  "virtio",
-					Bridge: "vmbr0",
-				},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(cfg)
+			if err != nil && !tt.expectFailure {
+				t.Fatalf("unexpected failure: %s", err)
+			}
+			if err == nil && tt.expectFailure {
+				t.Errorf("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestSourceDisks(t *testing.T) {
+	tests := []struct {
+		name          string
+		disks         []map[string]interface{}
+		expectFailure bool
+	}{
+		{
+			name: "grow and change options",
+			disks: []map[string]interface{}{
+				{"slot": "scsi0", "disk_size": "40G", "cache_mode": "writeback", "discard": true},
+				{"slot": "scsi1", "detach": true},
 			},
 		},
 		{
-			name:          "IPv6 invalid CIDR, fail",
+			name:          "invalid slot, fail",
+			disks:         []map[string]interface{}{{"slot": "disk0", "disk_size": "40G"}},
 			expectFailure: true,
-			ipconfigs: []cloudInitIpconfig{
-				{
-					Ip6:      "fda8:a260:6eda:20::4da",
-					Gateway6: "fda8:a260:6eda:20::1",
-				},
-			},
-			nics: []proxmox.NICConfig{
-				{
-					Model:  "virtio",
-					Bridge: "vmbr0",
-				},
-			},
 		},
 		{
-			name:          "not enough nics, fail",
+			name:          "invalid size, fail",
+			disks:         []map[string]interface{}{{"slot": "scsi0", "disk_size": "40GB"}},
 			expectFailure: true,
-			ipconfigs: []cloudInitIpconfig{
-				{
-					Ip6:      "fda8:a260:6eda:20::4da/128",
-					Gateway6: "fda8:a260:6eda:20::1",
-				},
-				{
-					Ip6:      "fda8:a260:6eda:20::4db/128",
-					Gateway6: "fda8:a260:6eda:20::1",
-				},
-			},
-			nics: []proxmox.NICConfig{
-				{
-					Model:  "virtio",
-					Bridge: "vmbr0",
-				},
-			},
 		},
 		{
-			name:          "ipconfig DHCP, no error",
-			expectFailure: false,
-			ipconfigs: []cloudInitIpconfig{
-				{
-					Ip:  "dhcp",
-					Ip6: "dhcp",
-				},
-			},
-			nics: []proxmox.NICConfig{
-				{
-					Model:  "virtio",
-					Bridge: "vmbr0",
-				},
+			name: "duplicate slot, fail",
+			disks: []map[string]interface{}{
+				{"slot": "scsi0", "disk_size": "40G"},
+				{"slot": "scsi0", "discard": true},
 			},
+			expectFailure: true,
+		},
+		{
+			name:          "detach with other options, fail",
+			disks:         []map[string]interface{}{{"slot": "scsi0", "detach": true, "disk_size": "40G"}},
+			expectFailure: true,
+		},
+		{
+			name:          "ssd on virtio, fail",
+			disks:         []map[string]interface{}{{"slot": "virtio0", "ssd": true}},
+			expectFailure: true,
 		},
 	}
 
-	for _, tt := range ipconfigTest {
+	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := mandatoryConfig(t)
-			cfg["network_adapters"] = tt.nics
-			cfg["ipconfig"] = tt.ipconfigs
+			cfg["source_disk"] = tt.disks
 
 			var c Config
-			_, _, err := c.Prepare(&c, cfg)
+			_, _, err := c.Prepare(cfg)
 			if err != nil && !tt.expectFailure {
 				t.Fatalf("unexpected failure: %s", err)
 			}
@@ -272,3 +562,61 @@ func TestIpconfig(t *testing.T) {
 		})
 	}
 }
+
+func TestNetworkAdaptersMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		nics          []map[string]interface{}
+		expectedMode  string
+		expectFailure bool
+	}{
+		{
+			name:         "default is merge",
+			expectedMode: "merge",
+		},
+		{
+			name:         "replace",
+			mode:         "replace",
+			nics:         []map[string]interface{}{{"bridge": "vmbr0"}},
+			expectedMode: "replace",
+		},
+		{
+			name:          "replace without network adapters, fail",
+			mode:          "replace",
+			expectFailure: true,
+		},
+		{
+			name:          "invalid mode, fail",
+			mode:          "strip",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			if tt.mode != "" {
+				cfg["network_adapters_mode"] = tt.mode
+			}
+			if tt.nics != nil {
+				cfg["network_adapters"] = tt.nics
+			}
+
+			var c Config
+			_, _, err := c.Prepare(cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure: %s", err)
+				}
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			if c.NetworkAdaptersMode != tt.expectedMode {
+				t.Errorf("expected network_adapters_mode %q, got %q", tt.expectedMode, c.NetworkAdaptersMode)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+)
+
+type sourceDiskReshaper interface {
+	GetVmConfig(*proxmoxapi.VmRef) (map[string]interface{}, error)
+	SetVmConfig(*proxmoxapi.VmRef, map[string]interface{}) (interface{}, error)
+	ResizeQemuDiskRaw(*proxmoxapi.VmRef, string, string) (interface{}, error)
+}
+
+var _ sourceDiskReshaper = &proxmoxapi.Client{}
+
+var rxDiskSize = regexp.MustCompile(`^(\d+(?:\.\d+)?)([KMGT]?)$`)
+
+// parseDiskSize converts a disk size as used by Proxmox, e.g. `16G`, to bytes
+func parseDiskSize(size string) (int64, error) {
+	m := rxDiskSize.FindStringSubmatch(size)
+	if m == nil {
+		return 0, fmt.Errorf("invalid disk size %q: must be a number with an optional K, M, G or T suffix", size)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid disk size %q: %s", size, err)
+	}
+	multiplier := map[string]float64{
+		"":  1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}[m[2]]
+	return int64(value * multiplier), nil
+}
+
+// driveOption returns the value of an option of a drive as found in the VM
+// config, e.g. `local-lvm:vm-100-disk-0,cache=none,size=16G`.
+func driveOption(drive string, option string) (string, bool) {
+	for _, part := range strings.Split(drive, ",")[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		if key == option {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// setDriveOptions sets or replaces options of a drive as found in the VM config
+func setDriveOptions(drive string, options map[string]string) string {
+	parts := strings.Split(drive, ",")
+	set := map[string]bool{}
+	for idx, part := range parts[1:] {
+		key, _, _ := strings.Cut(part, "=")
+		if value, ok := options[key]; ok {
+			parts[idx+1] = key + "=" + value
+			set[key] = true
+		}
+	}
+	// Keep a stable order for the options that weren't present yet
+	for _, key := range []string{"cache", "discard", "ssd", "iothread"} {
+		if value, ok := options[key]; ok && !set[key] {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkSourceDisks verifies that the changes to the source disks can be
+// applied to the disks of the source VM.
+func checkSourceDisks(disks []sourceDiskConfig, vmParams map[string]interface{}) error {
+	for _, disk := range disks {
+		drive, ok := vmParams[disk.Slot].(string)
+		if !ok || strings.Contains(drive, "media=cdrom") {
+			return fmt.Errorf("source_disk %s: no disk found at %s on the source VM", disk.Slot, disk.Slot)
+		}
+		if disk.Size == "" {
+			continue
+		}
+		currentSize, ok := driveOption(drive, "size")
+		if !ok {
+			log.Printf("size of source disk %s unknown, can't check it won't shrink", disk.Slot)
+			continue
+		}
+		current, err := parseDiskSize(currentSize)
+		if err != nil {
+			return fmt.Errorf("source_disk %s: %s", disk.Slot, err)
+		}
+		target, err := parseDiskSize(disk.Size)
+		if err != nil {
+			return fmt.Errorf("source_disk %s: %s", disk.Slot, err)
+		}
+		if target < current {
+			return fmt.Errorf("source_disk %s: disk_size %s is smaller than the disk on the source VM (%s), disks can't be shrunk", disk.Slot, disk.Size, currentSize)
+		}
+	}
+	return nil
+}
+
+// reshapeSourceDisks applies the changes to the disks inherited from the
+// source VM to the clone.
+func reshapeSourceDisks(client sourceDiskReshaper, disks []sourceDiskConfig, vmRef *proxmoxapi.VmRef) error {
+	if len(disks) == 0 {
+		return nil
+	}
+	vmParams, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return fmt.Errorf("error fetching config of the clone: %s", err)
+	}
+
+	changes := map[string]interface{}{}
+	var detach []string
+	for _, disk := range disks {
+		drive, ok := vmParams[disk.Slot].(string)
+		if !ok {
+			return fmt.Errorf("source_disk %s: no disk found at %s on the clone", disk.Slot, disk.Slot)
+		}
+		if disk.Detach {
+			detach = append(detach, disk.Slot)
+			continue
+		}
+
+		options := map[string]string{}
+		if disk.CacheMode != "" {
+			options["cache"] = disk.CacheMode
+		}
+		if disk.Discard != config.TriUnset {
+			options["discard"] = map[bool]string{true: "on", false: "ignore"}[disk.Discard.True()]
+		}
+		if disk.SSD != config.TriUnset {
+			options["ssd"] = map[bool]string{true: "1", false: "0"}[disk.SSD.True()]
+		}
+		if disk.IOThread != config.TriUnset {
+			options["iothread"] = map[bool]string{true: "1", false: "0"}[disk.IOThread.True()]
+		}
+		if len(options) > 0 {
+			changes[disk.Slot] = setDriveOptions(drive, options)
+		}
+	}
+	if len(detach) > 0 {
+		changes["delete"] = strings.Join(detach, ",")
+	}
+	if len(changes) > 0 {
+		if _, err := client.SetVmConfig(vmRef, changes); err != nil {
+			return fmt.Errorf("error updating disks of the clone: %s", err)
+		}
+	}
+
+	for _, disk := range disks {
+		if disk.Detach || disk.Size == "" {
+			continue
+		}
+		if currentSize, ok := driveOption(vmParams[disk.Slot].(string), "size"); ok && currentSize == disk.Size {
+			continue
+		}
+		if _, err := client.ResizeQemuDiskRaw(vmRef, disk.Slot, disk.Size); err != nil {
+			return fmt.Errorf("error resizing %s to %s: %s", disk.Slot, disk.Size, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+)
+
+type sourceDiskReshaperMock struct {
+	vmConfig map[string]interface{}
+	changes  map[string]interface{}
+	resized  map[string]string
+}
+
+func (m *sourceDiskReshaperMock) GetVmConfig(vmr *proxmoxapi.VmRef) (map[string]interface{}, error) {
+	return m.vmConfig, nil
+}
+
+func (m *sourceDiskReshaperMock) SetVmConfig(vmr *proxmoxapi.VmRef, params map[string]interface{}) (interface{}, error) {
+	m.changes = params
+	return nil, nil
+}
+
+func (m *sourceDiskReshaperMock) ResizeQemuDiskRaw(vmr *proxmoxapi.VmRef, disk string, size string) (interface{}, error) {
+	m.resized[disk] = size
+	return nil, nil
+}
+
+var _ sourceDiskReshaper = &sourceDiskReshaperMock{}
+
+func TestParseDiskSize(t *testing.T) {
+	cs := []struct {
+		size          string
+		expected      int64
+		expectFailure bool
+	}{
+		{size: "512", expected: 512},
+		{size: "16G", expected: 16 << 30},
+		{size: "1.5T", expected: 3 << 39},
+		{size: "2048M", expected: 2 << 30},
+		{size: "16GB", expectFailure: true},
+		{size: "-1G", expectFailure: true},
+	}
+	for _, c := range cs {
+		t.Run(c.size, func(t *testing.T) {
+			got, err := parseDiskSize(c.size)
+			if (err != nil) != c.expectFailure {
+				t.Fatalf("Expected failure: %v, got: %v", c.expectFailure, err)
+			}
+			if got != c.expected {
+				t.Errorf("Expected %d bytes, got %d", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckSourceDisks(t *testing.T) {
+	vmParams := map[string]interface{}{
+		"scsi0": "local-lvm:base-100-disk-0,cache=none,size=16G",
+		"ide2":  "local-lvm:vm-100-cloudinit,media=cdrom",
+	}
+	cs := []struct {
+		name          string
+		disks         []sourceDiskConfig
+		expectFailure bool
+	}{
+		{
+			name:  "grow",
+			disks: []sourceDiskConfig{{Slot: "scsi0", Size: "40G"}},
+		},
+		{
+			name:  "same size in another unit",
+			disks: []sourceDiskConfig{{Slot: "scsi0", Size: "16384M"}},
+		},
+		{
+			name:          "shrink, fail",
+			disks:         []sourceDiskConfig{{Slot: "scsi0", Size: "8G"}},
+			expectFailure: true,
+		},
+		{
+			name:          "missing disk, fail",
+			disks:         []sourceDiskConfig{{Slot: "scsi1", Detach: true}},
+			expectFailure: true,
+		},
+		{
+			name:          "cdrom, fail",
+			disks:         []sourceDiskConfig{{Slot: "ide2", Detach: true}},
+			expectFailure: true,
+		},
+	}
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkSourceDisks(c.disks, vmParams)
+			if (err != nil) != c.expectFailure {
+				t.Errorf("Expected failure: %v, got: %v", c.expectFailure, err)
+			}
+		})
+	}
+}
+
+func TestReshapeSourceDisks(t *testing.T) {
+	mock := &sourceDiskReshaperMock{
+		vmConfig: map[string]interface{}{
+			"scsi0":   "local-lvm:vm-101-disk-0,cache=none,size=16G",
+			"scsi1":   "local-lvm:vm-101-disk-1,size=8G",
+			"virtio0": "local-lvm:vm-101-disk-2,size=4G",
+		},
+		resized: map[string]string{},
+	}
+	disks := []sourceDiskConfig{
+		{Slot: "scsi0", Size: "40G", CacheMode: "writeback", Discard: config.TriTrue, SSD: config.TriTrue},
+		{Slot: "scsi1", Detach: true},
+		{Slot: "virtio0", Size: "4G", IOThread: config.TriFalse},
+	}
+
+	err := reshapeSourceDisks(mock, disks, proxmoxapi.NewVmRef(101))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectedChanges := map[string]interface{}{
+		"scsi0":   "local-lvm:vm-101-disk-0,cache=writeback,size=16G,discard=on,ssd=1",
+		"virtio0": "local-lvm:vm-101-disk-2,size=4G,iothread=0",
+		"delete":  "scsi1",
+	}
+	for k, v := range expectedChanges {
+		if mock.changes[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, mock.changes[k])
+		}
+	}
+	if len(mock.changes) != len(expectedChanges) {
+		t.Errorf("Expected changes %v, got %v", expectedChanges, mock.changes)
+	}
+	if len(mock.resized) != 1 || mock.resized["scsi0"] != "40G" {
+		t.Errorf("Expected only scsi0 to be resized to 40G, got %v", mock.resized)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+type networkAdapterReconciler interface {
+	GetVmConfig(*proxmoxapi.VmRef) (map[string]interface{}, error)
+	SetVmConfig(*proxmoxapi.VmRef, map[string]interface{}) (interface{}, error)
+}
+
+var _ networkAdapterReconciler = &proxmoxapi.Client{}
+
+var rxNetworkAdapter = regexp.MustCompile(`^net(\d+)$`)
+
+// sourceMACAddresses returns the MAC addresses of the network adapters in a
+// VM config, by index. Adapters are configured like
+// `virtio=BC:24:11:2E:5A:01,bridge=vmbr0,firewall=1`.
+func sourceMACAddresses(vmParams map[string]interface{}) map[int]string {
+	macs := map[int]string{}
+	for key, value := range vmParams {
+		m := rxNetworkAdapter.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		idx, _ := strconv.Atoi(m[1])
+		adapter, _ := value.(string)
+		first, _, _ := strings.Cut(adapter, ",")
+		if _, mac, ok := strings.Cut(first, "="); ok && mac != "" {
+			macs[idx] = mac
+		}
+	}
+	return macs
+}
+
+// setMACAddress replaces the MAC address of a network adapter config
+func setMACAddress(adapter string, mac string) string {
+	first, rest, hasRest := strings.Cut(adapter, ",")
+	model, _, _ := strings.Cut(first, "=")
+	adapter = model + "=" + mac
+	if hasRest {
+		adapter += "," + rest
+	}
+	return adapter
+}
+
+// reconcileNetworkAdapters applies network_adapters_mode and
+// preserve_source_macs to the network adapters the clone inherited from the
+// source VM and that aren't declared in network_adapters. Declared adapters
+// are configured when the clone is created.
+func reconcileNetworkAdapters(client networkAdapterReconciler, c *Config, vmRef *proxmoxapi.VmRef, sourceMACs map[int]string) error {
+	if c.NetworkAdaptersMode != "replace" && !c.PreserveSourceMACs {
+		return nil
+	}
+	vmParams, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return fmt.Errorf("error fetching config of the clone: %s", err)
+	}
+
+	changes := map[string]interface{}{}
+	var remove []string
+	for key, value := range vmParams {
+		m := rxNetworkAdapter.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		idx, _ := strconv.Atoi(m[1])
+		if idx < len(c.NICs) {
+			continue
+		}
+		if c.NetworkAdaptersMode == "replace" {
+			log.Printf("removing network adapter %s of the source VM", key)
+			remove = append(remove, key)
+			if _, ok := vmParams[fmt.Sprintf("ipconfig%d", idx)]; ok {
+				remove = append(remove, fmt.Sprintf("ipconfig%d", idx))
+			}
+			continue
+		}
+		if mac, ok := sourceMACs[idx]; ok {
+			changes[key] = setMACAddress(value.(string), mac)
+		}
+	}
+	if len(remove) > 0 {
+		slices.Sort(remove)
+		changes["delete"] = strings.Join(remove, ",")
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := client.SetVmConfig(vmRef, changes); err != nil {
+		return fmt.Errorf("error updating network adapters of the clone: %s", err)
+	}
+	return nil
+}
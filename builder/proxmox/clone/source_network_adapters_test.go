@@ -0,0 +1,111 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	proxmox "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
+)
+
+type networkAdapterReconcilerMock struct {
+	vmConfig map[string]interface{}
+	changes  map[string]interface{}
+}
+
+func (m *networkAdapterReconcilerMock) GetVmConfig(vmr *proxmoxapi.VmRef) (map[string]interface{}, error) {
+	return m.vmConfig, nil
+}
+
+func (m *networkAdapterReconcilerMock) SetVmConfig(vmr *proxmoxapi.VmRef, params map[string]interface{}) (interface{}, error) {
+	m.changes = params
+	return nil, nil
+}
+
+var _ networkAdapterReconciler = &networkAdapterReconcilerMock{}
+
+func TestSourceMACAddresses(t *testing.T) {
+	macs := sourceMACAddresses(map[string]interface{}{
+		"net0":  "virtio=BC:24:11:2E:5A:01,bridge=vmbr0,firewall=1",
+		"net2":  "e1000=BC:24:11:2E:5A:03,bridge=vmbr1",
+		"scsi0": "local-lvm:base-100-disk-0,size=16G",
+	})
+	expected := map[int]string{0: "BC:24:11:2E:5A:01", 2: "BC:24:11:2E:5A:03"}
+	if len(macs) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, macs)
+	}
+	for idx, mac := range expected {
+		if macs[idx] != mac {
+			t.Errorf("Expected MAC of net%d to be %s, got %s", idx, mac, macs[idx])
+		}
+	}
+}
+
+func TestReconcileNetworkAdapters(t *testing.T) {
+	sourceMACs := map[int]string{0: "BC:24:11:2E:5A:01", 1: "BC:24:11:2E:5A:02", 2: "BC:24:11:2E:5A:03"}
+	cs := []struct {
+		name            string
+		mode            string
+		preserveMACs    bool
+		expectedChanges map[string]interface{}
+	}{
+		{
+			name:            "merge keeps source adapters untouched",
+			mode:            "merge",
+			expectedChanges: nil,
+		},
+		{
+			name:         "merge with preserved MACs",
+			mode:         "merge",
+			preserveMACs: true,
+			expectedChanges: map[string]interface{}{
+				"net1": "virtio=BC:24:11:2E:5A:02,bridge=vmbr1",
+				"net2": "virtio=BC:24:11:2E:5A:03,bridge=vmbr2,firewall=1",
+			},
+		},
+		{
+			name: "replace removes undeclared adapters and their ipconfig",
+			mode: "replace",
+			expectedChanges: map[string]interface{}{
+				"delete": "ipconfig1,net1,net2",
+			},
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			mock := &networkAdapterReconcilerMock{
+				vmConfig: map[string]interface{}{
+					"net0":      "virtio=AA:AA:AA:AA:AA:00,bridge=vmbr0",
+					"net1":      "virtio=AA:AA:AA:AA:AA:01,bridge=vmbr1",
+					"net2":      "virtio=AA:AA:AA:AA:AA:02,bridge=vmbr2,firewall=1",
+					"ipconfig0": "ip=dhcp",
+					"ipconfig1": "ip=dhcp",
+				},
+			}
+			config := &Config{
+				Config: proxmox.Config{
+					NICs: []proxmox.NICConfig{{Model: "virtio", Bridge: "vmbr0"}},
+				},
+				NetworkAdaptersMode: c.mode,
+				PreserveSourceMACs:  c.preserveMACs,
+			}
+
+			err := reconcileNetworkAdapters(mock, config, proxmoxapi.NewVmRef(101), sourceMACs)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(mock.changes) != len(c.expectedChanges) {
+				t.Fatalf("Expected changes %v, got %v", c.expectedChanges, mock.changes)
+			}
+			for k, v := range c.expectedChanges {
+				if mock.changes[k] != v {
+					t.Errorf("Expected %s to be %q, got %q", k, v, mock.changes[k])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StepCheckLinkedClone verifies, before anything is created, that a linked
+// clone (`full_clone = false`) of the source VM is possible: the source has to
+// be a template and all its disks have to be on storage supporting linked clones.
+//
+// The ID of the source VM is stored in the "linked_clone_parent" state key,
+// so the dependency ends up in the artifact and the template description.
+type StepCheckLinkedClone struct{}
+
+type linkedCloneChecker interface {
+	GetVmConfig(*proxmoxapi.VmRef) (map[string]interface{}, error)
+	GetStorageConfig(string) (map[string]interface{}, error)
+}
+
+var _ linkedCloneChecker = &proxmoxapi.Client{}
+
+// Disks copied along with the source VM
+var rxLinkedCloneDisk = regexp.MustCompile(`^(ide|sata|scsi|virtio|efidisk|tpmstate)\d+$`)
+
+func (s *StepCheckLinkedClone) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(linkedCloneChecker)
+	c := state.Get("clone-config").(*Config)
+
+	if !c.FullClone.False() {
+		return multistep.ActionContinue
+	}
+
+	sourceVmr := state.Get("clone-source").(*cloneSourceRef).vmRef
+	if err := checkLinkedClone(client, sourceVmr); err != nil {
+		err := fmt.Errorf("can't create a linked clone of VM %d: %s", sourceVmr.VmId(), err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Creating a linked clone, the result depends on VM %d", sourceVmr.VmId()))
+	state.Put("linked_clone_parent", sourceVmr.VmId())
+	return multistep.ActionContinue
+}
+
+// checkLinkedClone returns an error if the source VM isn't a template or has
+// disks on storage not supporting linked clones.
+func checkLinkedClone(client linkedCloneChecker, sourceVmr *proxmoxapi.VmRef) error {
+	vmParams, err := client.GetVmConfig(sourceVmr)
+	if err != nil {
+		return fmt.Errorf("error fetching config: %s", err)
+	}
+	if template, _ := vmParams["template"].(float64); template != 1 {
+		return fmt.Errorf("it isn't a template, convert it to a template or set full_clone to true")
+	}
+
+	var slots []string
+	for k := range vmParams {
+		if rxLinkedCloneDisk.MatchString(k) {
+			slots = append(slots, k)
+		}
+	}
+	sort.Strings(slots)
+
+	storageTypes := map[string]string{}
+	for _, slot := range slots {
+		value, _ := vmParams[slot].(string)
+		if strings.Contains(value, "media=cdrom") {
+			continue
+		}
+		volume := strings.SplitN(value, ",", 2)[0]
+		storage, name, found := strings.Cut(volume, ":")
+		if !found {
+			// Pass-through of a host device, e.g. /dev/sdb
+			return fmt.Errorf("disk %s (%s) isn't a volume on a storage", slot, volume)
+		}
+		storageType, ok := storageTypes[storage]
+		if !ok {
+			storageConfig, err := client.GetStorageConfig(storage)
+			if err != nil {
+				return fmt.Errorf("error fetching config of storage %s: %s", storage, err)
+			}
+			storageType, _ = storageConfig["type"].(string)
+			storageTypes[storage] = storageType
+		}
+		if err := linkedCloneSupported(storageType, name); err != nil {
+			return fmt.Errorf("disk %s on storage %s: %s", slot, storage, err)
+		}
+	}
+	return nil
+}
+
+// linkedCloneSupported checks whether a volume on a storage of the given
+// type can be the base of a linked clone.
+func linkedCloneSupported(storageType string, volume string) error {
+	switch storageType {
+	case "lvmthin", "zfspool", "zfs", "rbd", "btrfs":
+		return nil
+	case "dir", "nfs", "cifs", "glusterfs", "cephfs":
+		// File based storages need a format supporting backing files
+		if !strings.HasSuffix(volume, ".qcow2") {
+			return fmt.Errorf("linked clones on %s storage require disks in qcow2 format", storageType)
+		}
+		return nil
+	case "lvm", "iscsi", "iscsidirect":
+		return fmt.Errorf("%s storage doesn't support linked clones", storageType)
+	default:
+		log.Printf("[WARN] - unknown storage type %q, assuming it supports linked clones", storageType)
+		return nil
+	}
+}
+
+func (s *StepCheckLinkedClone) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,146 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+)
+
+type linkedCloneCheckerMock struct {
+	vmConfig     map[string]interface{}
+	storageTypes map[string]string
+}
+
+func (m *linkedCloneCheckerMock) GetVmConfig(*proxmoxapi.VmRef) (map[string]interface{}, error) {
+	return m.vmConfig, nil
+}
+
+func (m *linkedCloneCheckerMock) GetStorageConfig(storage string) (map[string]interface{}, error) {
+	storageType, ok := m.storageTypes[storage]
+	if !ok {
+		return nil, fmt.Errorf("storage '%s' does not exist", storage)
+	}
+	return map[string]interface{}{"storage": storage, "type": storageType}, nil
+}
+
+var _ linkedCloneChecker = &linkedCloneCheckerMock{}
+
+func TestCheckLinkedClone(t *testing.T) {
+	storageTypes := map[string]string{
+		"local":     "dir",
+		"local-lvm": "lvmthin",
+		"lvm":       "lvm",
+		"ceph":      "rbd",
+	}
+
+	cs := []struct {
+		name           string
+		fullClone      config.Trilean
+		vmConfig       map[string]interface{}
+		expectedAction multistep.StepAction
+		expectedError  string
+	}{
+		{
+			name:      "full clones aren't checked",
+			fullClone: config.TriUnset,
+			vmConfig: map[string]interface{}{
+				"scsi0": "lvm:vm-100-disk-0,size=8G",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:      "template on thin storage",
+			fullClone: config.TriFalse,
+			vmConfig: map[string]interface{}{
+				"template": 1.0,
+				"scsi0":    "local-lvm:base-100-disk-0,size=8G",
+				"efidisk0": "ceph:base-100-disk-1,efitype=4m,size=1M",
+				"ide2":     "lvm:iso/ubuntu.iso,media=cdrom",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:      "qcow2 on directory storage",
+			fullClone: config.TriFalse,
+			vmConfig: map[string]interface{}{
+				"template": 1.0,
+				"virtio0":  "local:100/base-100-disk-0.qcow2,size=8G",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:      "source has to be a template",
+			fullClone: config.TriFalse,
+			vmConfig: map[string]interface{}{
+				"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+			},
+			expectedAction: multistep.ActionHalt,
+			expectedError:  "isn't a template",
+		},
+		{
+			name:      "raw on directory storage",
+			fullClone: config.TriFalse,
+			vmConfig: map[string]interface{}{
+				"template": 1.0,
+				"scsi0":    "local-lvm:base-100-disk-0,size=8G",
+				"scsi1":    "local:100/base-100-disk-1.raw,size=8G",
+			},
+			expectedAction: multistep.ActionHalt,
+			expectedError:  "disk scsi1 on storage local: linked clones on dir storage require disks in qcow2 format",
+		},
+		{
+			name:      "thick LVM",
+			fullClone: config.TriFalse,
+			vmConfig: map[string]interface{}{
+				"template":  1.0,
+				"tpmstate0": "lvm:base-100-disk-2,size=4M,version=v2.0",
+			},
+			expectedAction: multistep.ActionHalt,
+			expectedError:  "lvm storage doesn't support linked clones",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			sourceVmr := proxmoxapi.NewVmRef(100)
+			sourceVmr.SetNode("pve")
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("clone-config", &Config{FullClone: c.fullClone})
+			state.Put("clone-source", &cloneSourceRef{vmRef: sourceVmr})
+			state.Put("proxmoxClient", &linkedCloneCheckerMock{vmConfig: c.vmConfig, storageTypes: storageTypes})
+
+			step := StepCheckLinkedClone{}
+			action := step.Run(context.TODO(), state)
+			if action != c.expectedAction {
+				t.Fatalf("Expected action %s, got %s", c.expectedAction, action)
+			}
+
+			if c.expectedError != "" {
+				err := state.Get("error").(error)
+				if !strings.Contains(err.Error(), c.expectedError) {
+					t.Errorf("Expected error to contain %q, got %q", c.expectedError, err)
+				}
+				return
+			}
+
+			parent, ok := state.GetOk("linked_clone_parent")
+			if ok != c.fullClone.False() {
+				t.Fatalf("Expected linked_clone_parent to be set: %v, got: %v", c.fullClone.False(), ok)
+			}
+			if ok && parent.(int) != 100 {
+				t.Errorf("Expected linked_clone_parent to be 100, got %v", parent)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"slices"
 	"strings"
 
 	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
@@ -20,12 +21,13 @@ import (
 // and identifies any attached disks to prevent hcl/json defined disks
 // and isos from overwriting their assignments.
 // (Enables append behavior for hcl/json defined disks and ISOs)
+// It also records the MAC addresses of the network adapters of the source vm.
 type StepMapSourceDisks struct{}
 
 type cloneSource interface {
 	GetVmConfig(*proxmoxapi.VmRef) (map[string]interface{}, error)
-	GetVmRefsByName(string) ([]*proxmoxapi.VmRef, error)
-	CheckVmRef(*proxmoxapi.VmRef) error
+	GetItemList(string) (map[string]interface{}, error)
+	GetItemListInterfaceArray(string) ([]interface{}, error)
 }
 
 var _ cloneSource = &proxmoxapi.Client{}
@@ -35,30 +37,16 @@ func (s *StepMapSourceDisks) Run(ctx context.Context, state multistep.StateBag)
 	client := state.Get("proxmoxClient").(cloneSource)
 	c := state.Get("clone-config").(*Config)
 
-	var sourceVmr *proxmoxapi.VmRef
-	if c.CloneVM != "" {
-		sourceVmrs, err := client.GetVmRefsByName(c.CloneVM)
-		if err != nil {
-			state.Put("error", fmt.Errorf("Could not retrieve VM: %s", err))
-			return multistep.ActionHalt
-		}
-		// prefer source Vm located on same node
-		sourceVmr = sourceVmrs[0]
-		for _, candVmr := range sourceVmrs {
-			if candVmr.Node() == c.Node {
-				sourceVmr = candVmr
-			}
-		}
-	} else if c.CloneVMID != 0 {
-		sourceVmr = proxmoxapi.NewVmRef(c.CloneVMID)
-		err := client.CheckVmRef(sourceVmr)
-		if err != nil {
-			state.Put("error", fmt.Errorf("Could not retrieve VM: %s", err))
-			return multistep.ActionHalt
-		}
-	}
+	source := state.Get("clone-source").(*cloneSourceRef)
+	sourceVmr := source.vmRef
 
-	vmParams, err := client.GetVmConfig(sourceVmr)
+	var vmParams map[string]interface{}
+	var err error
+	if c.CloneSnapshot != "" {
+		vmParams, err = getSnapshotConfig(client, sourceVmr, c.CloneSnapshot)
+	} else {
+		vmParams, err = client.GetVmConfig(sourceVmr)
+	}
 	if err != nil {
 		err := fmt.Errorf("error fetching template config: %s", err)
 		state.Put("error", err)
@@ -88,11 +76,61 @@ func (s *StepMapSourceDisks) Run(ctx context.Context, state multistep.StateBag)
 		}
 	}
 
+	source.macAddresses = sourceMACAddresses(vmParams)
+
+	if err := checkSourceDisks(c.SourceDisks, vmParams); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	// store discovered disks in common config
 	d := state.Get("config").(*proxmox.Config)
 	d.CloneSourceDisks = sourceDisks
 
+	if c.PreserveSourceMACs {
+		for idx := range d.NICs {
+			if mac, ok := source.macAddresses[idx]; ok && d.NICs[idx].MACAddress == "" {
+				log.Printf("keeping MAC address %s of net%d", mac, idx)
+				d.NICs[idx].MACAddress = mac
+			}
+		}
+	}
+
 	return multistep.ActionContinue
 }
 
+// getSnapshotConfig returns the configuration of the source VM as it was
+// when the snapshot was taken, failing if the snapshot doesn't exist.
+func getSnapshotConfig(client cloneSource, sourceVmr *proxmoxapi.VmRef, snapshot string) (map[string]interface{}, error) {
+	snapshots, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot", sourceVmr.Node(), sourceVmr.VmId()))
+	if err != nil {
+		return nil, fmt.Errorf("could not list snapshots of VM %d: %s", sourceVmr.VmId(), err)
+	}
+	var names []string
+	for _, item := range snapshots {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// The current state is listed as a pseudo snapshot
+		if name, ok := entry["name"].(string); ok && name != "current" {
+			names = append(names, name)
+		}
+	}
+	if !slices.Contains(names, snapshot) {
+		return nil, fmt.Errorf("snapshot %q not found on VM %d, available snapshots: %s", snapshot, sourceVmr.VmId(), strings.Join(names, ", "))
+	}
+
+	snapshotConfig, err := client.GetItemList(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s/config", sourceVmr.Node(), sourceVmr.VmId(), snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot %q of VM %d: %s", snapshot, sourceVmr.VmId(), err)
+	}
+	vmParams, ok := snapshotConfig["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response reading snapshot %q of VM %d", snapshot, sourceVmr.VmId())
+	}
+	return vmParams, nil
+}
+
 func (s *StepMapSourceDisks) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,133 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	proxmox "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type cloneSourceMock struct {
+	vmConfig        map[string]interface{}
+	snapshotConfigs map[string]map[string]interface{}
+}
+
+func (m *cloneSourceMock) GetVmConfig(vmr *proxmoxapi.VmRef) (map[string]interface{}, error) {
+	return m.vmConfig, nil
+}
+
+func (m *cloneSourceMock) GetItemList(url string) (map[string]interface{}, error) {
+	for name, config := range m.snapshotConfigs {
+		if strings.HasSuffix(url, "/snapshot/"+name+"/config") {
+			return map[string]interface{}{"data": config}, nil
+		}
+	}
+	return nil, fmt.Errorf("500 snapshot does not exist")
+}
+
+func (m *cloneSourceMock) GetItemListInterfaceArray(url string) ([]interface{}, error) {
+	snapshots := []interface{}{
+		map[string]interface{}{"name": "current"},
+	}
+	for name := range m.snapshotConfigs {
+		snapshots = append(snapshots, map[string]interface{}{"name": name})
+	}
+	return snapshots, nil
+}
+
+var _ cloneSource = &cloneSourceMock{}
+
+func TestStepMapSourceDisks(t *testing.T) {
+	mock := &cloneSourceMock{
+		vmConfig: map[string]interface{}{
+			"scsi0": "local-lvm:base-100-disk-0,size=16G",
+			"scsi1": "local-lvm:base-100-disk-1,size=8G",
+			"ide2":  "local-lvm:vm-100-cloudinit,media=cdrom",
+			"net0":  "virtio=BC:24:11:2E:5A:01,bridge=vmbr0",
+			"net1":  "virtio=BC:24:11:2E:5A:02,bridge=vmbr1",
+		},
+		snapshotConfigs: map[string]map[string]interface{}{
+			"pre-hardening": {
+				"scsi0": "local-lvm:base-100-disk-0,size=16G",
+				"ide2":  "local:iso/debian.iso,media=cdrom",
+			},
+		},
+	}
+
+	cs := []struct {
+		name           string
+		snapshot       string
+		preserveMACs   bool
+		expectedAction multistep.StepAction
+		expectedDisks  []string
+		expectedMACs   []string
+	}{
+		{
+			name:           "current state",
+			expectedAction: multistep.ActionContinue,
+			expectedDisks:  []string{"scsi0", "scsi1"},
+		},
+		{
+			name:           "disks as in the snapshot",
+			snapshot:       "pre-hardening",
+			expectedAction: multistep.ActionContinue,
+			expectedDisks:  []string{"scsi0"},
+		},
+		{
+			name:           "source MACs are kept for declared adapters without one",
+			preserveMACs:   true,
+			expectedAction: multistep.ActionContinue,
+			expectedDisks:  []string{"scsi0", "scsi1"},
+			expectedMACs:   []string{"BC:24:11:2E:5A:01", "AA:AA:AA:AA:AA:AA"},
+		},
+		{
+			name:           "missing snapshot should halt",
+			snapshot:       "post-hardening",
+			expectedAction: multistep.ActionHalt,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			commonConfig := &proxmox.Config{
+				NICs: []proxmox.NICConfig{{Bridge: "vmbr0"}, {Bridge: "vmbr1", MACAddress: "AA:AA:AA:AA:AA:AA"}},
+			}
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("proxmoxClient", mock)
+			state.Put("config", commonConfig)
+			state.Put("clone-config", &Config{CloneVM: "golden", CloneSnapshot: c.snapshot, PreserveSourceMACs: c.preserveMACs})
+			state.Put("clone-source", &cloneSourceRef{vmRef: proxmoxapi.NewVmRef(100)})
+
+			step := &StepMapSourceDisks{}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if _, gotError := state.GetOk("error"); gotError != (c.expectedAction == multistep.ActionHalt) {
+				t.Errorf("Expected error state to be: %v, got: %v", c.expectedAction == multistep.ActionHalt, gotError)
+			}
+			disks := commonConfig.CloneSourceDisks
+			slices.Sort(disks)
+			if !slices.Equal(disks, c.expectedDisks) {
+				t.Errorf("Expected source disks %v, got %v", c.expectedDisks, disks)
+			}
+			for idx, mac := range c.expectedMACs {
+				if commonConfig.NICs[idx].MACAddress != mac {
+					t.Errorf("Expected MAC of net%d to be %s, got %s", idx, mac, commonConfig.NICs[idx].MACAddress)
+				}
+			}
+		})
+	}
+}
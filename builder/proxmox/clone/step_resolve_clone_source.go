@@ -0,0 +1,131 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StepResolveCloneSource looks up the VM to clone from, given by `clone_vm`
+// or `clone_vm_id`, so that all later steps use the same source VM.
+//
+// When several VMs share the name, the one on `node` is preferred, then one
+// that can be cloned directly onto `node`. A source VM on another node is
+// cloned directly onto `node` if all its disks are on shared storage,
+// otherwise the clone is created next to the source VM and migrated.
+//
+// The source is stored as *cloneSourceRef in the "clone-source" state key,
+// and its VM ID in "clone_source_vmid" for the shared steps.
+type StepResolveCloneSource struct{}
+
+type cloneSourceResolver interface {
+	GetVmRefsByName(string) ([]*proxmoxapi.VmRef, error)
+	CheckVmRef(*proxmoxapi.VmRef) error
+	GetItemList(string) (map[string]interface{}, error)
+}
+
+var _ cloneSourceResolver = &proxmoxapi.Client{}
+
+// cloneSourceRef is the VM to clone from and how to get the clone onto the build node
+type cloneSourceRef struct {
+	vmRef *proxmoxapi.VmRef
+	// Clone onto the node of the source VM, then migrate the clone to the build node
+	migrate bool
+	// MAC addresses of the network adapters of the source VM, by index,
+	// set by StepMapSourceDisks
+	macAddresses map[int]string
+}
+
+func (s *StepResolveCloneSource) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(cloneSourceResolver)
+	c := state.Get("clone-config").(*Config)
+
+	source, err := resolveCloneSource(client, c)
+	if err != nil {
+		err := fmt.Errorf("could not resolve clone source: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	sourceVmr := source.vmRef
+	switch {
+	case sourceVmr.Node() == c.Node:
+		ui.Say(fmt.Sprintf("Cloning from VM %d on node %s", sourceVmr.VmId(), sourceVmr.Node()))
+	case source.migrate:
+		if c.FullClone.False() {
+			err := fmt.Errorf("VM %d on node %s has disks on local storage, linked clones of it can only be built on node %s", sourceVmr.VmId(), sourceVmr.Node(), sourceVmr.Node())
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Say(fmt.Sprintf("Cloning from VM %d on node %s, the clone will be migrated to node %s as the source has disks on local storage", sourceVmr.VmId(), sourceVmr.Node(), c.Node))
+	default:
+		ui.Say(fmt.Sprintf("Cloning from VM %d on node %s onto node %s", sourceVmr.VmId(), sourceVmr.Node(), c.Node))
+	}
+
+	state.Put("clone-source", source)
+	state.Put("clone_source_vmid", sourceVmr.VmId())
+	return multistep.ActionContinue
+}
+
+func resolveCloneSource(client cloneSourceResolver, c *Config) (*cloneSourceRef, error) {
+	var candidates []*proxmoxapi.VmRef
+	if c.CloneVM != "" {
+		vmrs, err := client.GetVmRefsByName(c.CloneVM)
+		if err != nil {
+			return nil, err
+		}
+		candidates = vmrs
+	} else {
+		vmr := proxmoxapi.NewVmRef(c.CloneVMID)
+		if err := client.CheckVmRef(vmr); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, vmr)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no VM found")
+	}
+
+	// Keep the choice stable between builds
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Node() < candidates[j].Node()
+	})
+	for _, vmr := range candidates {
+		if vmr.Node() == c.Node {
+			return &cloneSourceRef{vmRef: vmr}, nil
+		}
+	}
+	for _, vmr := range candidates {
+		if !hasLocalDisks(client, vmr) {
+			return &cloneSourceRef{vmRef: vmr}, nil
+		}
+	}
+	return &cloneSourceRef{vmRef: candidates[0], migrate: true}, nil
+}
+
+// hasLocalDisks reports whether the VM has disks on storage that isn't
+// available on other nodes, which prevents cloning it directly onto another node.
+func hasLocalDisks(client cloneSourceResolver, vmr *proxmoxapi.VmRef) bool {
+	preconditions, err := client.GetItemList(fmt.Sprintf("/nodes/%s/qemu/%d/migrate", vmr.Node(), vmr.VmId()))
+	if err != nil {
+		// Assume shared storage, the clone API reports an error otherwise
+		log.Printf("could not check the storage of VM %d: %s", vmr.VmId(), err)
+		return false
+	}
+	data, _ := preconditions["data"].(map[string]interface{})
+	localDisks, _ := data["local_disks"].([]interface{})
+	return len(localDisks) > 0
+}
+
+func (s *StepResolveCloneSource) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,159 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	proxmox "github.com/hashicorp/packer-plugin-proxmox/builder/proxmox/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+)
+
+type cloneSourceResolverMock struct {
+	// VMs named "golden", by node
+	vms map[string]int
+	// Nodes on which the VMs have disks on local storage
+	localDisks map[string]bool
+}
+
+func (m *cloneSourceResolverMock) GetVmRefsByName(name string) ([]*proxmoxapi.VmRef, error) {
+	var vmrs []*proxmoxapi.VmRef
+	for node, id := range m.vms {
+		vmr := proxmoxapi.NewVmRef(id)
+		vmr.SetNode(node)
+		vmrs = append(vmrs, vmr)
+	}
+	if len(vmrs) == 0 {
+		return nil, fmt.Errorf("vm '%s' not found", name)
+	}
+	return vmrs, nil
+}
+
+func (m *cloneSourceResolverMock) CheckVmRef(vmr *proxmoxapi.VmRef) error {
+	for node, id := range m.vms {
+		if id == vmr.VmId() {
+			vmr.SetNode(node)
+			return nil
+		}
+	}
+	return fmt.Errorf("vm '%d' not found", vmr.VmId())
+}
+
+func (m *cloneSourceResolverMock) GetItemList(url string) (map[string]interface{}, error) {
+	for node := range m.vms {
+		if url == fmt.Sprintf("/nodes/%s/qemu/%d/migrate", node, m.vms[node]) && m.localDisks[node] {
+			return map[string]interface{}{"data": map[string]interface{}{
+				"local_disks": []interface{}{map[string]interface{}{"volid": "local-lvm:base-100-disk-0"}},
+			}}, nil
+		}
+	}
+	return map[string]interface{}{"data": map[string]interface{}{"local_disks": []interface{}{}}}, nil
+}
+
+var _ cloneSourceResolver = &cloneSourceResolverMock{}
+
+func TestStepResolveCloneSource(t *testing.T) {
+	cs := []struct {
+		name            string
+		vms             map[string]int
+		localDisks      map[string]bool
+		cloneVMID       int
+		fullClone       config.Trilean
+		expectedAction  multistep.StepAction
+		expectedVMID    int
+		expectedNode    string
+		expectedMigrate bool
+	}{
+		{
+			name:           "VM on the build node is preferred",
+			vms:            map[string]int{"pve1": 100, "pve2": 200, "pve3": 300},
+			localDisks:     map[string]bool{"pve1": true, "pve2": true, "pve3": true},
+			expectedAction: multistep.ActionContinue,
+			expectedVMID:   200,
+			expectedNode:   "pve2",
+		},
+		{
+			name:           "VM on shared storage is cloned directly",
+			vms:            map[string]int{"pve1": 100, "pve3": 300},
+			localDisks:     map[string]bool{"pve1": true},
+			expectedAction: multistep.ActionContinue,
+			expectedVMID:   300,
+			expectedNode:   "pve3",
+		},
+		{
+			name:            "VM on local storage is migrated",
+			vms:             map[string]int{"pve3": 300, "pve1": 100},
+			localDisks:      map[string]bool{"pve1": true, "pve3": true},
+			expectedAction:  multistep.ActionContinue,
+			expectedVMID:    100,
+			expectedNode:    "pve1",
+			expectedMigrate: true,
+		},
+		{
+			name:           "linked clone of VM on local storage of another node should halt",
+			vms:            map[string]int{"pve1": 100},
+			localDisks:     map[string]bool{"pve1": true},
+			fullClone:      config.TriFalse,
+			expectedAction: multistep.ActionHalt,
+		},
+		{
+			name:           "VM by ID",
+			vms:            map[string]int{"pve1": 100, "pve3": 300},
+			cloneVMID:      300,
+			expectedAction: multistep.ActionContinue,
+			expectedVMID:   300,
+			expectedNode:   "pve3",
+		},
+		{
+			name:           "missing VM should halt",
+			vms:            map[string]int{},
+			expectedAction: multistep.ActionHalt,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			mock := &cloneSourceResolverMock{vms: c.vms, localDisks: c.localDisks}
+			cloneConfig := &Config{
+				Config:    proxmox.Config{Node: "pve2"},
+				CloneVM:   "golden",
+				FullClone: c.fullClone,
+			}
+			if c.cloneVMID != 0 {
+				cloneConfig.CloneVM = ""
+				cloneConfig.CloneVMID = c.cloneVMID
+			}
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("proxmoxClient", mock)
+			state.Put("clone-config", cloneConfig)
+
+			step := &StepResolveCloneSource{}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Fatalf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if action == multistep.ActionHalt {
+				if _, ok := state.GetOk("error"); !ok {
+					t.Error("Expected an error in the state")
+				}
+				return
+			}
+			source := state.Get("clone-source").(*cloneSourceRef)
+			if source.vmRef.VmId() != c.expectedVMID || source.vmRef.Node() != c.expectedNode {
+				t.Errorf("Expected VM %d on %s, got %d on %s", c.expectedVMID, c.expectedNode, source.vmRef.VmId(), source.vmRef.Node())
+			}
+			if source.migrate != c.expectedMigrate {
+				t.Errorf("Expected migrate to be %v, got %v", c.expectedMigrate, source.migrate)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// StepUploadCloudInitSnippets writes the cicustom snippets to the snippets
+// storage, so they can be referenced by the cloned VM. Snippets only used by
+// the build are removed again, together with the reference on the template.
+type StepUploadCloudInitSnippets struct {
+	files []string
+}
+
+type snippetStorage interface {
+	GetStorageConfig(id string) (map[string]interface{}, error)
+	SetVmConfig(*proxmoxapi.VmRef, map[string]interface{}) (interface{}, error)
+}
+
+var _ snippetStorage = &proxmoxapi.Client{}
+
+// snippetWriter writes and removes files on the Proxmox node
+type snippetWriter interface {
+	WriteFile(name string, data []byte) error
+	Remove(name string) error
+	Close() error
+}
+
+// newSnippetWriter connects to the Proxmox node. Replaced in tests.
+var newSnippetWriter = func(c *cloudInitCustomConfig) (snippetWriter, error) {
+	return newSFTPSnippetWriter(c)
+}
+
+func (s *StepUploadCloudInitSnippets) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(snippetStorage)
+	c := state.Get("clone-config").(*Config)
+
+	if !c.CloudInitCustom.isSet() {
+		return multistep.ActionContinue
+	}
+	storage := c.CloudInitCustom.SnippetsStoragePool
+
+	storageConfig, err := client.GetStorageConfig(storage)
+	if err != nil {
+		err := fmt.Errorf("error fetching config of storage %s: %s", storage, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	content, _ := storageConfig["content"].(string)
+	if !strings.Contains(","+content+",", ",snippets,") {
+		err := fmt.Errorf("storage %s does not allow snippets content", storage)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	storagePath, _ := storageConfig["path"].(string)
+	if storagePath == "" {
+		err := fmt.Errorf("storage %s is not a file based storage, snippets can't be written to it", storage)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	writer, err := newSnippetWriter(&c.CloudInitCustom)
+	if err != nil {
+		err := fmt.Errorf("error connecting to %s to write snippets: %s", c.CloudInitCustom.SSHHost, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer writer.Close()
+
+	// Templates kept with keep_on_template reference the snippets of their
+	// build, later builds of the same VM must not overwrite them
+	buildID := uuid.TimeOrderedUUID()
+	custom := &proxmoxapi.CloudInitCustom{}
+	for _, kind := range []string{"user", "network", "meta", "vendor"} {
+		data, ok := c.CloudInitCustom.snippets[kind]
+		if !ok {
+			continue
+		}
+		filename := fmt.Sprintf("%s-%s-%s.yml", c.VMName, buildID, kind)
+		ui.Say(fmt.Sprintf("Writing Cloud-Init %s snippet to %s:snippets/%s", kind, storage, filename))
+		file := path.Join(storagePath, "snippets", filename)
+		if err := writer.WriteFile(file, []byte(data)); err != nil {
+			err := fmt.Errorf("error writing snippet %s: %s", file, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		s.files = append(s.files, file)
+
+		snippet := &proxmoxapi.CloudInitSnippet{
+			Storage:  storage,
+			FilePath: proxmoxapi.CloudInitSnippetPath("snippets/" + filename),
+		}
+		switch kind {
+		case "user":
+			custom.User = snippet
+		case "network":
+			custom.Network = snippet
+		case "meta":
+			custom.Meta = snippet
+		case "vendor":
+			custom.Vendor = snippet
+		}
+	}
+	state.Put("cloud_init_custom", custom)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepUploadCloudInitSnippets) Cleanup(state multistep.StateBag) {
+	if len(s.files) == 0 {
+		return
+	}
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(snippetStorage)
+	c := state.Get("clone-config").(*Config)
+
+	_, success := state.GetOk("success")
+	if success && c.CloudInitCustom.KeepOnTemplate {
+		return
+	}
+	if vmRef, ok := state.GetOk("vmRef"); ok && success {
+		// The template outlives the snippets, don't leave it referencing them
+		_, err := client.SetVmConfig(vmRef.(*proxmoxapi.VmRef), map[string]interface{}{
+			"delete": "cicustom",
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error removing cicustom from template: %s", err))
+		}
+	}
+
+	writer, err := newSnippetWriter(&c.CloudInitCustom)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error connecting to %s to delete snippets, please delete %s manually: %s", c.CloudInitCustom.SSHHost, strings.Join(s.files, ", "), err))
+		return
+	}
+	defer writer.Close()
+	for _, file := range s.files {
+		if err := writer.Remove(file); err != nil {
+			ui.Error(fmt.Sprintf("Error deleting snippet %s: %s", file, err))
+			continue
+		}
+		log.Printf("Deleted snippet %s", file)
+	}
+}
+
+type sftpSnippetWriter struct {
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPSnippetWriter(c *cloudInitCustomConfig) (*sftpSnippetWriter, error) {
+	var auth []ssh.AuthMethod
+	if c.SSHPrivateKeyFile != "" {
+		key, err := os.ReadFile(c.SSHPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.SSHPassword != "" {
+		auth = append(auth, ssh.Password(c.SSHPassword))
+	}
+
+	// The session runs as root on the node, never trust an unknown host
+	var hostKeyCallback ssh.HostKeyCallback
+	if c.SSHHostKey != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.SSHHostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh_host_key: %s", err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(hostKey)
+	} else {
+		var err error
+		hostKeyCallback, err = knownhosts.New(c.SSHKnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ssh_known_hosts_file: %s", err)
+		}
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(c.SSHHost, strconv.Itoa(c.SSHPort)), &ssh.ClientConfig{
+		User:            c.SSHUsername,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpSnippetWriter{conn: conn, client: client}, nil
+}
+
+func (w *sftpSnippetWriter) WriteFile(name string, data []byte) error {
+	if err := w.client.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := w.client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w *sftpSnippetWriter) Remove(name string) error {
+	return w.client.Remove(name)
+}
+
+func (w *sftpSnippetWriter) Close() error {
+	w.client.Close()
+	return w.conn.Close()
+}
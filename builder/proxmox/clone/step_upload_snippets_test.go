@@ -0,0 +1,182 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmoxclone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type snippetStorageMock struct {
+	storageConfig map[string]interface{}
+	vmConfig      map[string]interface{}
+}
+
+func (m *snippetStorageMock) GetStorageConfig(id string) (map[string]interface{}, error) {
+	if m.storageConfig == nil {
+		return nil, fmt.Errorf("storage %s does not exist", id)
+	}
+	return m.storageConfig, nil
+}
+
+func (m *snippetStorageMock) SetVmConfig(vmr *proxmoxapi.VmRef, params map[string]interface{}) (interface{}, error) {
+	m.vmConfig = params
+	return nil, nil
+}
+
+var _ snippetStorage = &snippetStorageMock{}
+
+type snippetWriterMock struct {
+	files map[string]string
+}
+
+func (m *snippetWriterMock) WriteFile(name string, data []byte) error {
+	m.files[name] = string(data)
+	return nil
+}
+
+func (m *snippetWriterMock) Remove(name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+func (m *snippetWriterMock) Close() error {
+	return nil
+}
+
+func TestStepUploadCloudInitSnippets(t *testing.T) {
+	cs := []struct {
+		name               string
+		storageConfig      map[string]interface{}
+		keepOnTemplate     bool
+		success            bool
+		expectedAction     multistep.StepAction
+		expectedCustom     bool
+		expectedFilesAfter int
+		expectDeleteConfig bool
+	}{
+		{
+			name:               "build only snippets are removed after a successful build",
+			storageConfig:      map[string]interface{}{"content": "iso,snippets", "path": "/var/lib/vz"},
+			success:            true,
+			expectedAction:     multistep.ActionContinue,
+			expectedCustom:     true,
+			expectedFilesAfter: 0,
+			expectDeleteConfig: true,
+		},
+		{
+			name:               "snippets kept on template",
+			storageConfig:      map[string]interface{}{"content": "snippets", "path": "/var/lib/vz"},
+			keepOnTemplate:     true,
+			success:            true,
+			expectedAction:     multistep.ActionContinue,
+			expectedCustom:     true,
+			expectedFilesAfter: 1,
+		},
+		{
+			name:               "snippets kept on template are removed after a failed build",
+			storageConfig:      map[string]interface{}{"content": "snippets", "path": "/var/lib/vz"},
+			keepOnTemplate:     true,
+			success:            false,
+			expectedAction:     multistep.ActionContinue,
+			expectedCustom:     true,
+			expectedFilesAfter: 0,
+		},
+		{
+			name:           "storage without snippets content should halt",
+			storageConfig:  map[string]interface{}{"content": "iso,vztmpl", "path": "/var/lib/vz"},
+			expectedAction: multistep.ActionHalt,
+		},
+		{
+			name:           "storage without path should halt",
+			storageConfig:  map[string]interface{}{"content": "snippets"},
+			expectedAction: multistep.ActionHalt,
+		},
+		{
+			name:           "unknown storage should halt",
+			expectedAction: multistep.ActionHalt,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &snippetStorageMock{storageConfig: c.storageConfig}
+			writer := &snippetWriterMock{files: map[string]string{}}
+			newSnippetWriter = func(*cloudInitCustomConfig) (snippetWriter, error) {
+				return writer, nil
+			}
+
+			cfg := &Config{}
+			cfg.VMName = "packer-test"
+			cfg.CloudInitCustom = cloudInitCustomConfig{
+				SnippetsStoragePool: "local",
+				UserData:            "#cloud-config\n",
+				KeepOnTemplate:      c.keepOnTemplate,
+				snippets:            map[string]string{"user": "#cloud-config\n"},
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("proxmoxClient", client)
+			state.Put("clone-config", cfg)
+
+			step := &StepUploadCloudInitSnippets{}
+			action := step.Run(context.TODO(), state)
+			if action != c.expectedAction {
+				t.Fatalf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if action == multistep.ActionHalt {
+				if _, ok := state.GetOk("error"); !ok {
+					t.Error("Expected an error in the state")
+				}
+				return
+			}
+
+			custom := state.Get("cloud_init_custom").(*proxmoxapi.CloudInitCustom)
+			if custom.User == nil {
+				t.Fatal("Expected a user snippet")
+			}
+			snippet := custom.User.String()
+			if !strings.HasPrefix(snippet, "local:snippets/packer-test-") || !strings.HasSuffix(snippet, "-user.yml") {
+				t.Errorf("Unexpected user snippet %q", snippet)
+			}
+			if writer.files["/var/lib/vz/"+strings.TrimPrefix(snippet, "local:")] != "#cloud-config\n" {
+				t.Errorf("Expected user snippet to be written, got %v", writer.files)
+			}
+
+			// Another build of the same VM must not overwrite the snippets
+			otherState := new(multistep.BasicStateBag)
+			otherState.Put("ui", packersdk.TestUi(t))
+			otherState.Put("proxmoxClient", client)
+			otherState.Put("clone-config", cfg)
+			other := &StepUploadCloudInitSnippets{}
+			other.Run(context.TODO(), otherState)
+			if len(writer.files) != 2 {
+				t.Errorf("Expected the snippets of two builds to be kept apart, got %v", writer.files)
+			}
+			for _, file := range other.files {
+				delete(writer.files, file)
+			}
+
+			state.Put("vmRef", proxmoxapi.NewVmRef(100))
+			if c.success {
+				state.Put("success", true)
+			}
+			step.Cleanup(state)
+
+			if len(writer.files) != c.expectedFilesAfter {
+				t.Errorf("Expected %d snippets after cleanup, got %d", c.expectedFilesAfter, len(writer.files))
+			}
+			if (client.vmConfig["delete"] == "cicustom") != c.expectDeleteConfig {
+				t.Errorf("Expected cicustom to be removed from the template: %v, got config %v", c.expectDeleteConfig, client.vmConfig)
+			}
+		})
+	}
+}
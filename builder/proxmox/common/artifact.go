@@ -13,9 +13,11 @@ import (
 )
 
 type Artifact struct {
-	builderID     string
-	artifactID    int
-	artifactType  string
+	builderID    string
+	artifactID   int
+	artifactType string
+	// Name of the snapshot of the VM, when the artifact is a snapshot
+	snapshotName  string
 	proxmoxClient *proxmox.Client
 
 	// StateData should store data such as GeneratedData
@@ -35,10 +37,16 @@ func (*Artifact) Files() []string {
 }
 
 func (a *Artifact) Id() string {
+	if a.snapshotName != "" {
+		return fmt.Sprintf("%d:%s", a.artifactID, a.snapshotName)
+	}
 	return strconv.Itoa(a.artifactID)
 }
 
 func (a *Artifact) String() string {
+	if a.snapshotName != "" {
+		return fmt.Sprintf("A %s was created: %s of VM %d", a.artifactType, a.snapshotName, a.artifactID)
+	}
 	return fmt.Sprintf("A %s was created: %d", a.artifactType, a.artifactID)
 }
 
@@ -47,6 +55,12 @@ func (a *Artifact) State(name string) interface{} {
 }
 
 func (a *Artifact) Destroy() error {
+	if a.snapshotName != "" {
+		// Only the snapshot is the artifact, keep the VM
+		log.Printf("Destroying %s: %s of VM %d", a.artifactType, a.snapshotName, a.artifactID)
+		_, err := proxmox.SnapshotName(a.snapshotName).Delete(a.proxmoxClient, proxmox.NewVmRef(a.artifactID))
+		return err
+	}
 	log.Printf("Destroying %s: %d", a.artifactType, a.artifactID)
 	_, err := a.proxmoxClient.DeleteVm(proxmox.NewVmRef(a.artifactID))
 	return err
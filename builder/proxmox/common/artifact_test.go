@@ -0,0 +1,39 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import "testing"
+
+func TestArtifact(t *testing.T) {
+	cs := []struct {
+		name           string
+		artifact       *Artifact
+		expectedID     string
+		expectedString string
+	}{
+		{
+			name:           "template",
+			artifact:       &Artifact{artifactID: 100, artifactType: "template"},
+			expectedID:     "100",
+			expectedString: "A template was created: 100",
+		},
+		{
+			name:           "snapshot",
+			artifact:       &Artifact{artifactID: 100, artifactType: "snapshot", snapshotName: "build-1"},
+			expectedID:     "100:build-1",
+			expectedString: "A snapshot was created: build-1 of VM 100",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			if id := c.artifact.Id(); id != c.expectedID {
+				t.Errorf("Expected Id() to be %q, got %q", c.expectedID, id)
+			}
+			if s := c.artifact.String(); s != c.expectedString {
+				t.Errorf("Expected String() to be %q, got %q", c.expectedString, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+// buildVMTag marks the VMs created by a build, until they are turned into
+// the artifact. VMs still carrying it once the build is gone are orphans,
+// left behind by a Packer process that was killed.
+const buildVMTag = "packer-build"
+
+// failedBuildTag is the tag of VMs kept by keep_vm_on_error
+const failedBuildTag = "packer-failed"
+
+// buildVMDescriptionHeader is the first line of the description of build VMs
+const buildVMDescriptionHeader = "Packer ephemeral build VM"
+
+// buildVMHeartbeatInterval is how often a running build records in the
+// description of its build VM that it's still alive
+const buildVMHeartbeatInterval = time.Minute
+
+// buildVMDescription returns the description of a build VM, recording which
+// build created it, when, on which host, and when the build was last seen
+// alive.
+func buildVMDescription(buildName string, started time.Time, heartbeat time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if buildName == "" {
+		buildName = "unknown"
+	}
+	return fmt.Sprintf("%s\nbuild: %s\nstarted: %s\nhost: %s\nheartbeat: %s",
+		buildVMDescriptionHeader, buildName, started.UTC().Format(time.RFC3339), host, heartbeat.UTC().Format(time.RFC3339))
+}
+
+type buildVMHeartbeater interface {
+	SetVmConfig(*proxmox.VmRef, map[string]interface{}) (interface{}, error)
+}
+
+// startBuildVMHeartbeat updates the heartbeat in the description of the
+// build VM until stopBuildVMHeartbeat is called, so the orphan cleanup of
+// other builds can tell it's still in use.
+func startBuildVMHeartbeat(state multistep.StateBag, client buildVMHeartbeater, vmRef *proxmox.VmRef, buildName string, started time.Time) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(buildVMHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				// Failing to update it, e.g. while the VM is locked by a
+				// disk move, is caught up by the next one
+				description := buildVMDescription(buildName, started, now)
+				if _, err := client.SetVmConfig(vmRef, map[string]interface{}{"description": description}); err != nil {
+					log.Printf("error updating the heartbeat of build VM %d: %s", vmRef.VmId(), err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	state.Put("build_vm_heartbeat", func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	})
+}
+
+// stopBuildVMHeartbeat stops the heartbeat of the build VM, if it was
+// started. Once it returns, the description of the VM isn't touched anymore.
+func stopBuildVMHeartbeat(state multistep.StateBag) {
+	if stop, ok := state.GetOk("build_vm_heartbeat"); ok {
+		stop.(func())()
+	}
+}
+
+// parseBuildVMDescription returns the fields of a description written by
+// buildVMDescription, or false if it isn't one.
+func parseBuildVMDescription(description string) (map[string]string, bool) {
+	lines := strings.Split(strings.TrimSpace(description), "\n")
+	if strings.TrimSpace(lines[0]) != buildVMDescriptionHeader {
+		return nil, false
+	}
+	fields := map[string]string{}
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return fields, true
+}
+
+// withTag returns the tags with the given tag added, in the format of the VM config.
+func withTag(tags string, tag string) string {
+	return strings.Join(append(withoutTag(splitTags(tags), tag), tag), ";")
+}
+
+// withoutTag returns the tags without the given tag.
+func withoutTag(tags []string, tag string) []string {
+	result := []string{}
+	for _, t := range tags {
+		if t != tag {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// hasTag returns whether the tags of the VM config include the given tag.
+func hasTag(vmConfig map[string]interface{}, tag string) bool {
+	tags, _ := vmConfig["tags"].(string)
+	for _, t := range splitTags(tags) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTags splits the tags of a VM config, PVE accepts several separators.
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
@@ -51,7 +51,13 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook,
 	comm := &b.config.Comm
 
 	// Build the steps
+	connect := &communicator.StepConnect{
+		Config:    comm,
+		Host:      commHost((*comm).Host()),
+		SSHConfig: (*comm).SSHConfigFunc(),
+	}
 	coreSteps := []multistep.Step{
+		&stepCleanupOrphanedVMs{},
 		&stepStartVM{
 			vmCreator: b.vmCreator,
 		},
@@ -60,30 +66,44 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook,
 			BootConfig: b.config.BootConfig,
 			Ctx:        b.config.Ctx,
 		},
-		&communicator.StepConnect{
-			Config:    comm,
-			Host:      commHost((*comm).Host()),
-			SSHConfig: (*comm).SSHConfigFunc(),
+		connect,
+		&stepWaitForCloudInit{},
+		&stepCreateBuildSnapshot{Name: "packer-connected"},
+		&stepProvisionWithRollback{
+			Provision: &commonsteps.StepProvision{},
+			Connect:   connect,
 		},
-		&commonsteps.StepProvision{},
+		&stepDeleteBuildSnapshots{},
+		&stepGuestTrim{},
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.Comm,
 		},
+		&stepGeneralize{},
 		&stepRemoveCloudInitDrive{},
+		&stepMoveDisks{},
 		&stepConvertToTemplate{},
 		&stepFinalizeConfig{},
+		&stepCreateSnapshot{},
 		&stepSuccess{},
 	}
-	preSteps := b.preSteps
+	// Each ISO is acquired by its own pipeline of steps, which are run
+	// concurrently before the VM is created
+	isoPipelines := make([][]multistep.Step, 0, len(b.config.ISOs))
 	for idx := range b.config.ISOs {
 		if b.config.ISOs[idx].ISODownloadPVE {
-			preSteps = append(preSteps,
+			isoPipelines = append(isoPipelines, []multistep.Step{
 				&stepDownloadISOOnPVE{
 					ISO: &b.config.ISOs[idx],
 				},
-			)
+			})
+		} else if b.config.ISOs[idx].ISOUploadStream {
+			isoPipelines = append(isoPipelines, []multistep.Step{
+				&stepUploadISO{
+					ISO: &b.config.ISOs[idx],
+				},
+			})
 		} else {
-			preSteps = append(preSteps,
+			isoPipelines = append(isoPipelines, []multistep.Step{
 				&commonsteps.StepCreateCD{
 					Files:   b.config.ISOs[idx].CDConfig.CDFiles,
 					Content: b.config.ISOs[idx].CDConfig.CDContent,
@@ -100,9 +120,13 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook,
 				&stepUploadISO{
 					ISO: &b.config.ISOs[idx],
 				},
-			)
+			})
 		}
 	}
+	preSteps := append(b.preSteps, &stepPrepareISOs{
+		Pipelines:   isoPipelines,
+		Concurrency: b.config.ISOConcurrency,
+	})
 
 	steps := append(preSteps, coreSteps...)
 	steps = append(steps, b.postSteps...)
@@ -129,13 +153,20 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook,
 		return nil, fmt.Errorf("artifact type could not be determined")
 	}
 
+	snapshotName, _ := state.Get("artifact_snapshot").(string)
+
 	artifact := &Artifact{
 		builderID:     b.id,
 		artifactID:    artifactID,
 		artifactType:  artifactType,
+		snapshotName:  snapshotName,
 		proxmoxClient: b.proxmoxClient,
 		StateData:     map[string]interface{}{"generated_data": state.Get("generated_data")},
 	}
+	// Linked clones depend on the disks of the template they were cloned from
+	if parent, ok := state.GetOk("linked_clone_parent"); ok {
+		artifact.StateData["linked_clone_parent"] = parent
+	}
 	return artifact, nil
 }
 
@@ -0,0 +1,177 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"crypto"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// CloudInitConfig returns the Cloud-Init settings of the build VM: the user
+// and SSH public key of the communicator, and the DNS and IP configuration.
+func (c *Config) CloudInitConfig() *proxmox.CloudInit {
+	var nameServers []netip.Addr
+	if c.Nameserver != "" {
+		for _, nameserver := range strings.Split(c.Nameserver, " ") {
+			ip, err := netip.ParseAddr(nameserver)
+			if err != nil {
+				continue
+			}
+			nameServers = append(nameServers, ip)
+		}
+	}
+
+	IpconfigMap := proxmox.CloudInitNetworkInterfaces{}
+	for idx := range c.Ipconfigs {
+		if c.Ipconfigs[idx] != (cloudInitIpconfig{}) {
+
+			// backwards compatibility conversions
+
+			var ipv4cfg proxmox.CloudInitIPv4Config
+			var ipv6cfg proxmox.CloudInitIPv6Config
+
+			// cloudInitIpconfig.Ip accepts a CIDR address or 'dhcp' string
+			switch c.Ipconfigs[idx].Ip {
+			case "dhcp":
+				ipv4cfg.DHCP = true
+			default:
+				if c.Ipconfigs[idx].Ip != "" {
+					addr := proxmox.IPv4CIDR(c.Ipconfigs[idx].Ip)
+					ipv4cfg.Address = &addr
+				}
+			}
+			if c.Ipconfigs[idx].Gateway != "" {
+				gw := proxmox.IPv4Address(c.Ipconfigs[idx].Gateway)
+				ipv4cfg.Gateway = &gw
+			}
+
+			// cloudInitIpconfig.Ip6 accepts a CIDR address, 'auto' or 'dhcp' string
+			switch c.Ipconfigs[idx].Ip6 {
+			case "dhcp":
+				ipv6cfg.DHCP = true
+			case "auto":
+				ipv6cfg.SLAAC = true
+			default:
+				if c.Ipconfigs[idx].Ip6 != "" {
+					addr := proxmox.IPv6CIDR(c.Ipconfigs[idx].Ip6)
+					ipv6cfg.Address = &addr
+				}
+			}
+			if c.Ipconfigs[idx].Gateway6 != "" {
+				addr := proxmox.IPv6Address(c.Ipconfigs[idx].Gateway6)
+				ipv6cfg.Gateway = &addr
+			}
+
+			IpconfigMap[proxmox.QemuNetworkInterfaceID(idx)] = proxmox.CloudInitNetworkConfig{
+				IPv4: &ipv4cfg,
+				IPv6: &ipv6cfg,
+			}
+		}
+	}
+
+	var publicKey []crypto.PublicKey
+
+	if c.Comm.SSHPublicKey != nil {
+		publicKey = append(publicKey, crypto.PublicKey(string(c.Comm.SSHPublicKey)))
+	}
+
+	username := c.Comm.SSHUsername
+	if c.Comm.Type == "winrm" {
+		username = c.Comm.WinRMUser
+	}
+
+	return &proxmox.CloudInit{
+		Username:      &username,
+		PublicSSHkeys: &publicKey,
+		DNS: &proxmox.GuestDNS{
+			NameServers:  &nameServers,
+			SearchDomain: &c.Searchdomain,
+		},
+		NetworkInterfaces: IpconfigMap,
+	}
+}
+
+// cloudInitControllers returns the controllers a Cloud-Init drive of the
+// given disk type can be attached to.
+func cloudInitControllers(diskType string) ([]string, error) {
+	var diskControllers []string
+	switch diskType {
+	// Proxmox supports up to 6 SATA controllers (0 - 5)
+	case "sata":
+		for i := 0; i < 6; i++ {
+			sataController := fmt.Sprintf("sata%d", i)
+			diskControllers = append(diskControllers, sataController)
+		}
+	// and up to 31 SCSI controllers (0 - 30)
+	case "scsi":
+		for i := 0; i < 31; i++ {
+			scsiController := fmt.Sprintf("scsi%d", i)
+			diskControllers = append(diskControllers, scsiController)
+		}
+	// Unspecified disk type defaults to "ide"
+	case "ide":
+		diskControllers = []string{"ide0", "ide1", "ide2", "ide3"}
+	default:
+		return nil, fmt.Errorf("unsupported disk type %q", diskType)
+	}
+	return diskControllers, nil
+}
+
+// hasCloudInitDrive reports whether a Cloud-Init drive is attached to the VM
+func hasCloudInitDrive(vmParams map[string]interface{}) bool {
+	for _, value := range vmParams {
+		drive, ok := value.(string)
+		if ok && strings.Contains(drive, "-cloudinit") && strings.Contains(drive, "media=cdrom") {
+			return true
+		}
+	}
+	return false
+}
+
+// attachCloudInitDrive adds a Cloud-Init drive to the build VM, unless it
+// already has one (e.g. inherited from the cloned VM).
+func attachCloudInitDrive(c *Config, client vmStarter, vmRef *proxmox.VmRef, ui packersdk.Ui) error {
+	vmParams, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return fmt.Errorf("error fetching VM config: %s", err)
+	}
+	if hasCloudInitDrive(vmParams) {
+		return nil
+	}
+
+	storagePool := c.CloudInitStoragePool
+	if storagePool == "" && len(c.Disks) > 0 {
+		storagePool = c.Disks[0].StoragePool
+	}
+	if storagePool == "" && vmParams["bootdisk"] != nil && vmParams[vmParams["bootdisk"].(string)] != nil {
+		bootDisk := vmParams[vmParams["bootdisk"].(string)].(string)
+		storagePool = strings.Split(bootDisk, ":")[0]
+	}
+	if storagePool == "" {
+		return fmt.Errorf("cloud_init_during_build is set to true, but cloud_init_storage_pool is empty and could not be set automatically. set cloud_init_storage_pool in your configuration")
+	}
+
+	diskControllers, err := cloudInitControllers(c.CloudInitDiskType)
+	if err != nil {
+		return err
+	}
+	for _, controller := range diskControllers {
+		if vmParams[controller] == nil {
+			ui.Say("Adding a cloud-init cdrom for the build in storage pool " + storagePool)
+			_, err := client.SetVmConfig(vmRef, map[string]interface{}{
+				controller: storagePool + ":cloudinit",
+			})
+			if err != nil {
+				return fmt.Errorf("error adding cloud-init cdrom: %s", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Found no free controller of type %s for a cloud-init cdrom", c.CloudInitDiskType)
+}
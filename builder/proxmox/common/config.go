@@ -2,7 +2,7 @@
 // SPDX-License-Identifier: MPL-2.0
 
 //go:generate packer-sdc struct-markdown
-//go:generate packer-sdc mapstructure-to-hcl2 -type Config,NICConfig,diskConfig,rng0Config,pciDeviceConfig,vgaConfig,ISOsConfig,efiConfig,tpmConfig
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,NICConfig,diskConfig,rng0Config,pciDeviceConfig,vgaConfig,ISOsConfig,efiConfig,tpmConfig,cloudInitSeedConfig,cloudInitIpconfig,templateOverridesConfig
 
 package proxmox
 
@@ -10,6 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"regexp"
@@ -17,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/packer-plugin-sdk/bootcommand"
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
@@ -172,15 +175,106 @@ type Config struct {
 	// Disables KVM hardware virtualization. Defaults to `false`.
 	DisableKVM bool `mapstructure:"disable_kvm"`
 
+	// Raw options of the VM configuration (see `qm config`) to set on the
+	// build VM after it is created and before it is started, for options the
+	// builder doesn't have a setting for. For example:
+	//
+	// ```hcl
+	//   vm_config_overrides = {
+	//     startup    = "order=2,up=30"
+	//     hookscript = "local:snippets/hook.pl"
+	//   }
+	// ```
+	//
+	// Options with an empty value are removed. Options the builder sets from
+	// its own settings (e.g. `memory` or `net0`) can't be overridden. Set
+	// `protection` with `template_config_overrides` instead, a protected
+	// build VM couldn't be deleted when the build fails. Options
+	// not known to the builder only cause a warning, and are validated by
+	// Proxmox.
+	VMConfigOverrides map[string]string `mapstructure:"vm_config_overrides"`
+	// Raw options of the VM configuration to set on the template at the end
+	// of the build, like `vm_config_overrides`. Use `template_overrides` for
+	// the hardware settings the builder supports.
+	TemplateConfigOverrides map[string]string `mapstructure:"template_config_overrides"`
+
 	// Name of the template. Defaults to the generated
 	// name used during creation.
 	TemplateName string `mapstructure:"template_name"`
 	// Description of the template, visible in
 	// the Proxmox interface.
 	TemplateDescription string `mapstructure:"template_description"`
+	// Append a block of build metadata to the description of the template
+	// (or VM), so tools and data sources can tell how it was built. The block
+	// is a JSON object in a `packer-metadata` code block, holding the build
+	// time and name, the Packer and plugin versions, the ISOs used with their
+	// checksums or the ID of the VM it was cloned from, and
+	// `notes_metadata_values`. Defaults to `false`.
+	NotesMetadata bool `mapstructure:"notes_metadata"`
+	// Additional key/value pairs to record in the metadata block of
+	// `notes_metadata`, for example the git commit the template was built from.
+	NotesMetadataValues map[string]string `mapstructure:"notes_metadata_values"`
+	// Hardware settings applied to the template (or VM) at the end of the
+	// build, in place of the ones used during the build. See
+	// [Template Overrides](#template-overrides).
+	TemplateOverrides templateOverridesConfig `mapstructure:"template_overrides"`
 	// Skip converting the VM to a template on completion of build.
 	// Defaults to `false`
 	SkipConvertToTemplate bool `mapstructure:"skip_convert_to_template"`
+	// Instead of converting the VM to a template, create a snapshot with this
+	// name and keep the VM. Only supported by the `proxmox-clone` builder.
+	//
+	// The VM given by `vm_id` or `template_name` is long-lived: the first
+	// build clones it from `clone_vm`, later builds run on the existing VM
+	// and add a snapshot to it. The hardware settings of the builder,
+	// including ISOs, `vm_config_overrides` and `cloud_init_during_build`,
+	// only apply when the VM is created, later builds keep the name and
+	// description of the VM as well. When a build fails, the existing VM is
+	// rolled back to the snapshot it was on before the build. A snapshot
+	// with the same name is an error, unless `-force` is set, which replaces
+	// it once the build succeeded. The VM itself is never deleted.
+	//
+	// The artifact is the snapshot, destroying it only removes the snapshot.
+	// The name can use template engine functions, e.g. `build-{{timestamp}}`.
+	// Names must start with a letter, only contain letters, digits, `-` and
+	// `_` and be 3 to 40 characters long. Requires `vm_id` or `template_name`,
+	// can't be combined with `skip_convert_to_template` or
+	// `final_storage_pool`.
+	SnapshotName string `mapstructure:"snapshot_name"`
+	// Include the RAM of the VM in the snapshot given by `snapshot_name`.
+	// The VM is snapshotted while running instead of being shut down first.
+	// Defaults to `false`.
+	SnapshotIncludeRAM bool `mapstructure:"snapshot_include_ram"`
+	// Name of the Proxmox storage pool to move all disks of the VM to at the
+	// end of the build, before it is converted to a template. This allows
+	// building on fast local storage while storing the template on shared
+	// storage. The VM is stopped, and every disk (including the EFI and TPM
+	// state disks) is moved and removed from its original storage. Use
+	// `final_format` on the `disks` to also convert them. With
+	// `skip_convert_to_template`, the VM is started again once finalized.
+	FinalStoragePool string `mapstructure:"final_storage_pool"`
+	// Keep the VM when the build fails instead of deleting it, so it can be
+	// inspected. The VM is stopped, renamed with a `-failed` suffix, tagged
+	// `packer-failed`, and the error is added to its description. Failed VMs
+	// are never deleted by `-force`, remove them manually once done.
+	// Unlike `-on-error=abort`, the rest of the build is still cleaned up.
+	// Defaults to `false`.
+	KeepVMOnError bool `mapstructure:"keep_vm_on_error"`
+	// Leave the VM kept by `keep_vm_on_error` running instead of stopping it.
+	// Defaults to `false`.
+	KeepVMOnErrorRunning bool `mapstructure:"keep_vm_on_error_running"`
+	// Delete orphaned build VMs before the build starts, once their build
+	// wasn't seen alive for this duration (e.g. `1h`). Build VMs are tagged
+	// `packer-build` and their description records the build, start time
+	// and host that created them. A running build updates the `heartbeat`
+	// in the description every minute, the VMs left behind when the Packer
+	// process is killed stop getting updates. This affects the build VMs of
+	// all builds on the cluster, including VMs of builds run by older plugin
+	// versions, which don't record a heartbeat and are deleted once they
+	// were started longer ago than this duration, even if they're still
+	// building. Templates and VMs kept by `keep_vm_on_error` are never
+	// deleted. Must be at least `10m`. Disabled by default.
+	CleanupOrphanedVMsOlderThan time.Duration `mapstructure:"cleanup_orphaned_vms_older_than"`
 
 	// If true, add an empty Cloud-Init CDROM drive after the virtual
 	// machine has been converted to a template. Defaults to `false`.
@@ -195,10 +289,101 @@ type Config struct {
 	// If unset and a Cloud-Init drive is configured for an ISO build, the Proxmox backend will default 'Upgrade Packages' to Yes for template builds.
 	// If unset for a clone build, configuration for 'Upgrade Packages' will be preserved if a Cloud-Init drive was present on the source VM.
 	CloudInitDisableUpgradePackages config.Trilean `mapstructure:"cloud_init_disable_upgrade_packages"`
+	// Attach a Cloud-Init CDROM drive to the VM during the build, populated
+	// with the user and SSH key of the communicator, `nameserver`,
+	// `searchdomain` and `ipconfig`. Useful to build from cloud images or
+	// autoinstall-capable ISOs. The drive is removed before the VM is
+	// converted to a template, set `cloud_init` to add an empty one to the
+	// template. Uses `cloud_init_storage_pool` and `cloud_init_disk_type`.
+	// The clone builder always populates the Cloud-Init settings of the
+	// cloned VM; there this only adds a drive if the cloned VM has none.
+	// Defaults to `false`.
+	CloudInitDuringBuild bool `mapstructure:"cloud_init_during_build"`
+	// Set nameserver IP address(es) via Cloud-Init.
+	// If not given, the same setting as on the host is used.
+	Nameserver string `mapstructure:"nameserver" required:"false"`
+	// Set the DNS searchdomain via Cloud-Init.
+	// If not given, the same setting as on the host is used.
+	Searchdomain string `mapstructure:"searchdomain" required:"false"`
+	// Set IP address and gateway via Cloud-Init.
+	// See the [CloudInit Ip Configuration](#cloudinit-ip-configuration) documentation for fields.
+	Ipconfigs []cloudInitIpconfig `mapstructure:"ipconfig" required:"false"`
+	// Wait for cloud-init in the VM to finish after connecting, before
+	// provisioning starts, by running `cloud-init status --wait`. The build
+	// fails, showing the cloud-init logs, if cloud-init reports an error.
+	// Useful for clone builds, where cloud-init may still be installing
+	// package upgrades when the communicator connects. Defaults to `false`.
+	CloudInitWait bool `mapstructure:"cloud_init_wait"`
+	// How to run `cloud-init status --wait` in the VM. Can be `communicator`
+	// or `qemu_agent` (requires `qemu_agent`). Defaults to `communicator`.
+	CloudInitWaitMethod string `mapstructure:"cloud_init_wait_method"`
+	// How long to wait for cloud-init to finish. Defaults to `30m`.
+	CloudInitWaitTimeout time.Duration `mapstructure:"cloud_init_wait_timeout"`
+
+	// Snapshot the VM once the communicator connected (and cloud-init
+	// finished, see `cloud_init_wait`), before the provisioners run. When a
+	// provisioner fails while running with `-on-error=ask`, an additional
+	// choice rolls the VM back to the snapshot and runs the provisioners
+	// again. The snapshot includes the RAM of the VM, so the rollback resumes
+	// the running VM, and the communicator connects again before retrying.
+	// The snapshot is removed once provisioning succeeded.
+	// Packer runs all provisioners at once, so there are no snapshots between
+	// individual provisioners. Requires storage supporting snapshots.
+	// Defaults to `false`.
+	SnapshotBeforeProvisioning bool `mapstructure:"snapshot_before_provisioning"`
+
+	// Run `fstrim` on all mounted filesystems of the VM after provisioning,
+	// so blocks of deleted files are released on thin provisioned storage
+	// (e.g. LVM-thin, ZFS, or qcow2 images), and report the storage allocated
+	// by the disks before and after. Trimming only frees storage for disks
+	// with `discard` enabled; `ssd` additionally makes guests trim on their own.
+	// Defaults to `false`.
+	GuestTrim bool `mapstructure:"guest_trim"`
+	// How to trim the filesystems. Can be `qemu_agent`, using the `fstrim`
+	// command of the guest agent (works for Linux and Windows guests), or
+	// `communicator`, running `fstrim -av` (Linux guests only). Defaults to
+	// `qemu_agent`, or `communicator` if `qemu_agent` is disabled.
+	GuestTrimMethod string `mapstructure:"guest_trim_method"`
+
+	// Generalize the VM at the end of the build, so VMs cloned from the
+	// template get their own identity, and shut it down through the guest.
+	//
+	// On Linux, cloud-init state and logs are cleaned, the machine-id is
+	// truncated, SSH host keys are removed and log files are emptied. On
+	// Windows, `sysprep /generalize /oobe /shutdown` is run.
+	// This requires a communicator. On Linux the commands are run through
+	// `sudo -n` unless `ssh_username` is `root`, so the SSH user needs
+	// passwordless sudo. Defaults to `false`.
+	Generalize bool `mapstructure:"generalize"`
+	// The operating system of the VM, which determines how it is
+	// generalized. Can be `linux` or `windows`. Defaults to `windows` when
+	// using the WinRM communicator, `linux` otherwise.
+	GeneralizeOS string `mapstructure:"generalize_os"`
+	// Path to an unattend answer file uploaded to the VM and passed to
+	// sysprep with `/unattend`. Only used when `generalize_os` is `windows`.
+	GeneralizeUnattendFile string `mapstructure:"generalize_unattend_file"`
+	// How long to wait for the VM to shut down after generalizing it.
+	// Defaults to `30m`.
+	GeneralizeTimeout time.Duration `mapstructure:"generalize_timeout"`
+
+	// Generate a cloud-init seed ISO and attach it to the VM during the build.
+	// See [Cloud-Init Seed](#cloud-init-seed).
+	CloudInitSeed cloudInitSeedConfig `mapstructure:"cloud_init_seed"`
 
 	// ISO files attached to the virtual machine.
 	// See [ISOs](#isos).
 	ISOs []ISOsConfig `mapstructure:"additional_iso_files"`
+	// How many times to try uploading an ISO to Proxmox before giving up.
+	// Proxmox can't resume an interrupted upload, so every attempt
+	// uploads the whole file again. Defaults to `3`.
+	ISOUploadAttempts int `mapstructure:"iso_upload_attempts"`
+	// Maximum number of ISOs that are downloaded, generated and uploaded at
+	// the same time. Every ISO is still handled in order (generate or
+	// download, then upload), but the ISOs don't wait for each other. Errors
+	// of all ISOs are reported together once every ISO is done. Set to `1`
+	// to handle the ISOs one after another. Defaults to `0`, which handles
+	// all ISOs at the same time.
+	ISOConcurrency int `mapstructure:"iso_concurrency"`
 	// Name of the network interface that Packer gets
 	// the VMs IP from. Defaults to the first non loopback interface.
 	VMInterface string `mapstructure:"vm_interface"`
@@ -267,11 +452,48 @@ type ISOsConfig struct {
 	//
 	// Defaults to `false`
 	ISODownloadPVE bool `mapstructure:"iso_download_pve"`
+	// Name of the file the ISO is stored as on `iso_storage_pool` when using
+	// `iso_download_pve`. Defaults to the file name of the URL, without the
+	// extension of the compression format if `decompression_algorithm` is set.
+	ISOTargetFilename string `mapstructure:"iso_target_filename"`
+	// Have the PVE node decompress the downloaded file when using
+	// `iso_download_pve`, for images published as compressed archives. Can
+	// be `gz`, `lzo`, `zst`, `bz2` or `xz`; which algorithms are accepted
+	// depends on the Proxmox VE version. The checksum applies to the
+	// compressed file.
+	DecompressionAlgorithm string `mapstructure:"decompression_algorithm"`
 	// If true, remove the mounted ISO from the template after finishing. Defaults to `false`.
 	Unmount bool `mapstructure:"unmount"`
 	// Keep CDRom device attached to template if unmounting ISO. Defaults to `false`.
 	// Has no effect if unmount is `false`
-	KeepCDRomDevice      bool   `mapstructure:"keep_cdrom_device"`
+	KeepCDRomDevice bool `mapstructure:"keep_cdrom_device"`
+	// What to do when an ISO downloaded through Packer is about to be uploaded to
+	// `iso_storage_pool`, but a file with the same name is already present there.
+	// If the existing file was uploaded by an earlier build with the same
+	// `iso_checksum` and has the same size, it is reused and the upload is
+	// skipped. Otherwise the behaviour is controlled by this option, which can
+	// be `replace` (upload the ISO and overwrite the existing file), `fail`
+	// (abort the build) or `always` (skip the lookup and always upload the ISO).
+	// Proxmox does not expose checksums of stored files, so the checksum of an
+	// uploaded ISO is recorded in the name of a small image next to it, e.g.
+	// `debian.iso.sha256-<checksum>.img`. Files without a matching record, or
+	// ISOs without `iso_checksum`, are never reused. With `iso_download_pve`,
+	// the checksum is recorded once the node verified the download, the size
+	// is compared with the size reported by the server hosting the ISO (except
+	// for files downloaded with `decompression_algorithm`), and the node
+	// only replaces an existing file once the download was verified. Has no
+	// effect on ISOs generated from `cd_files` or `cd_content`. Defaults to
+	// `replace`.
+	ISOOverwrite string `mapstructure:"iso_overwrite"`
+	// Stream the ISO from `iso_url` straight to `iso_storage_pool` instead of
+	// downloading it to the Packer host first. The checksum is computed while
+	// streaming, and the uploaded file is deleted again if it doesn't match.
+	// An existing file is reused like described for `iso_overwrite`.
+	// Only `http` and `https` URLs are supported, and the server hosting the
+	// ISO must report the size of the file. Can't be combined with
+	// `iso_download_pve`, `cd_files` or `cd_content`.
+	// Defaults to `false`.
+	ISOUploadStream      bool   `mapstructure:"iso_upload_stream"`
 	ShouldUploadISO      bool   `mapstructure-to-hcl2:",skip"`
 	DownloadPathKey      string `mapstructure-to-hcl2:",skip"`
 	AssignedDeviceIndex  string `mapstructure-to-hcl2:",skip"`
@@ -386,6 +608,61 @@ type diskConfig struct {
 	//
 	// This cannot work with virtio disks.
 	SSD bool `mapstructure:"ssd"`
+	// The format to convert the disk to when moving it to `final_storage_pool`
+	// at the end of the build. Can be `raw`, `qcow2` or `vmdk`. Defaults to
+	// the format of the disk during the build, as far as supported by the
+	// target storage.
+	FinalFormat string `mapstructure:"final_format"`
+
+	AssignedDeviceIndex string `mapstructure-to-hcl2:",skip"`
+}
+
+// Hardware settings of the template, applied once the build is done. This
+// allows building with more resources or on another network than the
+// template will have. Settings that aren't given keep the value used during
+// the build.
+//
+// Usage example (HCL):
+//
+// ```hcl
+//
+//	cores  = 8
+//	memory = 16384
+//
+//	template_overrides {
+//	  cores  = 2
+//	  memory = 2048
+//	  network_adapters {
+//	    model    = "virtio"
+//	    bridge   = "vmbr0"
+//	    vlan_tag = "20"
+//	  }
+//	}
+//
+// ```
+type templateOverridesConfig struct {
+	// How many CPU cores to give the template.
+	Cores uint8 `mapstructure:"cores"`
+	// How many CPU sockets to give the template.
+	Sockets uint8 `mapstructure:"sockets"`
+	// How much memory (in megabytes) to give the template.
+	Memory uint32 `mapstructure:"memory"`
+	// The minimum amount of memory (in megabytes) of the template, enabling
+	// memory ballooning.
+	BalloonMinimum uint32 `mapstructure:"ballooning_minimum"`
+	// The network adapters of the template, replacing all adapters used
+	// during the build. See [Network Adapters](#network-adapters). The MAC
+	// address of an existing adapter is kept unless `mac_address` is set.
+	NICs []NICConfig `mapstructure:"network_adapters"`
+	// Whether the template will be started during system bootup.
+	Onboot config.Trilean `mapstructure:"onboot"`
+	// The tags of the template, replacing the ones set by `tags`. This is a
+	// semicolon separated list.
+	Tags string `mapstructure:"tags"`
+	// The boot order of the template. Format example `order=virtio0;net0`.
+	Boot string `mapstructure:"boot"`
+	// Whether the QEMU Agent option is enabled for the template.
+	Agent config.Trilean `mapstructure:"qemu_agent"`
 }
 
 // Set the efidisk storage options.
@@ -418,6 +695,73 @@ type efiConfig struct {
 	EFIType string `mapstructure:"efi_type"`
 }
 
+// Generate a cloud-init seed ISO from the given user data, meta data, network
+// and vendor configuration. The ISO is built by Packer (see `cd_files` for
+// the tools needed), uploaded to `iso_storage_pool` like any other generated
+// ISO, attached to the VM for the build and removed again afterwards.
+//
+// Every document can be given inline or read from a file, and both are
+// processed with Packer templating.
+//
+// HCL2 example:
+//
+// ```hcl
+//
+//	cloud_init_seed {
+//	  iso_storage_pool = "local"
+//	  user_data_file   = "./http/user-data"
+//	  meta_data        = "instance-id: ${var.vm_name}"
+//	}
+//
+// ```
+//
+// JSON example:
+//
+// ```json
+//
+//	"cloud_init_seed": {
+//	  "iso_storage_pool": "local",
+//	  "user_data_file": "./http/user-data",
+//	  "meta_data": "instance-id: {{ user `vm_name` }}"
+//	}
+//
+// ```
+type cloudInitSeedConfig struct {
+	// The data source format of the seed. Can be `nocloud` (files `user-data`,
+	// `meta-data`, `network-config` and `vendor-data` on a volume labeled
+	// `cidata`) or `configdrive2` (files `openstack/latest/user_data`,
+	// `meta_data.json`, `network_data.json` and `vendor_data.json` on a
+	// volume labeled `config-2`). With `configdrive2` the meta, network and
+	// vendor data must be given in the OpenStack JSON formats.
+	// Defaults to `nocloud`.
+	Format string `mapstructure:"format"`
+	// Name of the Proxmox storage pool to upload the seed ISO to.
+	ISOStoragePool string `mapstructure:"iso_storage_pool" required:"true"`
+	// Bus type the seed ISO is attached with. Can be `ide`, `sata` or `scsi`.
+	// Defaults to `ide`.
+	Type string `mapstructure:"type"`
+	// Bus index the seed ISO is attached to. Defaults to the first free index.
+	Index string `mapstructure:"index"`
+	// The cloud-init user data.
+	UserData string `mapstructure:"user_data"`
+	// Path to a file holding the cloud-init user data. Can't be combined with `user_data`.
+	UserDataFile string `mapstructure:"user_data_file"`
+	// The cloud-init meta data. Defaults to a document only setting a
+	// generated instance ID.
+	MetaData string `mapstructure:"meta_data"`
+	// Path to a file holding the cloud-init meta data. Can't be combined with `meta_data`.
+	MetaDataFile string `mapstructure:"meta_data_file"`
+	// The cloud-init network configuration.
+	NetworkConfig string `mapstructure:"network_config"`
+	// Path to a file holding the cloud-init network configuration. Can't be
+	// combined with `network_config`.
+	NetworkConfigFile string `mapstructure:"network_config_file"`
+	// The cloud-init vendor data.
+	VendorData string `mapstructure:"vendor_data"`
+	// Path to a file holding the cloud-init vendor data. Can't be combined with `vendor_data`.
+	VendorDataFile string `mapstructure:"vendor_data_file"`
+}
+
 // Set the tpmstate storage options.
 //
 // HCL2 example:
@@ -586,6 +930,151 @@ type pciDeviceConfig struct {
 	XVGA bool `mapstructure:"x_vga"`
 }
 
+// toISO validates the seed configuration and turns it into the ISO that
+// is generated from cd_content, uploaded and attached to the VM.
+func (s *cloudInitSeedConfig) toISO(ctx *interpolate.Context) (ISOsConfig, []error) {
+	var errs []error
+
+	var label string
+	var names [4]string
+	switch s.Format {
+	case "", "nocloud":
+		s.Format = "nocloud"
+		label = "cidata"
+		names = [4]string{"user-data", "meta-data", "network-config", "vendor-data"}
+	case "configdrive2":
+		label = "config-2"
+		names = [4]string{
+			"openstack/latest/user_data",
+			"openstack/latest/meta_data.json",
+			"openstack/latest/network_data.json",
+			"openstack/latest/vendor_data.json",
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid value for cloud_init_seed format %q: only one of 'nocloud', 'configdrive2' is valid", s.Format))
+	}
+	if s.ISOStoragePool == "" {
+		errs = append(errs, errors.New("cloud_init_seed iso_storage_pool must be specified"))
+	}
+	switch s.Type {
+	case "ide", "sata", "scsi":
+	case "":
+		s.Type = "ide"
+	default:
+		errs = append(errs, errors.New("cloud_init_seed type must be ide, sata or scsi"))
+	}
+
+	content := map[string]string{}
+	documents := []struct {
+		key    string
+		inline string
+		file   string
+	}{
+		{"user_data", s.UserData, s.UserDataFile},
+		{"meta_data", s.MetaData, s.MetaDataFile},
+		{"network_config", s.NetworkConfig, s.NetworkConfigFile},
+		{"vendor_data", s.VendorData, s.VendorDataFile},
+	}
+	for i, doc := range documents {
+		data := doc.inline
+		if doc.file != "" {
+			if doc.inline != "" {
+				errs = append(errs, fmt.Errorf("cloud_init_seed %s and %s_file cannot both be set", doc.key, doc.key))
+				continue
+			}
+			raw, err := os.ReadFile(doc.file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error reading cloud_init_seed %s_file: %s", doc.key, err))
+				continue
+			}
+			data, err = interpolate.Render(string(raw), ctx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error processing cloud_init_seed %s_file: %s", doc.key, err))
+				continue
+			}
+		}
+		if data != "" && names[i] != "" {
+			content[names[i]] = data
+		}
+	}
+	if len(errs) > 0 {
+		return ISOsConfig{}, errs
+	}
+
+	// The data sources need meta data with an instance ID to pick up the seed
+	if _, ok := content[names[1]]; !ok {
+		instanceID := "packer-" + uuid.TimeOrderedUUID()
+		if s.Format == "configdrive2" {
+			content[names[1]] = fmt.Sprintf("{\"uuid\": %q}", instanceID)
+		} else {
+			content[names[1]] = fmt.Sprintf("instance-id: %s\n", instanceID)
+		}
+	}
+	if s.Format == "nocloud" {
+		// NoCloud requires user-data to be present, even if it is empty
+		if _, ok := content[names[0]]; !ok {
+			content[names[0]] = ""
+		}
+	}
+
+	return ISOsConfig{
+		Type:           s.Type,
+		Index:          s.Index,
+		ISOStoragePool: s.ISOStoragePool,
+		Unmount:        true,
+		CDConfig: commonsteps.CDConfig{
+			CDContent: content,
+			CDLabel:   label,
+		},
+	}, nil
+}
+
+// If you have configured more than one network interface, make sure to match the order of
+// `network_adapters` and `ipconfig`.
+//
+// Usage example (JSON):
+//
+// ```json
+// [
+//
+//	{
+//	  "ip": "192.168.1.55/24",
+//	  "gateway": "192.168.1.1",
+//	  "ip6": "fda8:a260:6eda:20::4da/128",
+//	  "gateway6": "fda8:a260:6eda:20::1"
+//	}
+//
+// ]
+// ```
+type cloudInitIpconfig struct {
+	// Either an IPv4 address (CIDR notation) or `dhcp`.
+	Ip string `mapstructure:"ip" required:"false"`
+	// IPv4 gateway.
+	Gateway string `mapstructure:"gateway" required:"false"`
+	// Can be an IPv6 address (CIDR notation), `auto` (enables SLAAC), or `dhcp`.
+	Ip6 string `mapstructure:"ip6" required:"false"`
+	// IPv6 gateway.
+	Gateway6 string `mapstructure:"gateway6" required:"false"`
+}
+
+// Convert Ipconfig attributes into a Proxmox-API compatible string
+func (c cloudInitIpconfig) String() string {
+	options := []string{}
+	if c.Ip != "" {
+		options = append(options, "ip="+c.Ip)
+	}
+	if c.Gateway != "" {
+		options = append(options, "gw="+c.Gateway)
+	}
+	if c.Ip6 != "" {
+		options = append(options, "ip6="+c.Ip6)
+	}
+	if c.Gateway6 != "" {
+		options = append(options, "gw6="+c.Gateway6)
+	}
+	return strings.Join(options, ",")
+}
+
 func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []string, error) {
 	// Do not add a cloud-init cdrom by default
 	c.CloudInit = false
@@ -634,6 +1123,118 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 	if c.TaskTimeout == 0 {
 		c.TaskTimeout = 60 * time.Second
 	}
+	if c.CloudInitWait {
+		switch c.CloudInitWaitMethod {
+		case "":
+			c.CloudInitWaitMethod = guestCommandCommunicator
+		case guestCommandCommunicator:
+		case guestCommandQemuAgent:
+			if c.Agent.False() {
+				errs = packersdk.MultiErrorAppend(errs, errors.New("cloud_init_wait_method qemu_agent requires qemu_agent to be enabled"))
+			}
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for cloud_init_wait_method %q: only one of 'communicator', 'qemu_agent' is valid", c.CloudInitWaitMethod))
+		}
+		if c.CloudInitWaitTimeout == 0 {
+			c.CloudInitWaitTimeout = 30 * time.Minute
+		}
+	}
+	if c.SnapshotName != "" {
+		if c.SkipConvertToTemplate {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_name can't be combined with skip_convert_to_template"))
+		}
+		if err := proxmox.SnapshotName(c.SnapshotName).Validate(); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid snapshot_name %q: %s", c.SnapshotName, err))
+		}
+		// The VM getting the snapshots is looked up on every build
+		if c.VMID == 0 && c.TemplateName == "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_name requires vm_id or template_name to be set"))
+		}
+		// Disks with snapshots can't be moved
+		if c.FinalStoragePool != "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_name can't be combined with final_storage_pool"))
+		}
+	}
+	if c.SnapshotIncludeRAM {
+		if c.SnapshotName == "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_include_ram requires snapshot_name to be set"))
+		}
+		// These stop the VM before the snapshot is taken
+		if c.Generalize || c.FinalStoragePool != "" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_include_ram can't be combined with generalize or final_storage_pool"))
+		}
+	}
+	overrideErrs, overrideWarnings := prepareConfigOverrides("vm_config_overrides", c.VMConfigOverrides, typedBuildVMOptions)
+	errs = packersdk.MultiErrorAppend(errs, overrideErrs...)
+	warnings = append(warnings, overrideWarnings...)
+	overrideErrs, overrideWarnings = prepareConfigOverrides("template_config_overrides", c.TemplateConfigOverrides, typedTemplateOptions)
+	errs = packersdk.MultiErrorAppend(errs, overrideErrs...)
+	warnings = append(warnings, overrideWarnings...)
+	if len(c.NotesMetadataValues) > 0 && !c.NotesMetadata {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("notes_metadata_values requires notes_metadata to be set"))
+	}
+	// Leave room for heartbeats that couldn't be written, e.g. during a disk move
+	if c.CleanupOrphanedVMsOlderThan < 0 || (c.CleanupOrphanedVMsOlderThan > 0 && c.CleanupOrphanedVMsOlderThan < 10*buildVMHeartbeatInterval) {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("cleanup_orphaned_vms_older_than must be at least %s", 10*buildVMHeartbeatInterval))
+	}
+	if c.KeepVMOnErrorRunning && !c.KeepVMOnError {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("keep_vm_on_error_running requires keep_vm_on_error to be set"))
+	}
+	if c.GuestTrim {
+		switch c.GuestTrimMethod {
+		case "":
+			c.GuestTrimMethod = guestCommandQemuAgent
+			if c.Agent.False() {
+				c.GuestTrimMethod = guestCommandCommunicator
+			}
+		case guestCommandCommunicator:
+		case guestCommandQemuAgent:
+			if c.Agent.False() {
+				errs = packersdk.MultiErrorAppend(errs, errors.New("guest_trim_method qemu_agent requires qemu_agent to be enabled"))
+			}
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for guest_trim_method %q: only one of 'communicator', 'qemu_agent' is valid", c.GuestTrimMethod))
+		}
+		for idx, disk := range c.Disks {
+			if !disk.Discard {
+				warnings = append(warnings, fmt.Sprintf("disks[%d] doesn't have discard enabled, guest_trim won't release its unused storage", idx))
+			}
+		}
+	}
+	if c.Generalize {
+		if c.Comm.Type == "none" {
+			errs = packersdk.MultiErrorAppend(errs, errors.New("generalize requires a communicator"))
+		}
+		switch c.GeneralizeOS {
+		case "":
+			c.GeneralizeOS = "linux"
+			if c.Comm.Type == "winrm" {
+				c.GeneralizeOS = "windows"
+			}
+		case "linux", "windows":
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for generalize_os %q: only one of 'linux', 'windows' is valid", c.GeneralizeOS))
+		}
+		if c.GeneralizeUnattendFile != "" {
+			if c.GeneralizeOS != "windows" {
+				errs = packersdk.MultiErrorAppend(errs, errors.New("generalize_unattend_file can only be used with generalize_os windows"))
+			} else if _, err := os.Stat(c.GeneralizeUnattendFile); err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("generalize_unattend_file: %s", err))
+			}
+		}
+		if c.GeneralizeTimeout == 0 {
+			c.GeneralizeTimeout = 30 * time.Minute
+		}
+	}
+	if c.ISOUploadAttempts < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("iso_upload_attempts must be positive"))
+	}
+	if c.ISOUploadAttempts == 0 {
+		c.ISOUploadAttempts = 3
+	}
+	if c.ISOConcurrency < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("iso_concurrency must be positive"))
+	}
 	if c.BootKeyInterval == 0 && os.Getenv(bootcommand.PackerKeyEnv) != "" {
 		var err error
 		c.BootKeyInterval, err = time.ParseDuration(os.Getenv(bootcommand.PackerKeyEnv))
@@ -678,6 +1279,13 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 		log.Printf("OS not set, using default 'other'")
 		c.OS = "other"
 	}
+	if c.CloudInitSeed != (cloudInitSeedConfig{}) {
+		seedISO, seedErrs := c.CloudInitSeed.toISO(&c.Ctx)
+		errs = packersdk.MultiErrorAppend(errs, seedErrs...)
+		if len(seedErrs) == 0 {
+			c.ISOs = append(c.ISOs, seedISO)
+		}
+	}
 	// validate iso devices
 	for idx := range c.ISOs {
 		// Check ISO config
@@ -783,6 +1391,39 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 		if len(c.ISOs[idx].ISOConfig.ISOUrls) == 0 && c.ISOs[idx].ISOConfig.RawSingleISOUrl == "" && c.ISOs[idx].ISODownloadPVE {
 			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_download_pve can only be used together with iso_url"))
 		}
+		if c.ISOs[idx].ISOUploadStream {
+			if len(c.ISOs[idx].ISOConfig.ISOUrls) == 0 && c.ISOs[idx].ISOConfig.RawSingleISOUrl == "" {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream can only be used together with iso_url"))
+			} else if err := CheckUploadStreamURLs(c.ISOs[idx].ISOConfig.ISOUrls); err != nil {
+				errs = packersdk.MultiErrorAppend(errs, err)
+			}
+			if c.ISOs[idx].ISODownloadPVE {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream and iso_download_pve cannot both be set"))
+			}
+			if len(c.ISOs[idx].CDFiles) > 0 || len(c.ISOs[idx].CDContent) > 0 {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream can't be combined with cd_files or cd_content"))
+			}
+		}
+		if !c.ISOs[idx].ISODownloadPVE {
+			if c.ISOs[idx].ISOTargetFilename != "" {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_target_filename can only be used together with iso_download_pve"))
+			}
+			if c.ISOs[idx].DecompressionAlgorithm != "" {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("decompression_algorithm can only be used together with iso_download_pve"))
+			}
+		}
+		switch c.ISOs[idx].DecompressionAlgorithm {
+		case "", "gz", "lzo", "zst", "bz2", "xz":
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for decompression_algorithm %q in additional_iso %d: only one of 'gz', 'lzo', 'zst', 'bz2', 'xz' is valid", c.ISOs[idx].DecompressionAlgorithm, idx))
+		}
+		switch c.ISOs[idx].ISOOverwrite {
+		case "replace", "fail", "always":
+		case "":
+			c.ISOs[idx].ISOOverwrite = "replace"
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for iso_overwrite %q in additional_iso %d: only one of 'replace', 'fail', 'always' is valid", c.ISOs[idx].ISOOverwrite, idx))
+		}
 	}
 
 	// validate disks
@@ -833,6 +1474,14 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 		if disk.StoragePoolType != "" {
 			warnings = append(warnings, "storage_pool_type is deprecated and should be omitted, it will be removed in a later version of the proxmox plugin")
 		}
+		switch disk.FinalFormat {
+		case "", "raw", "qcow2", "vmdk":
+		default:
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("disks[%d].final_format must be raw, qcow2 or vmdk", idx))
+		}
+		if disk.FinalFormat != "" && c.FinalStoragePool == "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("disks[%d].final_format requires final_storage_pool to be set", idx))
+		}
 	}
 
 	if len(c.Serials) > 4 {
@@ -848,7 +1497,46 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 		log.Printf("SCSI controller not set, using default 'lsi'")
 		c.SCSIController = "lsi"
 	}
-	if c.CloudInit {
+	// Check validity of given IP addresses
+	if c.Nameserver != "" {
+		for _, nameserver := range strings.Split(c.Nameserver, " ") {
+			_, err := netip.ParseAddr(nameserver)
+			if err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse nameserver: %s", err))
+			}
+		}
+	}
+	for _, i := range c.Ipconfigs {
+		if i.Ip != "" && i.Ip != "dhcp" {
+			_, _, err := net.ParseCIDR(i.Ip)
+			if err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.ip: %s", err))
+			}
+		}
+		if i.Gateway != "" {
+			_, err := netip.ParseAddr(i.Gateway)
+			if err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.gateway: %s", err))
+			}
+		}
+		if i.Ip6 != "" && i.Ip6 != "auto" && i.Ip6 != "dhcp" {
+			_, _, err := net.ParseCIDR(i.Ip6)
+			if err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.ip6: %s", err))
+			}
+		}
+		if i.Gateway6 != "" {
+			_, err := netip.ParseAddr(i.Gateway6)
+			if err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("could not parse ipconfig.gateway6: %s", err))
+			}
+		}
+	}
+	if len(c.NICs) < len(c.Ipconfigs) {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("%d ipconfig blocks given, but only %d network interfaces defined", len(c.Ipconfigs), len(c.NICs)))
+	}
+
+	if c.CloudInit || c.CloudInitDuringBuild {
 		switch c.CloudInitDiskType {
 		case "ide", "scsi", "sata":
 		case "":
@@ -888,19 +1576,21 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 	if c.TemplateName != "" && !re.MatchString(c.TemplateName) {
 		errs = packersdk.MultiErrorAppend(errs, errors.New("template_name must be a valid DNS name"))
 	}
-	for idx, nic := range c.NICs {
-		if nic.Bridge == "" {
-			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("network_adapters[%d].bridge must be specified", idx))
-		}
-		if nic.Model == "" {
-			log.Printf("NIC %d model not set, using default 'e1000'", idx)
-			c.NICs[idx].Model = "e1000"
+	errs = packersdk.MultiErrorAppend(errs, prepareNICs("network_adapters", c.NICs)...)
+	errs = packersdk.MultiErrorAppend(errs, prepareNICs("template_overrides.network_adapters", c.TemplateOverrides.NICs)...)
+	if c.TemplateOverrides.Memory > 0 && c.TemplateOverrides.Memory < 16 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("template_overrides: memory %d is too small", c.TemplateOverrides.Memory))
+	}
+	if c.TemplateOverrides.Memory > 0 || c.TemplateOverrides.BalloonMinimum > 0 {
+		templateMemory, templateBalloon := c.Memory, c.BalloonMinimum
+		if c.TemplateOverrides.Memory > 0 {
+			templateMemory = c.TemplateOverrides.Memory
 		}
-		if nic.Model != "virtio" && nic.PacketQueues > 0 {
-			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("network_adapters[%d].packet_queues can only be set for 'virtio' driver", idx))
+		if c.TemplateOverrides.BalloonMinimum > 0 {
+			templateBalloon = c.TemplateOverrides.BalloonMinimum
 		}
-		if (nic.MTU < 0) || (nic.MTU > 65520) {
-			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("network_adapters[%d].mtu only positive values up to 65520 are supported", idx))
+		if templateMemory < templateBalloon {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("template_overrides: ballooning_minimum (%d) must be lower than memory (%d)", templateBalloon, templateMemory))
 		}
 	}
 	if c.EFIDisk != "" {
@@ -981,3 +1671,25 @@ func (c *Config) Prepare(upper interface{}, raws ...interface{}) ([]string, []st
 	}
 	return nil, warnings, nil
 }
+
+// prepareNICs validates the network adapters given by key, and sets the
+// defaults of unset options.
+func prepareNICs(key string, nics []NICConfig) []error {
+	var errs []error
+	for idx, nic := range nics {
+		if nic.Bridge == "" {
+			errs = append(errs, fmt.Errorf("%s[%d].bridge must be specified", key, idx))
+		}
+		if nic.Model == "" {
+			log.Printf("NIC %d model not set, using default 'e1000'", idx)
+			nics[idx].Model = "e1000"
+		}
+		if nic.Model != "virtio" && nic.PacketQueues > 0 {
+			errs = append(errs, fmt.Errorf("%s[%d].packet_queues can only be set for 'virtio' driver", key, idx))
+		}
+		if (nic.MTU < 0) || (nic.MTU > 65520) {
+			errs = append(errs, fmt.Errorf("%s[%d].mtu only positive values up to 65520 are supported", key, idx))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,136 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// rxVMConfigOption matches the options of the QEMU VM configuration known
+// from the PVE API schema (`qm config`). Numbered options like net0 match
+// without their index.
+var rxVMConfigOption = regexp.MustCompile(`^(` +
+	`acpi|affinity|agent|amd-sev|arch|args|audio0|autostart|balloon|bios|boot|bootdisk|` +
+	`cdrom|cicustom|cipassword|citype|ciupgrade|ciuser|cores|cpu|cpulimit|cpuunits|` +
+	`description|efidisk0|freeze|hookscript|hotplug|hugepages|ivshmem|keephugepages|` +
+	`keyboard|kvm|localtime|lock|machine|memory|migrate_downtime|migrate_speed|name|` +
+	`nameserver|numa|onboot|ostype|protection|reboot|rng0|scsihw|searchdomain|shares|` +
+	`smbios1|smp|sockets|spice_enhancements|sshkeys|startdate|startup|tablet|tags|tdf|` +
+	`template|tpmstate0|vcpus|vga|vmgenid|vmstatestorage|watchdog|` +
+	`(hostpci|ide|ipconfig|net|numa|parallel|sata|scsi|serial|unused|usb|virtio|virtiofs)\d+` +
+	`)$`)
+
+// typedVMConfigOption is an option of the VM configuration the builder
+// already sets from one of its own options.
+type typedVMConfigOption struct {
+	rx *regexp.Regexp
+	// The option of the builder setting it, empty if the builder always
+	// manages it
+	option string
+}
+
+// typedBuildVMOptions are the options set when creating the build VM
+var typedBuildVMOptions = []typedVMConfigOption{
+	{regexp.MustCompile(`^name$`), "vm_name"},
+	{regexp.MustCompile(`^(description|template|lock|unused\d+)$`), ""},
+	{regexp.MustCompile(`^tags$`), "tags"},
+	{regexp.MustCompile(`^cores$`), "cores"},
+	{regexp.MustCompile(`^sockets$`), "sockets"},
+	{regexp.MustCompile(`^memory$`), "memory"},
+	{regexp.MustCompile(`^balloon$`), "ballooning_minimum"},
+	{regexp.MustCompile(`^cpu$`), "cpu_type"},
+	{regexp.MustCompile(`^numa$`), "numa"},
+	{regexp.MustCompile(`^ostype$`), "os"},
+	{regexp.MustCompile(`^bios$`), "bios"},
+	{regexp.MustCompile(`^efidisk0$`), "efi_config"},
+	{regexp.MustCompile(`^machine$`), "machine"},
+	{regexp.MustCompile(`^rng0$`), "rng0"},
+	{regexp.MustCompile(`^tpmstate0$`), "tpm_config"},
+	{regexp.MustCompile(`^vga$`), "vga"},
+	{regexp.MustCompile(`^net\d+$`), "network_adapters"},
+	{regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`), "disks"},
+	{regexp.MustCompile(`^hostpci\d+$`), "pci_devices"},
+	{regexp.MustCompile(`^serial\d+$`), "serials"},
+	{regexp.MustCompile(`^agent$`), "qemu_agent"},
+	{regexp.MustCompile(`^scsihw$`), "scsi_controller"},
+	{regexp.MustCompile(`^onboot$`), "onboot"},
+	{regexp.MustCompile(`^kvm$`), "disable_kvm"},
+	{regexp.MustCompile(`^boot$`), "boot"},
+	{regexp.MustCompile(`^args$`), "qemu_additional_args"},
+	{regexp.MustCompile(`^citype$`), ""},
+	{regexp.MustCompile(`^(cicustom|cipassword|ciupgrade|ciuser|ipconfig\d+|nameserver|searchdomain|sshkeys)$`), "cloud-init options"},
+	// A protected build VM couldn't be deleted when the build fails
+	{regexp.MustCompile(`^protection$`), "template_config_overrides"},
+}
+
+// typedTemplateOptions are the options set when finalizing the template
+var typedTemplateOptions = []typedVMConfigOption{
+	{regexp.MustCompile(`^name$`), "template_name"},
+	{regexp.MustCompile(`^description$`), "template_description"},
+	{regexp.MustCompile(`^(template|lock|unused\d+)$`), ""},
+	{regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`), "ISOs and cloud_init"},
+	{regexp.MustCompile(`^ciupgrade$`), "cloud_init_disable_upgrade_packages"},
+	{regexp.MustCompile(`^tags$`), "template_overrides.tags"},
+	{regexp.MustCompile(`^cores$`), "template_overrides.cores"},
+	{regexp.MustCompile(`^sockets$`), "template_overrides.sockets"},
+	{regexp.MustCompile(`^memory$`), "template_overrides.memory"},
+	{regexp.MustCompile(`^balloon$`), "template_overrides.ballooning_minimum"},
+	{regexp.MustCompile(`^net\d+$`), "template_overrides.network_adapters"},
+	{regexp.MustCompile(`^onboot$`), "template_overrides.onboot"},
+	{regexp.MustCompile(`^boot$`), "template_overrides.boot"},
+	{regexp.MustCompile(`^agent$`), "template_overrides.qemu_agent"},
+}
+
+// prepareConfigOverrides checks the raw VM options given by key don't
+// conflict with the options set by the builder. Options unknown to the PVE
+// API schema the builder was written against only cause a warning, they may
+// have been added by a newer PVE version.
+func prepareConfigOverrides(key string, overrides map[string]string, typed []typedVMConfigOption) ([]error, []string) {
+	var errs []error
+	var warnings []string
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		conflict := false
+		for _, t := range typed {
+			if !t.rx.MatchString(name) {
+				continue
+			}
+			conflict = true
+			if t.option == "" {
+				errs = append(errs, fmt.Errorf("%s: %q is managed by the builder and can't be overridden", key, name))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %q conflicts with %s, use it instead", key, name, t.option))
+			}
+			break
+		}
+		if !conflict && !rxVMConfigOption.MatchString(name) {
+			warnings = append(warnings, fmt.Sprintf("%s: %q isn't a known VM option, it is passed to Proxmox as is", key, name))
+		}
+	}
+	return errs, warnings
+}
+
+// configOverrideChanges returns the raw VM options as changes for
+// SetVmConfig. Options with an empty value are deleted.
+func configOverrideChanges(overrides map[string]string) (map[string]interface{}, []string) {
+	changes := map[string]interface{}{}
+	var deletes []string
+	for name, value := range overrides {
+		if value == "" {
+			deletes = append(deletes, name)
+			continue
+		}
+		changes[name] = value
+	}
+	sort.Strings(deletes)
+	return changes, deletes
+}
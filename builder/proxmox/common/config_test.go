@@ -5,9 +5,12 @@ package proxmox
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
@@ -237,6 +240,149 @@ func TestISOs(t *testing.T) {
 				"iso_file": "local:iso/test.iso",
 			},
 		},
+		{
+			name:           "iso_overwrite valid should succeed",
+			expectedToFail: false,
+			ISOs: map[string]interface{}{
+				"type":             "ide",
+				"iso_url":          "http://example.com",
+				"iso_checksum":     "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool": "local",
+				"iso_overwrite":    "fail",
+			},
+		},
+		{
+			name:           "iso_overwrite invalid should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":             "ide",
+				"iso_url":          "http://example.com",
+				"iso_checksum":     "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool": "local",
+				"iso_overwrite":    "sometimes",
+			},
+		},
+		{
+			name:           "iso_upload_stream with iso_url should succeed",
+			expectedToFail: false,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"iso_url":           "http://example.com",
+				"iso_checksum":      "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":  "local",
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "iso_upload_stream with ftp iso_url should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"iso_url":           "ftp://example.com/debian.iso",
+				"iso_checksum":      "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":  "local",
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "iso_upload_stream with local path should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"iso_url":           "./debian.iso",
+				"iso_checksum":      "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":  "local",
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "iso_upload_stream with iso_download_pve should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"iso_url":           "http://example.com",
+				"iso_checksum":      "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":  "local",
+				"iso_download_pve":  true,
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "decompression_algorithm with iso_download_pve should succeed",
+			expectedToFail: false,
+			ISOs: map[string]interface{}{
+				"type":                    "ide",
+				"iso_url":                 "http://example.com/image.iso.xz",
+				"iso_checksum":            "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":        "local",
+				"iso_download_pve":        true,
+				"iso_target_filename":     "image.iso",
+				"decompression_algorithm": "xz",
+			},
+		},
+		{
+			name:           "decompression_algorithm without iso_download_pve should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":                    "ide",
+				"iso_url":                 "http://example.com/image.iso.xz",
+				"iso_checksum":            "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":        "local",
+				"decompression_algorithm": "xz",
+			},
+		},
+		{
+			name:           "invalid decompression_algorithm should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":                    "ide",
+				"iso_url":                 "http://example.com/image.iso.rar",
+				"iso_checksum":            "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":        "local",
+				"iso_download_pve":        true,
+				"decompression_algorithm": "rar",
+			},
+		},
+		{
+			name:           "iso_target_filename without iso_download_pve should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":                "ide",
+				"iso_url":             "http://example.com/image.iso",
+				"iso_checksum":        "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"iso_storage_pool":    "local",
+				"iso_target_filename": "custom.iso",
+			},
+		},
+		{
+			name:           "iso_upload_stream with cd_files should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"cd_files":          []string{"config_test.go"},
+				"iso_storage_pool":  "local",
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "iso_upload_stream with cd_content should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"cd_content":        map[string]string{"user-data": "#cloud-config"},
+				"iso_storage_pool":  "local",
+				"iso_upload_stream": true,
+			},
+		},
+		{
+			name:           "iso_upload_stream with iso_file should fail",
+			expectedToFail: true,
+			ISOs: map[string]interface{}{
+				"type":              "ide",
+				"iso_file":          "local:iso/test.iso",
+				"iso_upload_stream": true,
+			},
+		},
 	}
 
 	for _, c := range isotests {
@@ -578,6 +724,50 @@ func TestVMID(t *testing.T) {
 	}
 }
 
+func TestISOConcurrency(t *testing.T) {
+	tests := []struct {
+		name           string
+		ISOConcurrency int
+		expectFailure  bool
+	}{
+		{
+			name:           "unset, no error",
+			ISOConcurrency: 0,
+			expectFailure:  false,
+		},
+		{
+			name:           "positive, no error",
+			ISOConcurrency: 2,
+			expectFailure:  false,
+		},
+		{
+			name:           "negative, fail",
+			ISOConcurrency: -1,
+			expectFailure:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["iso_concurrency"] = tt.ISOConcurrency
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+			}
+
+			if err == nil && tt.expectFailure {
+				t.Errorf("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
 func TestPCIDeviceMapping(t *testing.T) {
 	testCases := []struct {
 		expectedError   error
@@ -712,3 +902,966 @@ func TestPCIDeviceMapping(t *testing.T) {
 		})
 	}
 }
+
+func TestCloudInitSeed(t *testing.T) {
+	userDataFile := filepath.Join(t.TempDir(), "user-data")
+	if err := os.WriteFile(userDataFile, []byte("#cloud-config\nhostname: {{ lower `PACKER` }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		seed            map[string]interface{}
+		expectFailure   bool
+		expectedLabel   string
+		expectedContent map[string]string
+	}{
+		{
+			name: "nocloud with inline user data",
+			seed: map[string]interface{}{
+				"iso_storage_pool": "local",
+				"user_data":        "#cloud-config\n",
+				"meta_data":        "instance-id: test",
+			},
+			expectedLabel: "cidata",
+			expectedContent: map[string]string{
+				"user-data": "#cloud-config\n",
+				"meta-data": "instance-id: test",
+			},
+		},
+		{
+			name: "nocloud with templated user data file",
+			seed: map[string]interface{}{
+				"iso_storage_pool": "local",
+				"user_data_file":   userDataFile,
+				"network_config":   "version: 2",
+			},
+			expectedLabel: "cidata",
+			expectedContent: map[string]string{
+				"user-data":      "#cloud-config\nhostname: packer\n",
+				"network-config": "version: 2",
+			},
+		},
+		{
+			name: "configdrive2",
+			seed: map[string]interface{}{
+				"format":           "configdrive2",
+				"iso_storage_pool": "local",
+				"user_data":        "#cloud-config\n",
+				"vendor_data":      "{}",
+			},
+			expectedLabel: "config-2",
+			expectedContent: map[string]string{
+				"openstack/latest/user_data":        "#cloud-config\n",
+				"openstack/latest/vendor_data.json": "{}",
+			},
+		},
+		{
+			name: "invalid format, fail",
+			seed: map[string]interface{}{
+				"format":           "azure",
+				"iso_storage_pool": "local",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "inline and file user data, fail",
+			seed: map[string]interface{}{
+				"iso_storage_pool": "local",
+				"user_data":        "#cloud-config\n",
+				"user_data_file":   userDataFile,
+			},
+			expectFailure: true,
+		},
+		{
+			name: "missing user data file, fail",
+			seed: map[string]interface{}{
+				"iso_storage_pool": "local",
+				"user_data_file":   filepath.Join(t.TempDir(), "missing"),
+			},
+			expectFailure: true,
+		},
+		{
+			name: "missing storage pool, fail",
+			seed: map[string]interface{}{
+				"user_data": "#cloud-config\n",
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["cloud_init_seed"] = tt.seed
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+
+			if len(c.ISOs) != 1 {
+				t.Fatalf("expected the seed to be added as an ISO, got %d ISOs", len(c.ISOs))
+			}
+			iso := c.ISOs[0]
+			if !iso.ShouldUploadISO || !iso.Unmount {
+				t.Errorf("expected the seed ISO to be uploaded and unmounted, got upload %t, unmount %t", iso.ShouldUploadISO, iso.Unmount)
+			}
+			if iso.CDLabel != tt.expectedLabel {
+				t.Errorf("expected label %q, got %q", tt.expectedLabel, iso.CDLabel)
+			}
+			for name, expected := range tt.expectedContent {
+				if got := iso.CDContent[name]; got != expected {
+					t.Errorf("expected %s to be %q, got %q", name, expected, got)
+				}
+			}
+			metaData := "meta-data"
+			if tt.expectedLabel == "config-2" {
+				metaData = "openstack/latest/meta_data.json"
+			}
+			if iso.CDContent[metaData] == "" {
+				t.Errorf("expected %s to be generated", metaData)
+			}
+		})
+	}
+}
+
+func TestCloudInitWait(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		agent          interface{}
+		expectedMethod string
+		expectFailure  bool
+	}{
+		{
+			name:           "default method is the communicator",
+			expectedMethod: "communicator",
+		},
+		{
+			name:           "guest agent",
+			method:         "qemu_agent",
+			expectedMethod: "qemu_agent",
+		},
+		{
+			name:          "guest agent disabled, fail",
+			method:        "qemu_agent",
+			agent:         false,
+			expectFailure: true,
+		},
+		{
+			name:          "invalid method, fail",
+			method:        "winrm",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["cloud_init_wait"] = true
+			if tt.method != "" {
+				cfg["cloud_init_wait_method"] = tt.method
+			}
+			if tt.agent != nil {
+				cfg["qemu_agent"] = tt.agent
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			if c.CloudInitWaitMethod != tt.expectedMethod {
+				t.Errorf("expected cloud_init_wait_method %q, got %q", tt.expectedMethod, c.CloudInitWaitMethod)
+			}
+			if c.CloudInitWaitTimeout != 30*time.Minute {
+				t.Errorf("expected default timeout of 30m, got %s", c.CloudInitWaitTimeout)
+			}
+		})
+	}
+}
+
+func TestNameserver(t *testing.T) {
+	ipconfigTest := []struct {
+		name          string
+		nameserver    string
+		expectFailure bool
+	}{
+		{
+			name:          "nameserver empty, no error",
+			expectFailure: false,
+			nameserver:    "",
+		},
+		{
+			name:          "single valid nameserver, no error",
+			expectFailure: false,
+			nameserver:    "192.168.1.1",
+		},
+		{
+			name:          "two valid nameservers, no error",
+			expectFailure: false,
+			nameserver:    "192.168.1.1 192.168.1.2",
+		},
+		{
+			name:          "comma separated nameservers, fail",
+			expectFailure: true,
+			nameserver:    "192.168.1.1,192.168.1.2",
+		},
+		{
+			name:          "invalid nameserver, fail",
+			expectFailure: true,
+			nameserver:    "192.168.1",
+		},
+	}
+
+	for _, tt := range ipconfigTest {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["nameserver"] = tt.nameserver
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil && !tt.expectFailure {
+				t.Fatalf("unexpected failure: %s", err)
+			}
+			if err == nil && tt.expectFailure {
+				t.Errorf("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestIpconfig(t *testing.T) {
+	ipconfigTest := []struct {
+		name          string
+		nics          []NICConfig
+		ipconfigs     []cloudInitIpconfig
+		expectFailure bool
+	}{
+		{
+			name:          "ipconfig empty, no error",
+			expectFailure: false,
+			ipconfigs:     []cloudInitIpconfig{},
+		},
+		{
+			name:          "valid ipconfig, no error",
+			expectFailure: false,
+			ipconfigs: []cloudInitIpconfig{
+				{
+					Ip:       "192.168.1.55/24",
+					Gateway:  "192.168.1.1",
+					Ip6:      "fda8:a260:6eda:20::4da/128",
+					Gateway6: "fda8:a260:6eda:20::1",
+				},
+			},
+			nics: []NICConfig{
+				{
+					Model:  "virtio",
+					Bridge: "vmbr0",
+				},
+			},
+		},
+		{
+			name:          "IPv4 invalid CIDR, fail",
+			expectFailure: true,
+			ipconfigs: []cloudInitIpconfig{
+				{
+					Ip:      "192.168.1.55",
+					Gateway: "192.168.1.1",
+				},
+			},
+			nics: []NICConfig{
+				{
+					Model:  "virtio",
+					Bridge: "vmbr0",
+				},
+			},
+		},
+		{
+			name:          "IPv6 invalid CIDR, fail",
+			expectFailure: true,
+			ipconfigs: []cloudInitIpconfig{
+				{
+					Ip6:      "fda8:a260:6eda:20::4da",
+					Gateway6: "fda8:a260:6eda:20::1",
+				},
+			},
+			nics: []NICConfig{
+				{
+					Model:  "virtio",
+					Bridge: "vmbr0",
+				},
+			},
+		},
+		{
+			name:          "not enough nics, fail",
+			expectFailure: true,
+			ipconfigs: []cloudInitIpconfig{
+				{
+					Ip6:      "fda8:a260:6eda:20::4da/128",
+					Gateway6: "fda8:a260:6eda:20::1",
+				},
+				{
+					Ip6:      "fda8:a260:6eda:20::4db/128",
+					Gateway6: "fda8:a260:6eda:20::1",
+				},
+			},
+			nics: []NICConfig{
+				{
+					Model:  "virtio",
+					Bridge: "vmbr0",
+				},
+			},
+		},
+		{
+			name:          "ipconfig DHCP, no error",
+			expectFailure: false,
+			ipconfigs: []cloudInitIpconfig{
+				{
+					Ip:  "dhcp",
+					Ip6: "dhcp",
+				},
+			},
+			nics: []NICConfig{
+				{
+					Model:  "virtio",
+					Bridge: "vmbr0",
+				},
+			},
+		},
+	}
+
+	for _, tt := range ipconfigTest {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["network_adapters"] = tt.nics
+			cfg["ipconfig"] = tt.ipconfigs
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil && !tt.expectFailure {
+				t.Fatalf("unexpected failure: %s", err)
+			}
+			if err == nil && tt.expectFailure {
+				t.Errorf("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestFinalStoragePool(t *testing.T) {
+	tests := []struct {
+		name             string
+		finalStoragePool string
+		finalFormat      string
+		expectFailure    bool
+	}{
+		{
+			name:             "final storage pool only",
+			finalStoragePool: "ceph",
+		},
+		{
+			name:             "final storage pool and format",
+			finalStoragePool: "nfs",
+			finalFormat:      "qcow2",
+		},
+		{
+			name:             "invalid format, fail",
+			finalStoragePool: "nfs",
+			finalFormat:      "qed",
+			expectFailure:    true,
+		},
+		{
+			name:          "format without final storage pool, fail",
+			finalFormat:   "qcow2",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			if tt.finalStoragePool != "" {
+				cfg["final_storage_pool"] = tt.finalStoragePool
+			}
+			cfg["disks"] = []map[string]interface{}{
+				{
+					"storage_pool": "local-lvm",
+					"final_format": tt.finalFormat,
+				},
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestGuestTrimConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		agent            interface{}
+		discard          bool
+		expectedMethod   string
+		expectedWarnings int
+		expectFailure    bool
+	}{
+		{
+			name:           "default method is the guest agent",
+			discard:        true,
+			expectedMethod: "qemu_agent",
+		},
+		{
+			name:           "default method without guest agent is the communicator",
+			agent:          false,
+			discard:        true,
+			expectedMethod: "communicator",
+		},
+		{
+			name:             "disks without discard, warn",
+			method:           "communicator",
+			expectedMethod:   "communicator",
+			expectedWarnings: 1,
+		},
+		{
+			name:          "guest agent disabled, fail",
+			method:        "qemu_agent",
+			agent:         false,
+			expectFailure: true,
+		},
+		{
+			name:          "invalid method, fail",
+			method:        "ssh",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["guest_trim"] = true
+			if tt.method != "" {
+				cfg["guest_trim_method"] = tt.method
+			}
+			if tt.agent != nil {
+				cfg["qemu_agent"] = tt.agent
+			}
+			cfg["disks"] = []map[string]interface{}{
+				{
+					"storage_pool": "local-lvm",
+					"discard":      tt.discard,
+				},
+			}
+
+			var c Config
+			_, warnings, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			if c.GuestTrimMethod != tt.expectedMethod {
+				t.Errorf("expected guest_trim_method %q, got %q", tt.expectedMethod, c.GuestTrimMethod)
+			}
+			if len(warnings) != tt.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tt.expectedWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestGeneralizeConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]interface{}
+		expectedOS    string
+		expectFailure bool
+	}{
+		{
+			name:       "defaults to linux",
+			expectedOS: "linux",
+		},
+		{
+			name: "defaults to windows with winrm",
+			config: map[string]interface{}{
+				"communicator":   "winrm",
+				"winrm_username": "Administrator",
+			},
+			expectedOS: "windows",
+		},
+		{
+			name: "unattend file has to exist",
+			config: map[string]interface{}{
+				"generalize_os":            "windows",
+				"generalize_unattend_file": "/does/not/exist.xml",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "unattend file requires windows, fail",
+			config: map[string]interface{}{
+				"generalize_os":            "linux",
+				"generalize_unattend_file": "config_test.go",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "no communicator, fail",
+			config: map[string]interface{}{
+				"communicator": "none",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "invalid os, fail",
+			config: map[string]interface{}{
+				"generalize_os": "bsd",
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["generalize"] = true
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			if c.GeneralizeOS != tt.expectedOS {
+				t.Errorf("expected generalize_os %q, got %q", tt.expectedOS, c.GeneralizeOS)
+			}
+			if c.GeneralizeTimeout != 30*time.Minute {
+				t.Errorf("expected default timeout of 30m, got %s", c.GeneralizeTimeout)
+			}
+		})
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]interface{}
+		expectFailure bool
+	}{
+		{
+			name: "snapshot name",
+			config: map[string]interface{}{
+				"snapshot_name": "build-1",
+				"template_name": "golden",
+			},
+		},
+		{
+			name: "snapshot name with vm_id",
+			config: map[string]interface{}{
+				"snapshot_name": "build-1",
+				"vm_id":         1000,
+			},
+		},
+		{
+			name: "snapshot without VM to snapshot, fail",
+			config: map[string]interface{}{
+				"snapshot_name": "build-1",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "snapshot and final_storage_pool, fail",
+			config: map[string]interface{}{
+				"snapshot_name":      "build-1",
+				"template_name":      "golden",
+				"final_storage_pool": "ceph",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "snapshot including RAM",
+			config: map[string]interface{}{
+				"snapshot_name":        "build-1",
+				"snapshot_include_ram": true,
+				"template_name":        "golden",
+			},
+		},
+		{
+			name: "invalid snapshot name, fail",
+			config: map[string]interface{}{
+				"snapshot_name": "1.0",
+			},
+			expectFailure: true,
+		},
+		{
+			name: "RAM without snapshot name, fail",
+			config: map[string]interface{}{
+				"snapshot_include_ram": true,
+			},
+			expectFailure: true,
+		},
+		{
+			name: "RAM with generalize, fail",
+			config: map[string]interface{}{
+				"snapshot_name":        "build-1",
+				"snapshot_include_ram": true,
+				"generalize":           true,
+			},
+			expectFailure: true,
+		},
+		{
+			name: "snapshot and skip_convert_to_template, fail",
+			config: map[string]interface{}{
+				"snapshot_name":            "build-1",
+				"skip_convert_to_template": true,
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestKeepVMOnError(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]interface{}
+		expectFailure bool
+	}{
+		{
+			name: "keep VM on error",
+			config: map[string]interface{}{
+				"keep_vm_on_error": true,
+			},
+		},
+		{
+			name: "keep VM running on error",
+			config: map[string]interface{}{
+				"keep_vm_on_error":         true,
+				"keep_vm_on_error_running": true,
+			},
+		},
+		{
+			name: "running without keep_vm_on_error, fail",
+			config: map[string]interface{}{
+				"keep_vm_on_error_running": true,
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestCleanupOrphanedVMsOlderThan(t *testing.T) {
+	tests := []struct {
+		name          string
+		olderThan     string
+		expectFailure bool
+	}{
+		{
+			name:      "hours",
+			olderThan: "24h",
+		},
+		{
+			name:      "minimum",
+			olderThan: "10m",
+		},
+		{
+			name:          "shorter than the heartbeat allows, fail",
+			olderThan:     "2m",
+			expectFailure: true,
+		},
+		{
+			name:          "negative, fail",
+			olderThan:     "-1h",
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			cfg["cleanup_orphaned_vms_older_than"] = tt.olderThan
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+		})
+	}
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]interface{}
+		expectFailure bool
+	}{
+		{
+			name: "hardware overrides",
+			config: map[string]interface{}{
+				"cores":  8,
+				"memory": 16384,
+				"template_overrides": map[string]interface{}{
+					"cores":              2,
+					"memory":             2048,
+					"ballooning_minimum": 1024,
+					"network_adapters": []map[string]interface{}{
+						{"bridge": "vmbr0", "vlan_tag": "20"},
+					},
+				},
+			},
+		},
+		{
+			name: "network adapter without bridge, fail",
+			config: map[string]interface{}{
+				"template_overrides": map[string]interface{}{
+					"network_adapters": []map[string]interface{}{
+						{"model": "virtio"},
+					},
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "ballooning minimum above the memory of the build, fail",
+			config: map[string]interface{}{
+				"memory": 2048,
+				"template_overrides": map[string]interface{}{
+					"ballooning_minimum": 4096,
+				},
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, _, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			for _, nic := range c.TemplateOverrides.NICs {
+				if nic.Model != "e1000" {
+					t.Errorf("Expected default model e1000, got %q", nic.Model)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]interface{}
+		expectFailure    bool
+		expectedWarnings int
+	}{
+		{
+			name: "options without typed fields",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"hookscript": "local:snippets/hook.pl",
+					"smbios1":    "uuid=0b0ac9f8-2b5e-4b4b-a4b5-33d7b0a8b1a4",
+					"numa0":      "cpus=0-1,memory=1024",
+				},
+				"template_config_overrides": map[string]string{
+					"protection": "1",
+					"cpu":        "x86-64-v2-AES",
+					"hookscript": "",
+				},
+			},
+		},
+		{
+			name: "unknown option only warns",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"future-option": "1",
+				},
+			},
+			expectedWarnings: 1,
+		},
+		{
+			name: "build option set by a typed field, fail",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"net1": "virtio,bridge=vmbr1",
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "build option set by qemu_additional_args, fail",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"args": "-no-reboot",
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "build option set by citype, fail",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"citype": "configdrive2",
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "protected build VM, fail",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"protection": "1",
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "build option managed by the builder, fail",
+			config: map[string]interface{}{
+				"vm_config_overrides": map[string]string{
+					"description": "my VM",
+				},
+			},
+			expectFailure: true,
+		},
+		{
+			name: "template option set by template_overrides, fail",
+			config: map[string]interface{}{
+				"template_config_overrides": map[string]string{
+					"memory": "2048",
+				},
+			},
+			expectFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mandatoryConfig(t)
+			for k, v := range tt.config {
+				cfg[k] = v
+			}
+
+			var c Config
+			_, warnings, err := c.Prepare(&c, cfg)
+			if err != nil {
+				if !tt.expectFailure {
+					t.Fatalf("unexpected failure to prepare config: %s", err)
+				}
+				t.Logf("got expected failure: %s", err)
+				return
+			}
+			if tt.expectFailure {
+				t.Fatal("expected failure, but prepare succeeded")
+			}
+			if len(warnings) != tt.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tt.expectedWarnings, warnings)
+			}
+		})
+	}
+}
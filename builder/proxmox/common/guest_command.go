@@ -0,0 +1,108 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Ways of running a command inside the guest
+const (
+	guestCommandCommunicator = "communicator"
+	guestCommandQemuAgent    = "qemu_agent"
+)
+
+type guestAgentExecutor interface {
+	QemuAgentExec(*proxmox.VmRef, map[string]interface{}) (map[string]interface{}, error)
+	GetExecStatus(*proxmox.VmRef, string) (map[string]interface{}, error)
+}
+
+var _ guestAgentExecutor = &proxmox.Client{}
+
+// guestCommandPollInterval is the time between two checks of a command run
+// through the guest agent
+var guestCommandPollInterval = 2 * time.Second
+
+// runGuestCommand runs a shell command inside the guest, either through the
+// communicator or the QEMU guest agent, and returns its exit code and combined output.
+func runGuestCommand(ctx context.Context, state multistep.StateBag, method string, command string) (int, string, error) {
+	switch method {
+	case guestCommandQemuAgent:
+		client := state.Get("proxmoxClient").(guestAgentExecutor)
+		vmRef := state.Get("vmRef").(*proxmox.VmRef)
+		return runGuestAgentCommand(ctx, client, vmRef, command)
+	default:
+		comm, ok := state.Get("communicator").(packersdk.Communicator)
+		if !ok {
+			return 0, "", fmt.Errorf("no communicator available to run %q", command)
+		}
+		var out bytes.Buffer
+		cmd := &packersdk.RemoteCmd{
+			Command: command,
+			Stdout:  &out,
+			Stderr:  &out,
+		}
+		if err := comm.Start(ctx, cmd); err != nil {
+			return 0, "", err
+		}
+		// The communicators don't stop the command when ctx is done, and
+		// Wait only returns once it exited
+		exited := make(chan int, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		select {
+		case exitCode := <-exited:
+			return exitCode, out.String(), nil
+		case <-ctx.Done():
+			// The output is still being written to, don't read it
+			return 0, "", ctx.Err()
+		}
+	}
+}
+
+func runGuestAgentCommand(ctx context.Context, client guestAgentExecutor, vmRef *proxmox.VmRef, command string) (int, string, error) {
+	result, err := client.QemuAgentExec(vmRef, map[string]interface{}{
+		"command": []string{"/bin/sh", "-c", command},
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	pid, ok := result["pid"].(float64)
+	if !ok {
+		return 0, "", fmt.Errorf("guest agent did not return a pid for %q", command)
+	}
+
+	for {
+		status, err := client.GetExecStatus(vmRef, fmt.Sprintf("%d", int(pid)))
+		if err != nil {
+			return 0, "", err
+		}
+		exited := false
+		switch v := status["exited"].(type) {
+		case float64:
+			exited = v == 1
+		case bool:
+			exited = v
+		}
+		if exited {
+			exitCode, _ := status["exitcode"].(float64)
+			out, _ := status["out-data"].(string)
+			errOut, _ := status["err-data"].(string)
+			return int(exitCode), out + errOut, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, "", ctx.Err()
+		case <-time.After(guestCommandPollInterval):
+		}
+	}
+}
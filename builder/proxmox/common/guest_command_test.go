@@ -0,0 +1,47 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stuckCommunicator starts commands that never finish, like the SSH and
+// WinRM communicators do with a command hanging in the guest.
+type stuckCommunicator struct {
+	packersdk.MockCommunicator
+}
+
+func (c *stuckCommunicator) Start(ctx context.Context, cmd *packersdk.RemoteCmd) error {
+	return nil
+}
+
+func TestRunGuestCommandTimeout(t *testing.T) {
+	state := new(multistep.BasicStateBag)
+	state.Put("communicator", &stuckCommunicator{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := runGuestCommand(ctx, state, guestCommandCommunicator, "cloud-init status --wait")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to be exceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the command to be abandoned once the context is done")
+	}
+}
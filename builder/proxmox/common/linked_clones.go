@@ -0,0 +1,64 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+type linkedCloneLister interface {
+	GetResourceList(resourceType string) ([]interface{}, error)
+	GetVmConfig(vmr *proxmox.VmRef) (map[string]interface{}, error)
+}
+
+var _ linkedCloneLister = &proxmox.Client{}
+
+// linkedClones returns the IDs of the VMs on the cluster having disks based
+// on the disks of the given template. The volumes of linked clones reference
+// the volume they're based on, e.g. local-lvm:base-9000-disk-0/vm-101-disk-0
+// or local:9000/base-9000-disk-0.qcow2/101/vm-101-disk-0.qcow2.
+func linkedClones(client linkedCloneLister, template *proxmox.VmRef) ([]int, error) {
+	resources, err := client.GetResourceList("vm")
+	if err != nil {
+		return nil, fmt.Errorf("error listing VMs: %s", err)
+	}
+	base := fmt.Sprintf("base-%d-disk-", template.VmId())
+
+	var ids []int
+	for _, r := range resources {
+		vm, ok := r.(map[string]interface{})
+		if !ok || vm["type"] != "qemu" {
+			continue
+		}
+		id, _ := vm["vmid"].(float64)
+		node, _ := vm["node"].(string)
+		if int(id) == template.VmId() || id == 0 {
+			continue
+		}
+		vmRef := proxmox.NewVmRef(int(id))
+		vmRef.SetNode(node)
+		vmRef.SetVmType("qemu")
+		vmConfig, err := client.GetVmConfig(vmRef)
+		if err != nil {
+			return nil, fmt.Errorf("error reading configuration of VM %d: %s", int(id), err)
+		}
+		for _, v := range vmConfig {
+			value, ok := v.(string)
+			if !ok {
+				continue
+			}
+			volume := strings.SplitN(value, ",", 2)[0]
+			if strings.Contains(volume, base) && strings.Contains(volume, "/vm-") {
+				ids = append(ids, int(id))
+				break
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
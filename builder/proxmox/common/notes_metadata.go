@@ -0,0 +1,70 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// notesMetadataFence opens the code block holding the metadata in the notes.
+// A fenced code block keeps the JSON readable in the Proxmox interface, which
+// renders the notes as Markdown.
+const notesMetadataFence = "```packer-metadata"
+
+// ErrNoNotesMetadata is returned by ParseNotesMetadata when the notes don't
+// contain a metadata block.
+var ErrNoNotesMetadata = errors.New("no packer-metadata block found")
+
+// NotesMetadata is the build metadata appended to the notes (description) of
+// the artifact when `notes_metadata` is set.
+type NotesMetadata struct {
+	BuildTime     time.Time `json:"build_time"`
+	BuildName     string    `json:"build_name,omitempty"`
+	PackerVersion string    `json:"packer_version,omitempty"`
+	PluginVersion string    `json:"plugin_version,omitempty"`
+	// The ISOs attached during the build, with their configured checksum
+	ISOs []NotesMetadataISO `json:"isos,omitempty"`
+	// The VM the artifact was cloned from, for the clone builder
+	CloneSourceVMID int `json:"clone_source_vmid,omitempty"`
+	// The key/values of `notes_metadata_values`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// NotesMetadataISO describes an ISO attached during the build.
+type NotesMetadataISO struct {
+	File     string   `json:"file,omitempty"`
+	URLs     []string `json:"urls,omitempty"`
+	Checksum string   `json:"checksum,omitempty"`
+}
+
+// String returns the metadata as the block appended to the notes.
+func (m *NotesMetadata) String() string {
+	// Marshalling a struct of plain values can't fail
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return fmt.Sprintf("%s\n%s\n```", notesMetadataFence, data)
+}
+
+// ParseNotesMetadata reads back the metadata block from the notes of a VM or
+// template built with `notes_metadata`. It returns ErrNoNotesMetadata if the
+// notes don't contain one.
+func ParseNotesMetadata(notes string) (*NotesMetadata, error) {
+	notes = strings.ReplaceAll(notes, "\r\n", "\n")
+	_, block, found := strings.Cut(notes, notesMetadataFence+"\n")
+	if !found {
+		return nil, ErrNoNotesMetadata
+	}
+	block, _, found = strings.Cut(block, "\n```")
+	if !found {
+		return nil, fmt.Errorf("packer-metadata block isn't terminated")
+	}
+	m := &NotesMetadata{}
+	if err := json.Unmarshal([]byte(block), m); err != nil {
+		return nil, fmt.Errorf("error parsing packer-metadata block: %s", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,147 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestParseNotesMetadata(t *testing.T) {
+	metadata := &NotesMetadata{
+		BuildTime:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		BuildName:       "debian",
+		PackerVersion:   "1.11.0",
+		PluginVersion:   "1.2.5",
+		ISOs:            []NotesMetadataISO{{File: "local:iso/debian.iso", Checksum: "sha256:abc"}},
+		CloneSourceVMID: 9000,
+		Values:          map[string]string{"git_sha": "0123abc"},
+	}
+
+	cs := []struct {
+		name        string
+		notes       string
+		expected    *NotesMetadata
+		expectedErr error
+	}{
+		{
+			name:     "block only",
+			notes:    metadata.String(),
+			expected: metadata,
+		},
+		{
+			name:     "block after the description",
+			notes:    "Debian 12 template\n\n" + metadata.String(),
+			expected: metadata,
+		},
+		{
+			name:     "Windows line endings",
+			notes:    strings.ReplaceAll("Debian 12 template\n\n"+metadata.String()+"\n", "\n", "\r\n"),
+			expected: metadata,
+		},
+		{
+			name:        "no block",
+			notes:       "Debian 12 template",
+			expectedErr: ErrNoNotesMetadata,
+		},
+		{
+			name:  "unterminated block",
+			notes: "```packer-metadata\n{}",
+		},
+		{
+			name:  "invalid JSON",
+			notes: "```packer-metadata\n{\n```",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseNotesMetadata(c.notes)
+			if c.expected == nil {
+				if err == nil {
+					t.Fatal("Expected an error, got none")
+				}
+				if c.expectedErr != nil && !errors.Is(err, c.expectedErr) {
+					t.Errorf("Expected error %q, got %q", c.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected %+v, got %+v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestFinalizeNotesMetadata(t *testing.T) {
+	iso := ISOsConfig{ISOFile: "local:iso/debian.iso"}
+	iso.ISOConfig = commonsteps.ISOConfig{ISOUrls: []string{"https://example.com/debian.iso"}, ISOChecksum: "sha256:abc"}
+	c := &Config{
+		PackerConfig:        common.PackerConfig{PackerBuildName: "debian", PackerCoreVersion: "1.11.0"},
+		TemplateDescription: "Debian 12 template",
+		NotesMetadata:       true,
+		NotesMetadataValues: map[string]string{"git_sha": "0123abc"},
+		ISOs:                []ISOsConfig{iso},
+	}
+
+	var description string
+	client := finalizerMock{
+		getConfig: func() (map[string]interface{}, error) {
+			return map[string]interface{}{}, nil
+		},
+		setConfig: func(cfg map[string]interface{}) (string, error) {
+			description = cfg["description"].(string)
+			return "", nil
+		},
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", packersdk.TestUi(t))
+	state.Put("config", c)
+	state.Put("vmRef", proxmox.NewVmRef(1))
+	state.Put("proxmoxClient", client)
+	state.Put("clone_source_vmid", 9000)
+
+	step := stepFinalizeConfig{}
+	if action := step.Run(context.TODO(), state); action != multistep.ActionContinue {
+		t.Fatalf("Expected action to be %v, got %v", multistep.ActionContinue, action)
+	}
+
+	if !strings.HasPrefix(description, "Debian 12 template\n\n") {
+		t.Errorf("Expected the template description to be kept, got %q", description)
+	}
+	m, err := ParseNotesMetadata(description)
+	if err != nil {
+		t.Fatalf("Expected the metadata to be parsed: %s", err)
+	}
+	if m.BuildTime.IsZero() {
+		t.Error("Expected build time to be set")
+	}
+	if m.BuildName != "debian" || m.PackerVersion != "1.11.0" || m.PluginVersion == "" {
+		t.Errorf("Expected build name and versions to be set, got %+v", m)
+	}
+	expectedISOs := []NotesMetadataISO{{File: "local:iso/debian.iso", URLs: []string{"https://example.com/debian.iso"}, Checksum: "sha256:abc"}}
+	if !reflect.DeepEqual(m.ISOs, expectedISOs) {
+		t.Errorf("Expected ISOs %+v, got %+v", expectedISOs, m.ISOs)
+	}
+	if m.CloneSourceVMID != 9000 {
+		t.Errorf("Expected clone source 9000, got %d", m.CloneSourceVMID)
+	}
+	if m.Values["git_sha"] != "0123abc" {
+		t.Errorf("Expected user values to be recorded, got %v", m.Values)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"fmt"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// When `snapshot_name` is set, the build runs on a long-lived VM which gets
+// a new snapshot on every build. The VM is only created by the first build,
+// later builds run on the existing VM, and restore it to the state it was in
+// before the build when the build fails.
+
+type snapshotTarget interface {
+	GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error)
+	GetVmState(*proxmox.VmRef) (map[string]interface{}, error)
+	StartVm(*proxmox.VmRef) (string, error)
+	StopVm(*proxmox.VmRef) (string, error)
+	GetItemListInterfaceArray(string) ([]interface{}, error)
+	PostWithTask(map[string]interface{}, string) (string, error)
+	DeleteWithTask(string) (string, error)
+}
+
+var _ snapshotTarget = &proxmox.Client{}
+
+// useSnapshotTarget prepares the existing VM to run the build on. It records
+// the snapshot the VM is currently on, so it can be restored if the build
+// fails, and starts the VM.
+func useSnapshotTarget(state multistep.StateBag, vmRef *proxmox.VmRef) error {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(snapshotTarget)
+	c := state.Get("config").(*Config)
+
+	ui.Say(fmt.Sprintf("Building on existing VM %d", vmRef.VmId()))
+	vmConfig, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return fmt.Errorf("error reading VM configuration: %s", err)
+	}
+	if vmConfig["template"] != nil {
+		return fmt.Errorf("VM %d is a template, snapshots can only be taken of VMs", vmRef.VmId())
+	}
+
+	exists, err := hasSnapshot(client, vmRef, c.SnapshotName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !c.PackerForce {
+			return fmt.Errorf("snapshot %s already exists, use -force to replace it", c.SnapshotName)
+		}
+		ui.Say(fmt.Sprintf("Force set, snapshot %s will be replaced once the build succeeded", c.SnapshotName))
+		state.Put("snapshot_replace", true)
+	}
+
+	parent, _ := vmConfig["parent"].(string)
+	state.Put("snapshot_target_parent", parent)
+	state.Put("snapshot_target_reused", true)
+	state.Put("vmRef", vmRef)
+	state.Put("instance_id", vmRef.VmId())
+
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		return fmt.Errorf("error getting VM state: %s", err)
+	}
+	if vmState["status"] != "running" {
+		ui.Say("Starting VM")
+		if _, err := client.StartVm(vmRef); err != nil {
+			return fmt.Errorf("error starting VM: %s", err)
+		}
+	}
+	return nil
+}
+
+// hasSnapshot reports whether the VM has a snapshot with the given name.
+func hasSnapshot(client snapshotTarget, vmRef *proxmox.VmRef, name string) (bool, error) {
+	snapshots, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot", vmRef.Node(), vmRef.VmId()))
+	if err != nil {
+		return false, fmt.Errorf("error listing snapshots: %s", err)
+	}
+	for _, snapshot := range snapshots {
+		if s, ok := snapshot.(map[string]interface{}); ok && s["name"] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// restoreSnapshotTarget undoes the changes a failed build made to the
+// existing VM, by removing the build snapshots and rolling back to the
+// snapshot the VM was on before the build.
+func restoreSnapshotTarget(state multistep.StateBag, vmRef *proxmox.VmRef) {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(snapshotTarget)
+
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error getting state of VM %d: %s", vmRef.VmId(), err))
+		return
+	}
+	if vmState["status"] == "running" {
+		ui.Say("Stopping VM")
+		if _, err := client.StopVm(vmRef); err != nil {
+			ui.Error(fmt.Sprintf("Error stopping VM %d, please restore it manually: %s", vmRef.VmId(), err))
+			return
+		}
+	}
+
+	snapshots, _ := state.Get("build_snapshots").([]string)
+	// Remove the newest snapshot first, snapshots depend on their parent
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		ui.Say(fmt.Sprintf("Deleting build snapshot %s", snapshots[i]))
+		exitStatus, err := client.DeleteWithTask(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s", vmRef.Node(), vmRef.VmId(), snapshots[i]))
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error deleting build snapshot %s, please delete it manually: %s: %s", snapshots[i], err, exitStatus))
+		}
+	}
+
+	parent, _ := state.Get("snapshot_target_parent").(string)
+	if parent == "" || parent == "current" {
+		ui.Error(fmt.Sprintf("VM %d has no snapshot to roll back to, it keeps the changes of the failed build", vmRef.VmId()))
+		return
+	}
+	ui.Say(fmt.Sprintf("Rolling back VM %d to snapshot %s", vmRef.VmId(), parent))
+	exitStatus, err := client.PostWithTask(nil, fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s/rollback", vmRef.Node(), vmRef.VmId(), parent))
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error rolling back VM %d to snapshot %s, please restore it manually: %s: %s", vmRef.VmId(), parent, err, exitStatus))
+	}
+}
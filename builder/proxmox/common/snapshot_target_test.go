@@ -0,0 +1,260 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type snapshotTargetMock struct {
+	vmConfig  map[string]interface{}
+	snapshots []interface{}
+	status    string
+	started   bool
+	stopped   bool
+	posted    []string
+	deleted   []string
+	changes   map[string]interface{}
+}
+
+func (m *snapshotTargetMock) GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error) {
+	return m.vmConfig, nil
+}
+
+func (m *snapshotTargetMock) GetVmState(*proxmox.VmRef) (map[string]interface{}, error) {
+	return map[string]interface{}{"status": m.status}, nil
+}
+
+func (m *snapshotTargetMock) StartVm(*proxmox.VmRef) (string, error) {
+	m.started = true
+	return "", nil
+}
+
+func (m *snapshotTargetMock) StopVm(*proxmox.VmRef) (string, error) {
+	m.stopped = true
+	return "", nil
+}
+
+func (m *snapshotTargetMock) GetItemListInterfaceArray(string) ([]interface{}, error) {
+	return m.snapshots, nil
+}
+
+func (m *snapshotTargetMock) PostWithTask(_ map[string]interface{}, url string) (string, error) {
+	m.posted = append(m.posted, url)
+	return "", nil
+}
+
+func (m *snapshotTargetMock) DeleteWithTask(url string) (string, error) {
+	m.deleted = append(m.deleted, url)
+	return "", nil
+}
+
+func (m *snapshotTargetMock) SetVmConfig(_ *proxmox.VmRef, changes map[string]interface{}) (interface{}, error) {
+	m.changes = changes
+	return nil, nil
+}
+
+func (m *snapshotTargetMock) Version() (proxmox.Version, error) {
+	return proxmox.Version{Major: 8}, nil
+}
+
+func (m *snapshotTargetMock) ShutdownVm(*proxmox.VmRef) (string, error) {
+	m.stopped = true
+	return "", nil
+}
+
+func (m *snapshotTargetMock) CreateTemplate(*proxmox.VmRef) error {
+	return nil
+}
+
+var _ snapshotTarget = &snapshotTargetMock{}
+var _ finalizer = &snapshotTargetMock{}
+
+func TestUseSnapshotTarget(t *testing.T) {
+	cs := []struct {
+		name            string
+		vmConfig        map[string]interface{}
+		force           bool
+		expectError     bool
+		expectedReplace bool
+		expectedParent  string
+	}{
+		{
+			name:           "VM on a snapshot",
+			vmConfig:       map[string]interface{}{"parent": "build-0"},
+			expectedParent: "build-0",
+		},
+		{
+			name:     "VM without snapshots",
+			vmConfig: map[string]interface{}{},
+		},
+		{
+			name:        "template, fail",
+			vmConfig:    map[string]interface{}{"template": 1},
+			expectError: true,
+		},
+		{
+			name:        "existing snapshot, fail",
+			vmConfig:    map[string]interface{}{"parent": "build-1"},
+			expectError: true,
+		},
+		{
+			name:            "existing snapshot with force is replaced",
+			vmConfig:        map[string]interface{}{"parent": "build-1"},
+			force:           true,
+			expectedReplace: true,
+			expectedParent:  "build-1",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &snapshotTargetMock{
+				vmConfig: c.vmConfig,
+				status:   "stopped",
+			}
+			if parent, ok := c.vmConfig["parent"]; ok {
+				client.snapshots = []interface{}{
+					map[string]interface{}{"name": parent},
+					map[string]interface{}{"name": "current", "parent": parent},
+				}
+			}
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", &Config{SnapshotName: "build-1", PackerConfig: common.PackerConfig{PackerForce: c.force}})
+			state.Put("proxmoxClient", client)
+
+			err := useSnapshotTarget(state, vmRef)
+			if c.expectError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if _, ok := state.GetOk("vmRef"); ok {
+					t.Error("the VM should not be used by the build")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !client.started {
+				t.Error("expected the VM to be started")
+			}
+			if replace, _ := state.Get("snapshot_replace").(bool); replace != c.expectedReplace {
+				t.Errorf("expected snapshot_replace %t, got %t", c.expectedReplace, replace)
+			}
+			if parent := state.Get("snapshot_target_parent").(string); parent != c.expectedParent {
+				t.Errorf("expected parent %q, got %q", c.expectedParent, parent)
+			}
+			if len(client.deleted) != 0 {
+				t.Errorf("nothing should be deleted before the build, deleted %v", client.deleted)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotTarget(t *testing.T) {
+	cs := []struct {
+		name            string
+		parent          string
+		buildSnapshots  []string
+		expectedPosted  []string
+		expectedDeleted []string
+	}{
+		{
+			name:            "rolls back to the previous snapshot",
+			parent:          "build-0",
+			buildSnapshots:  []string{"packer-connected", "packer-provisioned"},
+			expectedPosted:  []string{"/nodes/pve/qemu/100/snapshot/build-0/rollback"},
+			expectedDeleted: []string{"/nodes/pve/qemu/100/snapshot/packer-provisioned", "/nodes/pve/qemu/100/snapshot/packer-connected"},
+		},
+		{
+			name: "nothing to roll back to",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &snapshotTargetMock{status: "running"}
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("proxmoxClient", client)
+			state.Put("snapshot_target_parent", c.parent)
+			state.Put("build_snapshots", c.buildSnapshots)
+
+			restoreSnapshotTarget(state, vmRef)
+
+			if !client.stopped {
+				t.Error("expected the VM to be stopped")
+			}
+			if !reflect.DeepEqual(client.posted, c.expectedPosted) {
+				t.Errorf("expected posts %v, got %v", c.expectedPosted, client.posted)
+			}
+			if !reflect.DeepEqual(client.deleted, c.expectedDeleted) {
+				t.Errorf("expected deletes %v, got %v", c.expectedDeleted, client.deleted)
+			}
+		})
+	}
+}
+
+func TestSnapshotTargetFinalize(t *testing.T) {
+	client := &snapshotTargetMock{
+		vmConfig: map[string]interface{}{
+			"name":        "long-lived",
+			"description": "kept across builds",
+			"parent":      "build-0",
+			"ide2":        "local:cloudinit,media=cdrom",
+		},
+		status: "stopped",
+	}
+	vmRef := proxmox.NewVmRef(100)
+	vmRef.SetNode("pve")
+
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", packersdk.TestUi(t))
+	state.Put("config", &Config{
+		SnapshotName:        "build-1",
+		TemplateName:        "template-name",
+		TemplateDescription: "template description",
+		ISOs: []ISOsConfig{
+			{ISOFile: "local:iso/seed.iso", AssignedDeviceIndex: "ide3", Unmount: true},
+			{ISOFile: "local:iso/tools.iso", AssignedDeviceIndex: "sata0"},
+		},
+	})
+	state.Put("proxmoxClient", client)
+
+	if err := useSnapshotTarget(state, vmRef); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, step := range []multistep.Step{&stepConvertToTemplate{}, &stepFinalizeConfig{}, &stepCreateSnapshot{}} {
+		if action := step.Run(context.TODO(), state); action != multistep.ActionContinue {
+			t.Fatalf("%T halted: %v", step, state.Get("error"))
+		}
+	}
+
+	for _, key := range []string{"name", "description", "ide3", "sata0"} {
+		if v, ok := client.changes[key]; ok {
+			t.Errorf("%s of the reused VM should be kept, got change %v", key, v)
+		}
+	}
+	if !reflect.DeepEqual(client.posted, []string{"/nodes/pve/qemu/100/snapshot"}) {
+		t.Errorf("expected the snapshot to be created, got posts %v", client.posted)
+	}
+	if snapshot := state.Get("artifact_snapshot"); snapshot != "build-1" {
+		t.Errorf("expected artifact snapshot build-1, got %v", snapshot)
+	}
+}
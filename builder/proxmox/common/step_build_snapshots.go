@@ -0,0 +1,172 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Build snapshots are taken during the build, so a failed provisioning run
+// can be retried from a known state when running with `-on-error=ask`,
+// without having to start the build from scratch. They are removed once
+// provisioning succeeded, and are listed in the "build_snapshots" state key.
+
+type buildSnapshotter interface {
+	PostWithTask(map[string]interface{}, string) (string, error)
+	DeleteWithTask(string) (string, error)
+	GetVmState(*proxmox.VmRef) (map[string]interface{}, error)
+	StartVm(*proxmox.VmRef) (string, error)
+}
+
+var _ buildSnapshotter = &proxmox.Client{}
+
+// stepCreateBuildSnapshot takes a build snapshot of the running VM, including
+// its RAM, when `snapshot_before_provisioning` is set.
+type stepCreateBuildSnapshot struct {
+	Name string
+}
+
+func (s *stepCreateBuildSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(buildSnapshotter)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+	c := state.Get("config").(*Config)
+
+	if !c.SnapshotBeforeProvisioning {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Creating build snapshot %s", s.Name))
+	// Include the RAM, so a rollback resumes the running VM instead of
+	// booting it again, e.g. from the installation ISO
+	exitStatus, err := client.PostWithTask(map[string]interface{}{
+		"snapname":    s.Name,
+		"description": "Packer build snapshot, removed once provisioning succeeded",
+		"vmstate":     1,
+	}, fmt.Sprintf("/nodes/%s/qemu/%d/snapshot", vmRef.Node(), vmRef.VmId()))
+	if err != nil {
+		err := fmt.Errorf("error creating build snapshot %s: %s: %s", s.Name, err, exitStatus)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	snapshots, _ := state.Get("build_snapshots").([]string)
+	state.Put("build_snapshots", append(snapshots, s.Name))
+	return multistep.ActionContinue
+}
+
+func (s *stepCreateBuildSnapshot) Cleanup(state multistep.StateBag) {}
+
+// stepProvisionWithRollback runs the provisioners. When they fail while
+// running with `-on-error=ask`, it offers to roll the VM back to the last
+// build snapshot, reconnect and run the provisioners again, before the
+// usual choices are offered.
+type stepProvisionWithRollback struct {
+	Provision multistep.Step
+	// Connect is run again to reconnect to the VM after a rollback
+	Connect multistep.Step
+}
+
+func (s *stepProvisionWithRollback) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+
+	for {
+		action := s.Provision.Run(ctx, state)
+		snapshots, _ := state.Get("build_snapshots").([]string)
+		if action != multistep.ActionHalt || c.PackerOnError != "ask" || len(snapshots) == 0 {
+			return action
+		}
+		snapshot := snapshots[len(snapshots)-1]
+
+		if err, ok := state.GetOk("error"); ok {
+			ui.Error(fmt.Sprintf("%s", err))
+		}
+		line, err := ui.Ask(fmt.Sprintf("[s] roll back to snapshot %s and retry provisioning, or press enter for other options?", snapshot))
+		if err != nil || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "s") {
+			return action
+		}
+
+		if err := rollbackBuildSnapshot(state, snapshot); err != nil {
+			err := fmt.Errorf("error rolling back to build snapshot %s: %s", snapshot, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		// The connection of the communicator didn't survive the rollback,
+		// make sure the provisioners only get the new one
+		s.Connect.Cleanup(state)
+		state.Remove("communicator")
+		if action := s.Connect.Run(ctx, state); action != multistep.ActionContinue {
+			return action
+		}
+		state.Remove("error")
+	}
+}
+
+// rollbackBuildSnapshot restores the VM to the given snapshot and makes sure
+// it is running again.
+func rollbackBuildSnapshot(state multistep.StateBag, snapshot string) error {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(buildSnapshotter)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+
+	ui.Say(fmt.Sprintf("Rolling back to build snapshot %s", snapshot))
+	exitStatus, err := client.PostWithTask(nil, fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s/rollback", vmRef.Node(), vmRef.VmId(), snapshot))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, exitStatus)
+	}
+
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		return fmt.Errorf("error getting VM state: %s", err)
+	}
+	if vmState["status"] != "running" {
+		ui.Say("Starting VM")
+		if _, err := client.StartVm(vmRef); err != nil {
+			return fmt.Errorf("error starting VM: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *stepProvisionWithRollback) Cleanup(state multistep.StateBag) {
+	s.Provision.Cleanup(state)
+}
+
+// stepDeleteBuildSnapshots removes the build snapshots once provisioning
+// succeeded. Snapshots would prevent moving the disks, and don't belong in
+// the artifact.
+type stepDeleteBuildSnapshots struct{}
+
+func (s *stepDeleteBuildSnapshots) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(buildSnapshotter)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+
+	snapshots, _ := state.Get("build_snapshots").([]string)
+	// Remove the newest snapshot first, snapshots depend on their parent
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		ui.Say(fmt.Sprintf("Deleting build snapshot %s", snapshots[i]))
+		exitStatus, err := client.DeleteWithTask(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s", vmRef.Node(), vmRef.VmId(), snapshots[i]))
+		if err != nil {
+			err := fmt.Errorf("error deleting build snapshot %s: %s: %s", snapshots[i], err, exitStatus)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		state.Put("build_snapshots", snapshots[:i])
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepDeleteBuildSnapshots) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,241 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type buildSnapshotterMock struct {
+	status string
+
+	posts   []string
+	params  []map[string]interface{}
+	deletes []string
+	started bool
+}
+
+func (m *buildSnapshotterMock) PostWithTask(params map[string]interface{}, url string) (string, error) {
+	m.posts = append(m.posts, url)
+	m.params = append(m.params, params)
+	if strings.HasSuffix(url, "/rollback") {
+		m.status = "stopped"
+	}
+	return "OK", nil
+}
+
+func (m *buildSnapshotterMock) DeleteWithTask(url string) (string, error) {
+	m.deletes = append(m.deletes, url)
+	return "OK", nil
+}
+
+func (m *buildSnapshotterMock) GetVmState(*proxmox.VmRef) (map[string]interface{}, error) {
+	return map[string]interface{}{"status": m.status}, nil
+}
+
+func (m *buildSnapshotterMock) StartVm(*proxmox.VmRef) (string, error) {
+	m.started = true
+	m.status = "running"
+	return "", nil
+}
+
+var _ buildSnapshotter = &buildSnapshotterMock{}
+
+// failingStepMock halts the given number of times before it continues
+type failingStepMock struct {
+	failures int
+	runs     int
+}
+
+func (s *failingStepMock) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.runs++
+	if s.runs <= s.failures {
+		state.Put("error", fmt.Errorf("provisioner failed"))
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *failingStepMock) Cleanup(state multistep.StateBag) {}
+
+// connectStepMock connects a new communicator, recording whether the
+// previous one was left in the state
+type connectStepMock struct {
+	runs      int
+	cleanups  int
+	staleComm bool
+}
+
+func (s *connectStepMock) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.runs++
+	if _, ok := state.GetOk("communicator"); ok {
+		s.staleComm = true
+	}
+	state.Put("communicator", s.runs)
+	return multistep.ActionContinue
+}
+
+func (s *connectStepMock) Cleanup(state multistep.StateBag) {
+	s.cleanups++
+}
+
+// askUiMock answers the questions of the step with the given answers
+type askUiMock struct {
+	packersdk.Ui
+	answers []string
+	asked   int
+}
+
+func (u *askUiMock) Ask(query string) (string, error) {
+	if u.asked >= len(u.answers) {
+		return "", fmt.Errorf("unexpected question %q", query)
+	}
+	u.asked++
+	return u.answers[u.asked-1], nil
+}
+
+func TestProvisionWithRollback(t *testing.T) {
+	cs := []struct {
+		name               string
+		onError            string
+		snapshot           bool
+		failures           int
+		answers            []string
+		expectedAction     multistep.StepAction
+		expectedProvisions int
+		expectedConnects   int
+		expectedPosts      []string
+	}{
+		{
+			name:               "successful provisioning",
+			onError:            "ask",
+			snapshot:           true,
+			expectedAction:     multistep.ActionContinue,
+			expectedProvisions: 1,
+			expectedPosts:      []string{"/nodes/pve/qemu/100/snapshot"},
+		},
+		{
+			name:               "no rollback without -on-error=ask",
+			onError:            "cleanup",
+			snapshot:           true,
+			failures:           1,
+			expectedAction:     multistep.ActionHalt,
+			expectedProvisions: 1,
+			expectedPosts:      []string{"/nodes/pve/qemu/100/snapshot"},
+		},
+		{
+			name:               "no rollback without snapshot",
+			onError:            "ask",
+			failures:           1,
+			expectedAction:     multistep.ActionHalt,
+			expectedProvisions: 1,
+		},
+		{
+			name:               "rollback and retry",
+			onError:            "ask",
+			snapshot:           true,
+			failures:           2,
+			answers:            []string{"s", "s"},
+			expectedAction:     multistep.ActionContinue,
+			expectedProvisions: 3,
+			expectedConnects:   2,
+			expectedPosts: []string{
+				"/nodes/pve/qemu/100/snapshot",
+				"/nodes/pve/qemu/100/snapshot/packer-connected/rollback",
+				"/nodes/pve/qemu/100/snapshot/packer-connected/rollback",
+			},
+		},
+		{
+			name:               "declined rollback",
+			onError:            "ask",
+			snapshot:           true,
+			failures:           1,
+			answers:            []string{""},
+			expectedAction:     multistep.ActionHalt,
+			expectedProvisions: 1,
+			expectedPosts:      []string{"/nodes/pve/qemu/100/snapshot"},
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &buildSnapshotterMock{status: "running"}
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+			provision := &failingStepMock{failures: c.failures}
+			connect := &connectStepMock{}
+
+			ui := &askUiMock{Ui: packersdk.TestUi(t), answers: c.answers}
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", ui)
+			state.Put("config", &Config{
+				PackerConfig:               common.PackerConfig{PackerOnError: c.onError},
+				SnapshotBeforeProvisioning: c.snapshot,
+			})
+			state.Put("proxmoxClient", client)
+			state.Put("vmRef", vmRef)
+			state.Put("communicator", 0)
+
+			steps := []multistep.Step{
+				&stepCreateBuildSnapshot{Name: "packer-connected"},
+				&stepProvisionWithRollback{Provision: provision, Connect: connect},
+				&stepDeleteBuildSnapshots{},
+			}
+			action := multistep.ActionContinue
+			for _, step := range steps {
+				if action = step.Run(context.TODO(), state); action != multistep.ActionContinue {
+					break
+				}
+			}
+
+			if action != c.expectedAction {
+				t.Fatalf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if provision.runs != c.expectedProvisions {
+				t.Errorf("Expected %d provisioning runs, got %d", c.expectedProvisions, provision.runs)
+			}
+			if connect.runs != c.expectedConnects {
+				t.Errorf("Expected %d reconnects, got %d", c.expectedConnects, connect.runs)
+			}
+			if !reflect.DeepEqual(client.posts, c.expectedPosts) {
+				t.Errorf("Expected requests %v, got %v", c.expectedPosts, client.posts)
+			}
+			if c.expectedConnects > 0 && !client.started {
+				t.Error("Expected the VM to be started after the rollback")
+			}
+			if connect.cleanups != c.expectedConnects {
+				t.Errorf("Expected the previous connection to be cleaned up %d times, got %d", c.expectedConnects, connect.cleanups)
+			}
+			if connect.staleComm {
+				t.Error("Expected the communicator from before the rollback to be removed")
+			}
+			if c.snapshot && client.params[0]["vmstate"] != 1 {
+				t.Errorf("Expected the build snapshot to include the RAM, got %v", client.params[0])
+			}
+			if c.snapshot && action == multistep.ActionContinue {
+				if !reflect.DeepEqual(client.deletes, []string{"/nodes/pve/qemu/100/snapshot/packer-connected"}) {
+					t.Errorf("Expected the build snapshot to be deleted, got %v", client.deletes)
+				}
+				if snapshots, _ := state.Get("build_snapshots").([]string); len(snapshots) != 0 {
+					t.Errorf("Expected no build snapshots to be left, got %v", snapshots)
+				}
+			}
+			if _, ok := state.GetOk("error"); ok != (action == multistep.ActionHalt) {
+				t.Errorf("Expected error state to be: %v, got: %v", action == multistep.ActionHalt, ok)
+			}
+			if ui.asked != len(c.answers) {
+				t.Errorf("Expected %d questions, got %d", len(c.answers), ui.asked)
+			}
+		})
+	}
+}
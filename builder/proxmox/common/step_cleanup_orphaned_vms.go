@@ -0,0 +1,141 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepCleanupOrphanedVMs deletes the build VMs left behind by Packer processes
+// that were killed, before a new build starts. Build VMs are recognized by
+// their tag. A running build updates the heartbeat in the description of its
+// build VM, see startBuildVMHeartbeat, VMs without a recent one are orphans.
+//
+// Failing to clean up doesn't fail the build, it's only reported.
+type stepCleanupOrphanedVMs struct{}
+
+type orphanCleaner interface {
+	GetResourceList(resourceType string) ([]interface{}, error)
+	GetVmConfig(vmr *proxmox.VmRef) (map[string]interface{}, error)
+	GetVmState(vmr *proxmox.VmRef) (map[string]interface{}, error)
+	StopVm(vmr *proxmox.VmRef) (string, error)
+	DeleteVm(vmr *proxmox.VmRef) (string, error)
+}
+
+var _ orphanCleaner = &proxmox.Client{}
+
+func (s *stepCleanupOrphanedVMs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(orphanCleaner)
+	c := state.Get("config").(*Config)
+
+	if c.CleanupOrphanedVMsOlderThan == 0 {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Looking for orphaned build VMs older than %s", c.CleanupOrphanedVMsOlderThan))
+	orphans, err := orphanedVMs(client, c.CleanupOrphanedVMsOlderThan, time.Now())
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error looking for orphaned build VMs: %s", err))
+		return multistep.ActionContinue
+	}
+
+	for _, orphan := range orphans {
+		ui.Say(fmt.Sprintf("Deleting orphaned build VM %d (build %s, started %s on %s)",
+			orphan.vmRef.VmId(), orphan.fields["build"], orphan.fields["started"], orphan.fields["host"]))
+		if err := deleteOrphanedVM(client, orphan.vmRef); err != nil {
+			ui.Error(fmt.Sprintf("Error deleting orphaned build VM %d. Please delete it manually: %s", orphan.vmRef.VmId(), err))
+		}
+	}
+	return multistep.ActionContinue
+}
+
+type orphanedVM struct {
+	vmRef  *proxmox.VmRef
+	fields map[string]string
+}
+
+// orphanedVMs returns the build VMs on the cluster whose build wasn't seen
+// alive for maxAge. Templates and failed builds kept by keep_vm_on_error are
+// never considered orphans.
+func orphanedVMs(client orphanCleaner, maxAge time.Duration, now time.Time) ([]orphanedVM, error) {
+	resources, err := client.GetResourceList("vm")
+	if err != nil {
+		return nil, fmt.Errorf("error listing VMs: %s", err)
+	}
+
+	var orphans []orphanedVM
+	for _, r := range resources {
+		vm, ok := r.(map[string]interface{})
+		if !ok || vm["type"] != "qemu" || !hasTag(vm, buildVMTag) || hasTag(vm, failedBuildTag) {
+			continue
+		}
+		id, _ := vm["vmid"].(float64)
+		node, _ := vm["node"].(string)
+		vmRef := proxmox.NewVmRef(int(id))
+		vmRef.SetNode(node)
+		vmRef.SetVmType("qemu")
+
+		vmConfig, err := client.GetVmConfig(vmRef)
+		if err != nil {
+			// One unreadable VM, e.g. on a node that is down, shouldn't stop the cleanup
+			log.Printf("error reading configuration of VM %d, skipping it: %s", int(id), err)
+			continue
+		}
+		if vmConfig["template"] != nil || hasTag(vmConfig, failedBuildTag) {
+			continue
+		}
+		description, _ := vmConfig["description"].(string)
+		fields, ok := parseBuildVMDescription(description)
+		if !ok {
+			log.Printf("VM %d is tagged %s, but its description doesn't describe a build, skipping it", int(id), buildVMTag)
+			continue
+		}
+		// Build VMs created before heartbeats were recorded only have a start time
+		lastSeen := fields["heartbeat"]
+		if lastSeen == "" {
+			lastSeen = fields["started"]
+		}
+		seen, err := time.Parse(time.RFC3339, lastSeen)
+		if err != nil {
+			log.Printf("VM %d has an invalid heartbeat %q, skipping it", int(id), lastSeen)
+			continue
+		}
+		if now.Sub(seen) < maxAge {
+			log.Printf("build VM %d was last seen alive at %s, not orphaned yet", int(id), lastSeen)
+			continue
+		}
+		orphans = append(orphans, orphanedVM{vmRef: vmRef, fields: fields})
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].vmRef.VmId() < orphans[j].vmRef.VmId()
+	})
+	return orphans, nil
+}
+
+func deleteOrphanedVM(client orphanCleaner, vmRef *proxmox.VmRef) error {
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		return fmt.Errorf("error getting VM state: %s", err)
+	}
+	if vmState["status"] == "running" {
+		if _, err := client.StopVm(vmRef); err != nil {
+			return fmt.Errorf("error stopping VM: %s", err)
+		}
+	}
+	if _, err := client.DeleteVm(vmRef); err != nil {
+		return fmt.Errorf("error deleting VM: %s", err)
+	}
+	return nil
+}
+
+func (s *stepCleanupOrphanedVMs) Cleanup(state multistep.StateBag) {}
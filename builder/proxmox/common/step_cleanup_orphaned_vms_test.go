@@ -0,0 +1,197 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type orphanCleanerMock struct {
+	resources []interface{}
+	configs   map[int]map[string]interface{}
+	configErr map[int]error
+	running   map[int]bool
+	deleteErr error
+
+	stopped []int
+	deleted []int
+}
+
+func (m *orphanCleanerMock) GetResourceList(resourceType string) ([]interface{}, error) {
+	return m.resources, nil
+}
+
+func (m *orphanCleanerMock) GetVmConfig(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+	if err := m.configErr[vmr.VmId()]; err != nil {
+		return nil, err
+	}
+	return m.configs[vmr.VmId()], nil
+}
+
+func (m *orphanCleanerMock) GetVmState(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+	if m.running[vmr.VmId()] {
+		return map[string]interface{}{"status": "running"}, nil
+	}
+	return map[string]interface{}{"status": "stopped"}, nil
+}
+
+func (m *orphanCleanerMock) StopVm(vmr *proxmox.VmRef) (string, error) {
+	m.stopped = append(m.stopped, vmr.VmId())
+	return "", nil
+}
+
+func (m *orphanCleanerMock) DeleteVm(vmr *proxmox.VmRef) (string, error) {
+	if m.deleteErr != nil {
+		return "", m.deleteErr
+	}
+	m.deleted = append(m.deleted, vmr.VmId())
+	return "", nil
+}
+
+var _ orphanCleaner = &orphanCleanerMock{}
+
+func TestCleanupOrphanedVMs(t *testing.T) {
+	old := buildVMDescription("proxmox-iso.debian", time.Now().Add(-48*time.Hour), time.Now().Add(-47*time.Hour))
+	recent := buildVMDescription("proxmox-iso.debian", time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	alive := buildVMDescription("proxmox-iso.debian", time.Now().Add(-48*time.Hour), time.Now().Add(-time.Minute))
+	// written by plugin versions without heartbeats
+	legacy := "Packer ephemeral build VM\nbuild: proxmox-iso.debian\nstarted: " + time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339)
+
+	resources := []interface{}{
+		// on a node that is down
+		map[string]interface{}{"type": "qemu", "vmid": 99.0, "node": "pve2", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 100.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 101.0, "node": "pve", "tags": "debian;packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 102.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 103.0, "node": "pve", "tags": "packer-build;packer-failed"},
+		map[string]interface{}{"type": "qemu", "vmid": 104.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 105.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 106.0, "node": "pve"},
+		map[string]interface{}{"type": "lxc", "vmid": 107.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 108.0, "node": "pve", "tags": "packer-build"},
+		map[string]interface{}{"type": "qemu", "vmid": 109.0, "node": "pve", "tags": "packer-build"},
+	}
+	configs := map[int]map[string]interface{}{
+		// orphaned
+		100: {"description": old},
+		101: {"description": old},
+		// still building
+		102: {"description": recent},
+		// kept by keep_vm_on_error
+		103: {"description": old},
+		// converted, but not finalized
+		104: {"description": old, "template": 1.0},
+		// tagged by someone else
+		105: {"description": "my VM"},
+		106: {"description": old},
+		// long running build, still alive
+		108: {"description": alive},
+		// orphaned, without heartbeat
+		109: {"description": legacy},
+	}
+
+	cs := []struct {
+		name            string
+		olderThan       time.Duration
+		deleteErr       error
+		expectedDeleted []int
+	}{
+		{
+			name: "disabled cleanup should not delete",
+		},
+		{
+			name:            "old build VMs should be deleted",
+			olderThan:       24 * time.Hour,
+			expectedDeleted: []int{100, 101, 109},
+		},
+		{
+			name:            "recent build VMs should be deleted with a shorter duration",
+			olderThan:       30 * time.Minute,
+			expectedDeleted: []int{100, 101, 102, 109},
+		},
+		{
+			name:      "failed deletion should not fail the build",
+			olderThan: 24 * time.Hour,
+			deleteErr: fmt.Errorf("VM is locked"),
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &orphanCleanerMock{
+				resources: resources,
+				configs:   configs,
+				configErr: map[int]error{99: fmt.Errorf("595 no route to host")},
+				running:   map[int]bool{100: true},
+				deleteErr: c.deleteErr,
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", &Config{CleanupOrphanedVMsOlderThan: c.olderThan})
+			state.Put("proxmoxClient", client)
+
+			step := &stepCleanupOrphanedVMs{}
+			action := step.Run(context.TODO(), state)
+			if action != multistep.ActionContinue {
+				t.Fatalf("Expected action to be %v, got %v", multistep.ActionContinue, action)
+			}
+			if !reflect.DeepEqual(client.deleted, c.expectedDeleted) {
+				t.Errorf("Expected VMs %v to be deleted, got %v", c.expectedDeleted, client.deleted)
+			}
+			if len(c.expectedDeleted) > 0 && !reflect.DeepEqual(client.stopped, []int{100}) {
+				t.Errorf("Expected running VM 100 to be stopped, got %v", client.stopped)
+			}
+		})
+	}
+}
+
+func TestBuildVMDescription(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fields, ok := parseBuildVMDescription(buildVMDescription("proxmox-iso.debian", started, started.Add(time.Minute)))
+	if !ok {
+		t.Fatal("Expected the build VM description to be parsed")
+	}
+	if fields["build"] != "proxmox-iso.debian" {
+		t.Errorf("Expected build to be %q, got %q", "proxmox-iso.debian", fields["build"])
+	}
+	if fields["started"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("Expected start time to be %q, got %q", "2024-05-01T12:00:00Z", fields["started"])
+	}
+	if fields["host"] == "" {
+		t.Error("Expected host to be set")
+	}
+	if fields["heartbeat"] != "2024-05-01T12:01:00Z" {
+		t.Errorf("Expected heartbeat to be %q, got %q", "2024-05-01T12:01:00Z", fields["heartbeat"])
+	}
+
+	if _, ok := parseBuildVMDescription("Debian 12 template"); ok {
+		t.Error("Expected other descriptions not to be parsed")
+	}
+}
+
+type heartbeatMock struct{}
+
+func (heartbeatMock) SetVmConfig(*proxmox.VmRef, map[string]interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func TestStopBuildVMHeartbeat(t *testing.T) {
+	state := new(multistep.BasicStateBag)
+	// Stopping without a heartbeat, e.g. on a reused VM, is a no-op
+	stopBuildVMHeartbeat(state)
+
+	startBuildVMHeartbeat(state, heartbeatMock{}, proxmox.NewVmRef(100), "proxmox-iso.debian", time.Now())
+	// Both stepFinalizeConfig and the cleanup of stepStartVM stop it
+	stopBuildVMHeartbeat(state)
+	stopBuildVMHeartbeat(state)
+}
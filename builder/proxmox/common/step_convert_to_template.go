@@ -32,21 +32,42 @@ func (s *stepConvertToTemplate) Run(ctx context.Context, state multistep.StateBa
 	vmRef := state.Get("vmRef").(*proxmox.VmRef)
 	c := state.Get("config").(*Config)
 
-	if c.SkipConvertToTemplate {
+	// Earlier steps may have stopped the VM already
+	stopped, _ := state.Get("vm_stopped").(bool)
+
+	switch {
+	case c.SkipConvertToTemplate:
 		ui.Say("skip_convert_to_template set, skipping conversion to template")
 		state.Put("artifact_type", "VM")
-	} else {
-		ui.Say("Stopping VM")
-		_, err := client.ShutdownVm(vmRef)
-		if err != nil {
-			err := fmt.Errorf("Error converting VM to template, could not stop: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+	case c.SnapshotName != "":
+		// The snapshot is taken by stepCreateSnapshot, once the
+		// configuration of the VM is finalized
+		if !c.SnapshotIncludeRAM && !stopped {
+			ui.Say("Stopping VM")
+			_, err := client.ShutdownVm(vmRef)
+			if err != nil {
+				err := fmt.Errorf("Error stopping VM for snapshot: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			state.Put("vm_stopped", true)
+		}
+		state.Put("artifact_type", "snapshot")
+	default:
+		if !stopped {
+			ui.Say("Stopping VM")
+			_, err := client.ShutdownVm(vmRef)
+			if err != nil {
+				err := fmt.Errorf("Error converting VM to template, could not stop: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
 		}
 
 		ui.Say("Converting VM to template")
-		err = client.CreateTemplate(vmRef)
+		err := client.CreateTemplate(vmRef)
 		if err != nil {
 			err := fmt.Errorf("Error converting VM to template: %s", err)
 			state.Put("error", err)
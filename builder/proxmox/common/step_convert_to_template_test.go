@@ -37,6 +37,8 @@ func TestConvertToTemplate(t *testing.T) {
 		expectArtifactIdSet      bool
 		expectArtifactType       string
 		builderConfig            *Config
+		vmStopped                bool
+		expectShutdown           bool
 	}{
 		{
 			name:                     "no errors returns continue and sets template id",
@@ -56,6 +58,39 @@ func TestConvertToTemplate(t *testing.T) {
 				SkipConvertToTemplate: true,
 			},
 		},
+		{
+			name:                     "snapshot mode stops the VM but doesn't create a template",
+			expectCallCreateTemplate: false,
+			expectedAction:           multistep.ActionContinue,
+			expectArtifactIdSet:      true,
+			expectArtifactType:       "snapshot",
+			builderConfig: &Config{
+				SnapshotName: "build-1",
+			},
+			expectShutdown: true,
+		},
+		{
+			name:                     "snapshot mode with RAM keeps the VM running",
+			shutdownErr:              fmt.Errorf("should not be stopped"),
+			expectCallCreateTemplate: false,
+			expectedAction:           multistep.ActionContinue,
+			expectArtifactIdSet:      true,
+			expectArtifactType:       "snapshot",
+			builderConfig: &Config{
+				SnapshotName:       "build-1",
+				SnapshotIncludeRAM: true,
+			},
+		},
+		{
+			name:                     "already stopped VM isn't stopped again",
+			shutdownErr:              fmt.Errorf("VM not running"),
+			expectCallCreateTemplate: true,
+			expectedAction:           multistep.ActionContinue,
+			expectArtifactIdSet:      true,
+			expectArtifactType:       "template",
+			builderConfig:            &Config{},
+			vmStopped:                true,
+		},
 		{
 			name:                     "when shutdown fails, don't try to create template and halt",
 			shutdownErr:              fmt.Errorf("failed to stop vm"),
@@ -80,8 +115,10 @@ func TestConvertToTemplate(t *testing.T) {
 
 	for _, c := range cs {
 		t.Run(c.name, func(t *testing.T) {
+			shutdownWasCalled := false
 			converter := converterMock{
 				shutdownVm: func(r *proxmox.VmRef) (string, error) {
+					shutdownWasCalled = true
 					if r.VmId() != vmid {
 						t.Errorf("ShutdownVm called with unexpected id, expected %d, got %d", vmid, r.VmId())
 					}
@@ -104,6 +141,9 @@ func TestConvertToTemplate(t *testing.T) {
 			state.Put("vmRef", proxmox.NewVmRef(vmid))
 			state.Put("proxmoxClient", converter)
 			state.Put("config", c.builderConfig)
+			if c.vmStopped {
+				state.Put("vm_stopped", true)
+			}
 
 			step := stepConvertToTemplate{}
 			action := step.Run(context.TODO(), state)
@@ -111,6 +151,10 @@ func TestConvertToTemplate(t *testing.T) {
 				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
 			}
 
+			if c.expectShutdown && !shutdownWasCalled {
+				t.Error("Expected ShutdownVm to be called")
+			}
+
 			artifactId, artifactIdWasSet := state.GetOk("artifact_id")
 			artifactType, artifactTypeWasSet := state.GetOk("artifact_type")
 
@@ -0,0 +1,73 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepCreateSnapshot takes the snapshot given by `snapshot_name` of the
+// finalized VM, when the artifact is to be a snapshot instead of a template.
+//
+// An existing snapshot with the same name is only replaced when the build
+// was forced, see useSnapshotTarget.
+//
+// It sets the artifact_snapshot state which is used for Artifact lookup.
+type stepCreateSnapshot struct{}
+
+type snapshotCreator interface {
+	PostWithTask(map[string]interface{}, string) (string, error)
+	DeleteWithTask(string) (string, error)
+}
+
+var _ snapshotCreator = &proxmox.Client{}
+
+func (s *stepCreateSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(snapshotCreator)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+	c := state.Get("config").(*Config)
+
+	if c.SnapshotName == "" {
+		return multistep.ActionContinue
+	}
+
+	if replace, _ := state.Get("snapshot_replace").(bool); replace {
+		ui.Say(fmt.Sprintf("Deleting existing snapshot %s of VM %d", c.SnapshotName, vmRef.VmId()))
+		exitStatus, err := client.DeleteWithTask(fmt.Sprintf("/nodes/%s/qemu/%d/snapshot/%s", vmRef.Node(), vmRef.VmId(), c.SnapshotName))
+		if err != nil {
+			err := fmt.Errorf("Error deleting existing snapshot %s: %s: %s", c.SnapshotName, err, exitStatus)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	params := map[string]interface{}{
+		"snapname": c.SnapshotName,
+	}
+	msg := fmt.Sprintf("Creating snapshot %s of VM %d", c.SnapshotName, vmRef.VmId())
+	if c.SnapshotIncludeRAM {
+		params["vmstate"] = 1
+		msg += ", including RAM"
+	}
+	ui.Say(msg)
+	exitStatus, err := client.PostWithTask(params, fmt.Sprintf("/nodes/%s/qemu/%d/snapshot", vmRef.Node(), vmRef.VmId()))
+	if err != nil {
+		err := fmt.Errorf("Error creating snapshot %s: %s: %s", c.SnapshotName, err, exitStatus)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("artifact_snapshot", c.SnapshotName)
+
+	return multistep.ActionContinue
+}
+
+func (s *stepCreateSnapshot) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,122 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type snapshotCreatorMock struct {
+	err       error
+	url       string
+	params    map[string]interface{}
+	deleteURL string
+}
+
+func (m *snapshotCreatorMock) PostWithTask(params map[string]interface{}, url string) (string, error) {
+	m.url = url
+	m.params = params
+	return "", m.err
+}
+
+func (m *snapshotCreatorMock) DeleteWithTask(url string) (string, error) {
+	m.deleteURL = url
+	return "", nil
+}
+
+var _ snapshotCreator = &snapshotCreatorMock{}
+
+func TestCreateSnapshot(t *testing.T) {
+	cs := []struct {
+		name             string
+		config           *Config
+		err              error
+		expectedAction   multistep.StepAction
+		replace          bool
+		expectedParams   map[string]interface{}
+		expectedDelete   string
+		expectedSnapshot string
+	}{
+		{
+			name:           "no snapshot name does nothing",
+			config:         &Config{},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:             "snapshot",
+			config:           &Config{SnapshotName: "build-1"},
+			expectedAction:   multistep.ActionContinue,
+			expectedParams:   map[string]interface{}{"snapname": "build-1"},
+			expectedSnapshot: "build-1",
+		},
+		{
+			name:             "snapshot including RAM",
+			config:           &Config{SnapshotName: "build-1", SnapshotIncludeRAM: true},
+			expectedAction:   multistep.ActionContinue,
+			expectedParams:   map[string]interface{}{"snapname": "build-1", "vmstate": 1},
+			expectedSnapshot: "build-1",
+		},
+		{
+			name:             "forced snapshot replaces the existing one",
+			config:           &Config{SnapshotName: "build-1"},
+			replace:          true,
+			expectedAction:   multistep.ActionContinue,
+			expectedParams:   map[string]interface{}{"snapname": "build-1"},
+			expectedDelete:   "/nodes/pve/qemu/100/snapshot/build-1",
+			expectedSnapshot: "build-1",
+		},
+		{
+			name:           "failing snapshot should halt",
+			config:         &Config{SnapshotName: "build-1"},
+			err:            fmt.Errorf("snapshot feature is not available"),
+			expectedAction: multistep.ActionHalt,
+			expectedParams: map[string]interface{}{"snapname": "build-1"},
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			client := &snapshotCreatorMock{err: c.err}
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", c.config)
+			state.Put("proxmoxClient", client)
+			state.Put("vmRef", vmRef)
+			if c.replace {
+				state.Put("snapshot_replace", true)
+			}
+
+			step := &stepCreateSnapshot{}
+			action := step.Run(context.TODO(), state)
+			if action != c.expectedAction {
+				t.Fatalf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if c.expectedParams != nil {
+				if client.url != "/nodes/pve/qemu/100/snapshot" {
+					t.Errorf("Unexpected url %s", client.url)
+				}
+				if !reflect.DeepEqual(client.params, c.expectedParams) {
+					t.Errorf("Expected params %v, got %v", c.expectedParams, client.params)
+				}
+			}
+			if client.deleteURL != c.expectedDelete {
+				t.Errorf("Expected delete of %q, got %q", c.expectedDelete, client.deleteURL)
+			}
+			snapshot, _ := state.Get("artifact_snapshot").(string)
+			if snapshot != c.expectedSnapshot {
+				t.Errorf("Expected artifact_snapshot to be %q, got %q", c.expectedSnapshot, snapshot)
+			}
+		})
+	}
+}
@@ -6,10 +6,15 @@ package proxmox
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/go-getter/v2"
@@ -23,13 +28,28 @@ type stepDownloadISOOnPVE struct {
 	ISO *ISOsConfig
 }
 
+type isoDownloader interface {
+	CreateItemReturnStatus(params map[string]interface{}, url string) (exitStatus string, err error)
+	GetItemList(url string) (list map[string]interface{}, err error)
+	GetItemListInterfaceArray(url string) ([]interface{}, error)
+	DeleteVolume(vmr *proxmox.VmRef, storageName string, volumeName string) (exitStatus interface{}, err error)
+	UploadLargeFile(node string, storage string, contentType string, filename string, filesize int64, file io.Reader) error
+}
+
+var _ isoDownloader = &proxmox.Client{}
+
+// downloadTaskPollInterval is the time between two checks of the download task
+var downloadTaskPollInterval = 2 * time.Second
+
 func (s *stepDownloadISOOnPVE) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
-	var isoStoragePath string
-	isoStoragePath, err := DownloadISOOnPVE(state, s.ISO.ISOUrls, s.ISO.ISOChecksum, s.ISO.ISOStoragePool)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	isoStoragePath, err := downloadISOOnPVE(ctx, state, s.ISO)
 
 	// Abort if no ISO can be downloaded
 	if err != nil {
 		state.Put("error", err)
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 	// If available, set the file path to the downloaded iso file on the node
@@ -45,55 +65,214 @@ func (s *stepDownloadISOOnPVE) Run(ctx context.Context, state multistep.StateBag
 //
 // Returns: When successful, the path to the iso on the node, else an empty string.
 func DownloadISOOnPVE(state multistep.StateBag, ISOUrls []string, ISOChecksum string, ISOStoragePool string) (string, error) {
+	iso := &ISOsConfig{
+		ISOStoragePool: ISOStoragePool,
+		ISOOverwrite:   "replace",
+	}
+	iso.ISOUrls = ISOUrls
+	iso.ISOChecksum = ISOChecksum
+	return downloadISOOnPVE(context.TODO(), state, iso)
+}
+
+// downloadISOOnPVE tries the URLs of the ISO one after another until the PVE
+// node managed to download one of them, and returns its path on the node.
+func downloadISOOnPVE(ctx context.Context, state multistep.StateBag, iso *ISOsConfig) (string, error) {
 	ui := state.Get("ui").(packersdk.Ui)
-	client := state.Get("proxmoxClient").(*proxmox.Client)
+	client := state.Get("proxmoxClient").(isoDownloader)
 	c := state.Get("config").(*Config)
 
-	// Generate ISOConfig configuration attributes in the format defined for packer-plugin-sdk
-	// and use go-getter to generate parameters compatible with the Proxmox-API.
-	var isoConfig proxmox.ConfigContent_Iso
-	for _, url := range ISOUrls {
-		var checksum string
-		var checksumType string
-		if ISOChecksum != "none" {
-			gr := &getter.Request{
-				Src: url + "?checksum=" + ISOChecksum,
-			}
-			gc := getter.Client{}
-			fileChecksum, err := gc.GetChecksum(context.TODO(), gr)
-			if err != nil {
-				state.Put("error", err)
-				ui.Say(err.Error())
-				continue
-			}
-			checksum = hex.EncodeToString(fileChecksum.Value)
-			checksumType = fileChecksum.Type
+	var errs *packersdk.MultiError
+	for _, isoURL := range iso.ISOUrls {
+		// Generate ISOConfig configuration attributes in the format defined for packer-plugin-sdk
+		// and use go-getter to generate parameters compatible with the Proxmox-API.
+		// go-getter also resolves checksum files (file:...), picking the entry
+		// matching the file name of the URL.
+		fileChecksum, err := resolveISOChecksum(ctx, isoURL, iso.ISOChecksum)
+		if err != nil {
+			err = fmt.Errorf("error reading checksum for %s: %s", isoURL, err)
+			ui.Error(err.Error())
+			errs = packersdk.MultiErrorAppend(errs, err)
+			continue
+		}
+
+		filename := pveDownloadFilename(iso, isoURL)
+		isoStoragePath := fmt.Sprintf("%s:iso/%s", iso.ISOStoragePool, filename)
+
+		reuse, err := reuseExistingPVEISO(ctx, client, c.Node, iso, isoURL, filename, fileChecksum, ui)
+		if err != nil {
+			return "", err
+		}
+		if reuse {
+			return isoStoragePath, nil
 		}
 
-		isoConfig = proxmox.ConfigContent_Iso{
-			Node:              c.Node,
-			Storage:           ISOStoragePool,
-			DownloadUrl:       url,
-			Filename:          path.Base(url),
-			ChecksumAlgorithm: checksumType,
-			Checksum:          checksum,
+		params := map[string]interface{}{
+			"content":  "iso",
+			"filename": filename,
+			"url":      isoURL,
+		}
+		if fileChecksum != nil {
+			params["checksum"] = hex.EncodeToString(fileChecksum.Value)
+			params["checksum-algorithm"] = fileChecksum.Type
+		}
+		if iso.DecompressionAlgorithm != "" {
+			params["compression"] = iso.DecompressionAlgorithm
 		}
 
-		log.Printf("[INFO] - beginning download of %s to node %s", isoConfig.DownloadUrl, isoConfig.Node)
-		err := proxmox.DownloadIsoFromUrl(client, isoConfig)
-		// On error continues with the next URL and logs the error
+		ui.Say(fmt.Sprintf("Downloading %s to %s on node %s", isoURL, isoStoragePath, c.Node))
+		err = runPVEDownloadTask(ctx, client, c.Node, iso.ISOStoragePool, params, ui)
 		if err != nil {
-			log.Printf("[ERROR] - failed to download iso from %s: %s", isoConfig.DownloadUrl, err)
+			err = fmt.Errorf("failed to download ISO from %s: %s", isoURL, err)
+			ui.Error(err.Error())
+			errs = packersdk.MultiErrorAppend(errs, err)
 			continue
 		}
-		isoStoragePath := fmt.Sprintf("%s:iso/%s", isoConfig.Storage, isoConfig.Filename)
 		log.Printf("[INFO] - finished downloading %s", isoStoragePath)
+		// The node verified the download against the checksum
+		if err := recordISOChecksum(client, c.Node, iso.ISOStoragePool, filename, fileChecksum); err != nil {
+			ui.Error(fmt.Sprintf("Error recording checksum of %s, it won't be reused by later builds: %s", isoStoragePath, err))
+		}
 		// Returns the path to the iso on the node
 		return isoStoragePath, nil
 	}
 
 	// Returns an empty string, which means download was not successful.
-	return "", fmt.Errorf("failed to download ISO with all the provided URLs, attempted: %s", strings.Join(ISOUrls, ", "))
+	return "", fmt.Errorf("failed to download ISO with all the provided URLs, attempted: %s: %s", strings.Join(iso.ISOUrls, ", "), errs)
+}
+
+// pveDownloadFilename returns the name of the file the ISO is stored as on the node.
+func pveDownloadFilename(iso *ISOsConfig, isoURL string) string {
+	if iso.ISOTargetFilename != "" {
+		return iso.ISOTargetFilename
+	}
+	filename := isoURL
+	if u, err := url.Parse(isoURL); err == nil {
+		filename = u.Path
+	}
+	filename = path.Base(filename)
+	if iso.DecompressionAlgorithm != "" {
+		// The file is decompressed by the node, don't keep the extension of the archive
+		filename = strings.TrimSuffix(filename, "."+iso.DecompressionAlgorithm)
+	}
+	return filename
+}
+
+// reuseExistingPVEISO checks whether the ISO is already present on the storage pool.
+// A file with the same name is considered identical when a previous build recorded
+// the same checksum for it, and its size matches the size reported by the server
+// hosting the ISO. Files that aren't identical are downloaded again, unless
+// iso_overwrite is set to fail.
+func reuseExistingPVEISO(ctx context.Context, client isoDownloader, node string, iso *ISOsConfig, isoURL string, filename string, checksum *getter.FileChecksum, ui packersdk.Ui) (bool, error) {
+	isoStoragePath := fmt.Sprintf("%s:iso/%s", iso.ISOStoragePool, filename)
+	existingSize, found, err := getStorageVolumeSize(client, node, iso.ISOStoragePool, "iso", isoStoragePath)
+	if err != nil {
+		return false, fmt.Errorf("error listing content of storage %s: %s", iso.ISOStoragePool, err)
+	}
+	if !found {
+		return false, nil
+	}
+
+	if iso.ISOOverwrite != "always" {
+		identical := false
+		if checksum != nil {
+			identical, err = hasISOChecksum(client, node, iso.ISOStoragePool, filename, checksum)
+			if err != nil {
+				return false, fmt.Errorf("error listing content of storage %s: %s", iso.ISOStoragePool, err)
+			}
+		}
+		// Compressed downloads can't be compared by size, the size of the
+		// decompressed file isn't known before the node downloaded it
+		if identical && iso.DecompressionAlgorithm == "" {
+			if size, err := getRemoteFileSize(ctx, isoURL); err != nil {
+				log.Printf("[INFO] - can't compare the size of %s with %s: %s", isoStoragePath, isoURL, err)
+			} else if size != existingSize {
+				identical = false
+			}
+		}
+		if identical {
+			ui.Message(fmt.Sprintf("ISO already present at %s with matching checksum, skipping download", isoStoragePath))
+			return true, nil
+		}
+		if iso.ISOOverwrite == "fail" {
+			return false, fmt.Errorf("%s already exists and can't be verified to be identical to %s, and iso_overwrite is set to fail", isoStoragePath, isoURL)
+		}
+	}
+
+	// The node downloads to a temporary file and only replaces the existing
+	// one once the download was verified, so a failed download keeps it
+	ui.Say(fmt.Sprintf("%s already exists, replacing it", isoStoragePath))
+	return false, nil
+}
+
+// rxDownloadProgress matches the progress lines of the download-url task log,
+// e.g. `32768K ........ ........ ........ ........ 10% 41.2M 16s`
+var rxDownloadProgress = regexp.MustCompile(`^\s*\d+[KMG]\s[\s.]*\d+%`)
+
+// runPVEDownloadTask starts the download-url task on the node and waits for
+// it to finish, passing the task log on to the UI. Progress lines are only
+// logged.
+func runPVEDownloadTask(ctx context.Context, client isoDownloader, node string, storage string, params map[string]interface{}, ui packersdk.Ui) error {
+	resp, err := client.CreateItemReturnStatus(params, fmt.Sprintf("/nodes/%s/storage/%s/download-url", node, storage))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, resp)
+	}
+	var task struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp), &task); err != nil || task.Data == "" {
+		return fmt.Errorf("unexpected response starting download task: %s", resp)
+	}
+	upid := task.Data
+	log.Printf("[INFO] - download task %s started", upid)
+
+	logLine := 0
+	for {
+		// Fetch the status before the log, so no lines are missed once the task stopped
+		status, err := client.GetItemList(fmt.Sprintf("/nodes/%s/tasks/%s/status", node, upid))
+		if err != nil {
+			return fmt.Errorf("error reading status of task %s: %s", upid, err)
+		}
+
+		lines, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/tasks/%s/log?start=%d", node, upid, logLine))
+		if err != nil {
+			log.Printf("[WARN] - error reading log of task %s: %s", upid, err)
+		}
+		for _, line := range lines {
+			entry, ok := line.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			n, ok := entry["n"].(float64)
+			if !ok || int(n) <= logLine {
+				continue
+			}
+			logLine = int(n)
+			text, _ := entry["t"].(string)
+			switch {
+			case text == "" || text == "no content":
+			case rxDownloadProgress.MatchString(text):
+				// Progress is logged every few MB, don't flood the UI with it
+				log.Printf("[INFO] - task %s: %s", upid, text)
+			default:
+				ui.Message(text)
+			}
+		}
+
+		data, _ := status["data"].(map[string]interface{})
+		if data["status"] == "stopped" {
+			exitStatus, _ := data["exitstatus"].(string)
+			if exitStatus != "OK" {
+				return fmt.Errorf("task %s failed: %s", upid, exitStatus)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(downloadTaskPollInterval):
+		}
+	}
 }
 
 func (s *stepDownloadISOOnPVE) Cleanup(state multistep.StateBag) {
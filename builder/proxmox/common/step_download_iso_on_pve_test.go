@@ -0,0 +1,424 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type isoDownloaderMock struct {
+	failURLs       []string
+	taskExitStatus string
+	storageContent []interface{}
+	params         []map[string]interface{}
+	logWasRead     bool
+	deleted        []string
+	uploaded       []string
+}
+
+func (m *isoDownloaderMock) CreateItemReturnStatus(params map[string]interface{}, url string) (string, error) {
+	m.params = append(m.params, params)
+	for _, u := range m.failURLs {
+		if params["url"] == u {
+			return `{"data":null}`, fmt.Errorf("500 Internal Server Error")
+		}
+	}
+	return `{"data":"UPID:pve:00001234:00005678:00000000:download:local:root@pam:"}`, nil
+}
+
+func (m *isoDownloaderMock) GetItemList(url string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"status":     "stopped",
+			"exitstatus": m.taskExitStatus,
+		},
+	}, nil
+}
+
+func (m *isoDownloaderMock) GetItemListInterfaceArray(url string) ([]interface{}, error) {
+	if strings.Contains(url, "/tasks/") {
+		m.logWasRead = true
+		return []interface{}{
+			map[string]interface{}{"n": float64(1), "t": "downloading..."},
+		}, nil
+	}
+	return m.storageContent, nil
+}
+
+func (m *isoDownloaderMock) DeleteVolume(vmr *proxmox.VmRef, storageName string, volumeName string) (interface{}, error) {
+	m.deleted = append(m.deleted, volumeName)
+	return nil, nil
+}
+
+func (m *isoDownloaderMock) UploadLargeFile(node string, storage string, contentType string, filename string, filesize int64, file io.Reader) error {
+	m.uploaded = append(m.uploaded, filename)
+	return nil
+}
+
+var _ isoDownloader = &isoDownloaderMock{}
+
+func TestDownloadISOOnPVE(t *testing.T) {
+	content := []byte("iso content")
+	sum := fmt.Sprintf("%x", sha256.Sum256(content))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			fmt.Fprintf(w, "%s  other.iso\n%s  test.iso\n", strings.Repeat("0", 64), sum)
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(content)
+			}
+		}
+	}))
+	defer srv.Close()
+	downloadTaskPollInterval = 0
+
+	cs := []struct {
+		name            string
+		iso             ISOsConfig
+		failURLs        []string
+		taskExitStatus  string
+		storageContent  []interface{}
+		expectedAction  multistep.StepAction
+		expectedISOPath string
+		expectedParams  map[string]interface{}
+		expectDownloads int
+		expectedUploads []string
+	}{
+		{
+			name: "literal checksum should download",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "sha256:" + sum,
+				},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectedParams: map[string]interface{}{
+				"filename":           "test.iso",
+				"checksum":           sum,
+				"checksum-algorithm": "sha256",
+			},
+			expectDownloads: 1,
+		},
+		{
+			name: "checksum file should be resolved",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "file:" + srv.URL + "/SHA256SUMS",
+				},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectedParams: map[string]interface{}{
+				"checksum":           sum,
+				"checksum-algorithm": "sha256",
+			},
+			expectDownloads: 1,
+		},
+		{
+			name: "decompression should strip the archive extension",
+			iso: ISOsConfig{
+				ISOStoragePool:         "local",
+				ISOOverwrite:           "replace",
+				DecompressionAlgorithm: "xz",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso.xz"},
+					ISOChecksum: "none",
+				},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectedParams: map[string]interface{}{
+				"filename":    "test.iso",
+				"compression": "xz",
+			},
+			expectDownloads: 1,
+		},
+		{
+			name: "custom filename",
+			iso: ISOsConfig{
+				ISOStoragePool:    "local",
+				ISOOverwrite:      "replace",
+				ISOTargetFilename: "custom.iso",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/custom.iso",
+			expectedParams: map[string]interface{}{
+				"filename": "custom.iso",
+			},
+			expectDownloads: 1,
+		},
+		{
+			name: "failing URL should fall back to the next one",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/broken/test.iso", srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			failURLs:        []string{srv.URL + "/broken/test.iso"},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectDownloads: 2,
+		},
+		{
+			name: "failing task should halt",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			taskExitStatus:  "checksum mismatch",
+			expectedAction:  multistep.ActionHalt,
+			expectDownloads: 1,
+		},
+		{
+			name: "existing file with matching checksum should be reused",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "sha256:" + sum,
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(len(content))},
+				map[string]interface{}{"volid": "local:iso/test.iso.sha256-" + sum + ".img", "size": float64(1)},
+			},
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectDownloads: 0,
+		},
+		{
+			name: "existing file without checksum record should be replaced",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "sha256:" + sum,
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(len(content))},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectDownloads: 1,
+			expectedUploads: []string{"test.iso.sha256-" + sum + ".img"},
+		},
+		{
+			name: "existing file should be replaced when iso_checksum is none",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(len(content))},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectDownloads: 1,
+		},
+		{
+			name: "existing different file should be replaced",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(1)},
+			},
+			taskExitStatus:  "OK",
+			expectedAction:  multistep.ActionContinue,
+			expectedISOPath: "local:iso/test.iso",
+			expectDownloads: 1,
+		},
+		{
+			name: "failed replacement of an existing file should halt",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "replace",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "sha256:" + sum,
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(1)},
+			},
+			taskExitStatus:  "checksum mismatch",
+			expectedAction:  multistep.ActionHalt,
+			expectDownloads: 1,
+		},
+		{
+			name: "existing different file with fail policy should halt",
+			iso: ISOsConfig{
+				ISOStoragePool: "local",
+				ISOOverwrite:   "fail",
+				ISOConfig: commonsteps.ISOConfig{
+					ISOUrls:     []string{srv.URL + "/test.iso"},
+					ISOChecksum: "none",
+				},
+			},
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(1)},
+			},
+			expectedAction:  multistep.ActionHalt,
+			expectDownloads: 0,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			m := &isoDownloaderMock{
+				failURLs:       c.failURLs,
+				taskExitStatus: c.taskExitStatus,
+				storageContent: c.storageContent,
+			}
+			iso := c.iso
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", &Config{Node: "pve"})
+			state.Put("proxmoxClient", m)
+
+			step := &stepDownloadISOOnPVE{ISO: &iso}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if _, gotError := state.GetOk("error"); gotError != (c.expectedAction == multistep.ActionHalt) {
+				t.Errorf("Expected error state to be: %v, got: %v", c.expectedAction == multistep.ActionHalt, gotError)
+			}
+			if iso.ISOFile != c.expectedISOPath {
+				t.Errorf("Expected ISO file to be %q, got %q", c.expectedISOPath, iso.ISOFile)
+			}
+			if len(m.params) != c.expectDownloads {
+				t.Fatalf("Expected %d download tasks, got %d", c.expectDownloads, len(m.params))
+			}
+			// Existing ISOs are replaced by the node once the download succeeded
+			for _, volume := range m.deleted {
+				if volume == "local:iso/test.iso" {
+					t.Errorf("Expected the existing ISO not to be deleted, got deletes %v", m.deleted)
+				}
+			}
+			if c.expectedUploads != nil && !reflect.DeepEqual(m.uploaded, c.expectedUploads) {
+				t.Errorf("Expected uploads %v, got %v", c.expectedUploads, m.uploaded)
+			}
+			if c.expectDownloads > 0 && c.taskExitStatus != "" && !m.logWasRead {
+				t.Error("Expected the task log to be read")
+			}
+			for k, v := range c.expectedParams {
+				got := m.params[len(m.params)-1][k]
+				if got != v {
+					t.Errorf("Expected download parameter %s to be %v, got %v", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+// taskLogMock serves the log of a download task that runs for a few polls,
+// ignoring the start offset like a misbehaving API could
+type taskLogMock struct {
+	isoDownloaderMock
+	polls int
+}
+
+func (m *taskLogMock) GetItemList(url string) (map[string]interface{}, error) {
+	m.polls++
+	status := "running"
+	if m.polls >= 3 {
+		status = "stopped"
+	}
+	return map[string]interface{}{
+		"data": map[string]interface{}{"status": status, "exitstatus": "OK"},
+	}, nil
+}
+
+func (m *taskLogMock) GetItemListInterfaceArray(url string) ([]interface{}, error) {
+	lines := []interface{}{
+		map[string]interface{}{"n": float64(1), "t": "downloading https://example.com/test.iso to /var/lib/vz/template/iso/test.iso"},
+		map[string]interface{}{"n": float64(2), "t": "     0K ........ ........ ........ ........  5% 25.5M 23s"},
+		map[string]interface{}{"n": float64(3), "t": " 32768K ........ ........ ........ ........ 10% 41.2M 16s"},
+	}
+	if m.polls >= 3 {
+		lines = append(lines, map[string]interface{}{"n": float64(4), "t": "calculating checksum...OK, checksum verified"})
+	}
+	return lines, nil
+}
+
+func TestRunPVEDownloadTask(t *testing.T) {
+	downloadTaskPollInterval = 0
+	var out bytes.Buffer
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: io.Discard}
+
+	err := runPVEDownloadTask(context.TODO(), &taskLogMock{}, "pve", "local", map[string]interface{}{}, ui)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"downloading https://example.com/test.iso to /var/lib/vz/template/iso/test.iso",
+		"calculating checksum...OK, checksum verified",
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		got = append(got, strings.TrimSpace(line))
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected messages %q, got %q", expected, got)
+	}
+}
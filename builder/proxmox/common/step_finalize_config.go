@@ -7,9 +7,12 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-proxmox/version"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
@@ -36,16 +39,37 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 	c := state.Get("config").(*Config)
 	vmRef := state.Get("vmRef").(*proxmox.VmRef)
 
+	// The description of the build VM is replaced below
+	stopBuildVMHeartbeat(state)
+
 	changes := make(map[string]interface{})
 
-	changes["name"] = c.VMName
-	if c.TemplateName != "" {
-		changes["name"] = c.TemplateName
-	}
+	// An existing VM reused for `snapshot_name` keeps its name and
+	// description, and never got the ISOs of the builder attached
+	reused, _ := state.Get("snapshot_target_reused").(bool)
+
+	if !reused {
+		changes["name"] = c.VMName
+		if c.TemplateName != "" {
+			changes["name"] = c.TemplateName
+		}
 
-	// During build, the description is "Packer ephemeral build VM", so if no description is
-	// set, we need to clear it
-	changes["description"] = c.TemplateDescription
+		// During build, the description describes the build VM, so if no description is
+		// set, we need to clear it
+		notes := []string{}
+		if c.TemplateDescription != "" {
+			notes = append(notes, c.TemplateDescription)
+		}
+		// Record the dependency of linked clones, so the VM they're based on
+		// isn't deleted unknowingly
+		if parent, ok := state.GetOk("linked_clone_parent"); ok {
+			notes = append(notes, fmt.Sprintf("Linked clone of VM %d", parent.(int)))
+		}
+		if c.NotesMetadata {
+			notes = append(notes, buildNotesMetadata(state, c).String())
+		}
+		changes["description"] = strings.Join(notes, "\n\n")
+	}
 
 	vmParams, err := client.GetVmConfig(vmRef)
 	if err != nil {
@@ -64,25 +88,9 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 			}
 		}
 		if cloudInitStoragePool != "" {
-			var diskControllers []string
-			switch c.CloudInitDiskType {
-			// Proxmox supports up to 6 SATA controllers (0 - 5)
-			case "sata":
-				for i := 0; i < 6; i++ {
-					sataController := fmt.Sprintf("sata%d", i)
-					diskControllers = append(diskControllers, sataController)
-				}
-			// and up to 31 SCSI controllers (0 - 30)
-			case "scsi":
-				for i := 0; i < 31; i++ {
-					scsiController := fmt.Sprintf("scsi%d", i)
-					diskControllers = append(diskControllers, scsiController)
-				}
-			// Unspecified disk type defaults to "ide"
-			case "ide":
-				diskControllers = []string{"ide0", "ide1", "ide2", "ide3"}
-			default:
-				state.Put("error", fmt.Errorf("unsupported disk type %q", c.CloudInitDiskType))
+			diskControllers, err := cloudInitControllers(c.CloudInitDiskType)
+			if err != nil {
+				state.Put("error", err)
 				return multistep.ActionHalt
 			}
 			cloudInitAttached := false
@@ -134,7 +142,7 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 	}
 
 	deleteItems := []string{}
-	if len(c.ISOs) > 0 {
+	if len(c.ISOs) > 0 && !reused {
 		for idx := range c.ISOs {
 			cdrom := c.ISOs[idx].AssignedDeviceIndex
 			if c.ISOs[idx].Unmount {
@@ -164,11 +172,38 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 		}
 	}
 
+	overrides, overrideDeletes := templateOverrideChanges(c.TemplateOverrides, vmParams)
+	for k, v := range overrides {
+		changes[k] = v
+	}
+	deleteItems = append(deleteItems, overrideDeletes...)
+
+	rawOverrides, rawDeletes := configOverrideChanges(c.TemplateConfigOverrides)
+	for k, v := range rawOverrides {
+		changes[k] = v
+	}
+	deleteItems = append(deleteItems, rawDeletes...)
+
+	// The artifact isn't a build VM anymore, don't leave it for the orphan cleanup
+	if hasTag(vmParams, buildVMTag) && c.TemplateOverrides.Tags == "" {
+		tags, _ := vmParams["tags"].(string)
+		if remaining := withoutTag(splitTags(tags), buildVMTag); len(remaining) > 0 {
+			changes["tags"] = strings.Join(remaining, ";")
+		} else {
+			deleteItems = append(deleteItems, "tags")
+		}
+	}
+
 	changes["delete"] = strings.Join(deleteItems, ",")
 
+	// VMs stopped by earlier steps (e.g. generalize) are left stopped, unless
+	// they were only stopped to move their disks
+	stopped, _ := state.Get("vm_stopped").(bool)
+	stoppedForMove, _ := state.Get("vm_stopped_for_move").(bool)
+
 	if len(changes) > 0 {
 		// Adding a Cloud-Init drive or removing CD-ROM devices won't take effect without a power off and on of the QEMU VM
-		if c.SkipConvertToTemplate {
+		if c.SkipConvertToTemplate && !stopped {
 			ui.Say("Hardware changes pending for VM, stopping VM")
 			_, err := client.ShutdownVm(vmRef)
 			if err != nil {
@@ -188,7 +223,7 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 	}
 
 	// When build artifact is to be a VM, return a running VM
-	if c.SkipConvertToTemplate {
+	if c.SkipConvertToTemplate && (!stopped || stoppedForMove) {
 		ui.Say("Resuming VM")
 		_, err := client.StartVm(vmRef)
 		if err != nil {
@@ -202,4 +237,125 @@ func (s *stepFinalizeConfig) Run(ctx context.Context, state multistep.StateBag)
 	return multistep.ActionContinue
 }
 
+// templateOverrideChanges returns the changes to the VM config applying the
+// `template_overrides`, and the options to delete from it.
+func templateOverrideChanges(o templateOverridesConfig, vmParams map[string]interface{}) (map[string]interface{}, []string) {
+	changes := map[string]interface{}{}
+	var deletes []string
+
+	if o.Cores > 0 {
+		changes["cores"] = o.Cores
+	}
+	if o.Sockets > 0 {
+		changes["sockets"] = o.Sockets
+	}
+	if o.Memory > 0 {
+		changes["memory"] = o.Memory
+	}
+	if o.BalloonMinimum > 0 {
+		changes["balloon"] = o.BalloonMinimum
+	}
+	if o.Onboot != config.TriUnset {
+		changes["onboot"] = boolToInt(o.Onboot.True())
+	}
+	if o.Tags != "" {
+		changes["tags"] = o.Tags
+	}
+	if o.Boot != "" {
+		changes["boot"] = o.Boot
+	}
+	if o.Agent != config.TriUnset {
+		current, _ := vmParams["agent"].(string)
+		changes["agent"] = agentWithEnabled(current, o.Agent.True())
+	}
+
+	if len(o.NICs) > 0 {
+		for idx, nic := range o.NICs {
+			key := fmt.Sprintf("net%d", idx)
+			mac := nic.MACAddress
+			if mac == "" || mac == "repeatable" {
+				// Keep the MAC address of the adapter used during the build
+				current, _ := vmParams[key].(string)
+				_, mac, _ = strings.Cut(strings.SplitN(current, ",", 2)[0], "=")
+			}
+			changes[key] = nicConfigString(nic, mac)
+		}
+		// Adapters beyond the ones of the template are removed
+		rxNet := regexp.MustCompile(`^net(\d+)$`)
+		for key := range vmParams {
+			if m := rxNet.FindStringSubmatch(key); m != nil {
+				if idx, _ := strconv.Atoi(m[1]); idx >= len(o.NICs) {
+					deletes = append(deletes, key)
+				}
+			}
+		}
+	}
+	return changes, deletes
+}
+
+// nicConfigString returns the network adapter in the format of the netN options.
+func nicConfigString(nic NICConfig, mac string) string {
+	model := nic.Model
+	if mac != "" {
+		model += "=" + mac
+	}
+	parts := []string{model, "bridge=" + nic.Bridge}
+	if nic.VLANTag != "" {
+		parts = append(parts, "tag="+nic.VLANTag)
+	}
+	if nic.Firewall {
+		parts = append(parts, "firewall=1")
+	}
+	if nic.MTU > 0 {
+		parts = append(parts, fmt.Sprintf("mtu=%d", nic.MTU))
+	}
+	if nic.PacketQueues > 0 {
+		parts = append(parts, fmt.Sprintf("queues=%d", nic.PacketQueues))
+	}
+	return strings.Join(parts, ",")
+}
+
+// agentWithEnabled returns the agent option enabling or disabling the agent,
+// keeping its other settings.
+func agentWithEnabled(current string, enabled bool) string {
+	parts := []string{fmt.Sprintf("enabled=%d", boolToInt(enabled))}
+	for _, p := range strings.Split(current, ",") {
+		// The first value may omit the enabled= key
+		if !strings.Contains(p, "=") || strings.HasPrefix(p, "enabled=") {
+			continue
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, ",")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// buildNotesMetadata collects the metadata of the build for `notes_metadata`.
+func buildNotesMetadata(state multistep.StateBag, c *Config) *NotesMetadata {
+	m := &NotesMetadata{
+		BuildTime:     time.Now().UTC().Truncate(time.Second),
+		BuildName:     c.PackerBuildName,
+		PackerVersion: c.PackerCoreVersion,
+		PluginVersion: version.PluginVersion.String(),
+		Values:        c.NotesMetadataValues,
+	}
+	for _, iso := range c.ISOs {
+		entry := NotesMetadataISO{File: iso.ISOFile, URLs: iso.ISOUrls}
+		if iso.ISOChecksum != "none" {
+			entry.Checksum = iso.ISOChecksum
+		}
+		m.ISOs = append(m.ISOs, entry)
+	}
+	if vmid, ok := state.Get("clone_source_vmid").(int); ok {
+		m.CloneSourceVMID = vmid
+	}
+	return m
+}
+
 func (s *stepFinalizeConfig) Cleanup(state multistep.StateBag) {}
@@ -56,6 +56,10 @@ func TestTemplateFinalize(t *testing.T) {
 		expectedAction      multistep.StepAction
 		expectedDelete      []string
 		proxmoxVersion      uint8
+		linkedCloneParent   int
+		vmStopped           bool
+		vmStoppedForMove    bool
+		expectStart         bool
 	}{
 		{
 			name:          "empty config changes name and description",
@@ -102,6 +106,59 @@ func TestTemplateFinalize(t *testing.T) {
 			},
 			expectedAction: multistep.ActionContinue,
 		},
+		{
+			name: "linked clones record the VM they're based on",
+			builderConfig: &Config{
+				TemplateName:        "my-template",
+				TemplateDescription: "some-description",
+			},
+			initialVMConfig: map[string]interface{}{
+				"name":        "dummy",
+				"description": "Packer ephemeral build VM",
+			},
+			linkedCloneParent:   9000,
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"name":        "my-template",
+				"description": "some-description\n\nLinked clone of VM 9000",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "VM artifact stopped by earlier steps isn't restarted",
+			builderConfig: &Config{
+				TemplateName:          "my-vm",
+				SkipConvertToTemplate: true,
+			},
+			initialVMConfig: map[string]interface{}{
+				"name": "dummy",
+			},
+			vmStopped:           true,
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"name": "my-vm",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "VM artifact stopped to move its disks is restarted",
+			builderConfig: &Config{
+				TemplateName:          "my-vm",
+				SkipConvertToTemplate: true,
+				FinalStoragePool:      "ceph",
+			},
+			initialVMConfig: map[string]interface{}{
+				"name": "dummy",
+			},
+			vmStopped:           true,
+			vmStoppedForMove:    true,
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"name": "my-vm",
+			},
+			expectedAction: multistep.ActionContinue,
+			expectStart:    true,
+		},
 		{
 			name: "all options",
 			builderConfig: &Config{
@@ -226,11 +283,112 @@ func TestTemplateFinalize(t *testing.T) {
 			expectedDelete:      []string{"unused0", "unused99"},
 			expectedAction:      multistep.ActionContinue,
 		},
+		{
+			name: "template overrides are applied",
+			builderConfig: &Config{
+				TemplateOverrides: templateOverridesConfig{
+					Cores:          2,
+					Sockets:        1,
+					Memory:         2048,
+					BalloonMinimum: 1024,
+					NICs: []NICConfig{
+						{Model: "virtio", Bridge: "vmbr1", VLANTag: "20", Firewall: true},
+					},
+					Onboot: config.TriTrue,
+					Tags:   "debian;prod",
+					Boot:   "order=scsi0;net0",
+					Agent:  config.TriFalse,
+				},
+			},
+			initialVMConfig: map[string]interface{}{
+				"net0":  "virtio=BC:24:11:00:00:01,bridge=vmbr0,tag=10",
+				"net1":  "e1000=BC:24:11:00:00:02,bridge=vmbr0",
+				"agent": "1,fstrim_cloned_disks=1",
+				"tags":  "debian;packer-build",
+			},
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"cores":   uint8(2),
+				"sockets": uint8(1),
+				"memory":  uint32(2048),
+				"balloon": uint32(1024),
+				"net0":    "virtio=BC:24:11:00:00:01,bridge=vmbr1,tag=20,firewall=1",
+				"onboot":  1,
+				"tags":    "debian;prod",
+				"boot":    "order=scsi0;net0",
+				"agent":   "enabled=0,fstrim_cloned_disks=1",
+			},
+			expectedDelete: []string{"net1"},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "template override with MAC address",
+			builderConfig: &Config{
+				TemplateOverrides: templateOverridesConfig{
+					NICs: []NICConfig{
+						{Model: "virtio", Bridge: "vmbr1", MACAddress: "BC:24:11:00:00:09", MTU: 1, PacketQueues: 2},
+					},
+				},
+			},
+			initialVMConfig: map[string]interface{}{
+				"net0": "virtio=BC:24:11:00:00:01,bridge=vmbr0",
+			},
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"net0": "virtio=BC:24:11:00:00:09,bridge=vmbr1,mtu=1,queues=2",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "raw template config overrides are applied",
+			builderConfig: &Config{
+				TemplateConfigOverrides: map[string]string{
+					"cpu":        "x86-64-v2-AES",
+					"hookscript": "",
+				},
+			},
+			initialVMConfig: map[string]interface{}{
+				"hookscript": "local:snippets/build-hook.pl",
+			},
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"cpu": "x86-64-v2-AES",
+			},
+			expectedDelete: []string{"hookscript"},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:          "build VM tag is removed",
+			builderConfig: &Config{},
+			initialVMConfig: map[string]interface{}{
+				"tags": "debian;packer-build",
+			},
+			expectCallSetConfig: true,
+			expectedVMConfig: map[string]interface{}{
+				"tags": "debian",
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:          "tags are deleted with the build VM tag",
+			builderConfig: &Config{},
+			initialVMConfig: map[string]interface{}{
+				"tags": "packer-build",
+			},
+			expectCallSetConfig: true,
+			expectedDelete:      []string{"tags"},
+			expectedAction:      multistep.ActionContinue,
+		},
 	}
 
 	for _, c := range cs {
 		t.Run(c.name, func(t *testing.T) {
+			started := false
 			finalizer := finalizerMock{
+				startVm: func() (string, error) {
+					started = true
+					return "", nil
+				},
 				getConfig: func() (map[string]interface{}, error) {
 					return c.initialVMConfig, c.getConfigErr
 				},
@@ -275,12 +433,24 @@ func TestTemplateFinalize(t *testing.T) {
 			state.Put("config", c.builderConfig)
 			state.Put("vmRef", proxmox.NewVmRef(1))
 			state.Put("proxmoxClient", finalizer)
+			if c.vmStopped {
+				state.Put("vm_stopped", true)
+			}
+			if c.vmStoppedForMove {
+				state.Put("vm_stopped_for_move", true)
+			}
+			if c.linkedCloneParent != 0 {
+				state.Put("linked_clone_parent", c.linkedCloneParent)
+			}
 
 			step := stepFinalizeConfig{}
 			action := step.Run(context.TODO(), state)
 			if action != c.expectedAction {
 				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
 			}
+			if started != c.expectStart {
+				t.Errorf("Expected StartVm to be called: %v, got: %v", c.expectStart, started)
+			}
 		})
 	}
 }
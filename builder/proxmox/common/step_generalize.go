@@ -0,0 +1,153 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepGeneralize removes the identity of the VM (machine-id, SSH host keys,
+// cloud-init state, or sysprep on Windows) before it is turned into a
+// template, and shuts it down.
+//
+// The "vm_stopped" state key is set, so the VM isn't stopped again when
+// converting it to a template.
+type stepGeneralize struct{}
+
+type generalizer interface {
+	GetVmState(*proxmox.VmRef) (map[string]interface{}, error)
+	ShutdownVm(*proxmox.VmRef) (string, error)
+}
+
+var _ generalizer = &proxmox.Client{}
+
+// generalizePollInterval is the time between two checks whether the VM
+// shut down after sysprep
+var generalizePollInterval = 5 * time.Second
+
+// linuxGeneralizeScript resets everything that identifies a Linux VM
+const linuxGeneralizeScript = `set -e
+if command -v cloud-init >/dev/null 2>&1; then cloud-init clean --logs --seed; fi
+truncate -s 0 /etc/machine-id
+if [ -e /var/lib/dbus/machine-id ]; then rm -f /var/lib/dbus/machine-id; ln -s /etc/machine-id /var/lib/dbus/machine-id; fi
+rm -f /etc/ssh/ssh_host_*
+find /var/log -type f -exec truncate -s 0 {} +`
+
+const (
+	windowsSysprep      = `C:\Windows\System32\Sysprep\sysprep.exe /generalize /oobe /shutdown /quiet`
+	windowsUnattendPath = `C:\Windows\Temp\packer-unattend.xml`
+)
+
+func (s *stepGeneralize) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+	client := state.Get("proxmoxClient").(generalizer)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+
+	if !c.Generalize {
+		return multistep.ActionContinue
+	}
+
+	var err error
+	if c.GeneralizeOS == "windows" {
+		err = sysprep(ctx, state, c, client, vmRef)
+	} else {
+		err = generalizeLinux(ctx, state, c, client, vmRef)
+	}
+	if err != nil {
+		err := fmt.Errorf("error generalizing VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("vm_stopped", true)
+	return multistep.ActionContinue
+}
+
+func generalizeLinux(ctx context.Context, state multistep.StateBag, c *Config, client generalizer, vmRef *proxmox.VmRef) error {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	ui.Say("Generalizing VM")
+	command := fmt.Sprintf("sh -c '%s'", linuxGeneralizeScript)
+	if c.Comm.SSHUsername != "root" {
+		command = "sudo -n " + command
+	}
+	exitCode, out, err := runGuestCommand(ctx, state, guestCommandCommunicator, command)
+	if err != nil {
+		return err
+	}
+	log.Printf("generalize script exited with %d: %s", exitCode, out)
+	if exitCode != 0 {
+		return fmt.Errorf("generalize script exited with %d: %s", exitCode, strings.TrimSpace(out))
+	}
+
+	ui.Say("Stopping VM")
+	if _, err := client.ShutdownVm(vmRef); err != nil {
+		return fmt.Errorf("could not stop: %s", err)
+	}
+	return nil
+}
+
+// sysprep runs sysprep, which shuts the VM down once done. The connection
+// of the communicator is lost in the process, so the command isn't waited
+// for, the state of the VM is polled instead.
+func sysprep(ctx context.Context, state multistep.StateBag, c *Config, client generalizer, vmRef *proxmox.VmRef) error {
+	ui := state.Get("ui").(packersdk.Ui)
+	comm, ok := state.Get("communicator").(packersdk.Communicator)
+	if !ok {
+		return fmt.Errorf("no communicator available to run sysprep")
+	}
+
+	command := windowsSysprep
+	if c.GeneralizeUnattendFile != "" {
+		f, err := os.Open(c.GeneralizeUnattendFile)
+		if err != nil {
+			return fmt.Errorf("could not open unattend file: %s", err)
+		}
+		defer f.Close()
+		ui.Say(fmt.Sprintf("Uploading %s to %s", c.GeneralizeUnattendFile, windowsUnattendPath))
+		if err := comm.Upload(windowsUnattendPath, f, nil); err != nil {
+			return fmt.Errorf("could not upload unattend file: %s", err)
+		}
+		command += " /unattend:" + windowsUnattendPath
+	}
+
+	ui.Say("Running sysprep")
+	if err := comm.Start(ctx, &packersdk.RemoteCmd{Command: command}); err != nil {
+		return fmt.Errorf("could not start sysprep: %s", err)
+	}
+
+	ui.Say(fmt.Sprintf("Waiting up to %s for sysprep to shut down the VM", c.GeneralizeTimeout))
+	waitCtx, cancel := context.WithTimeout(ctx, c.GeneralizeTimeout)
+	defer cancel()
+	for {
+		vmState, err := client.GetVmState(vmRef)
+		if err != nil {
+			return fmt.Errorf("error getting VM state: %s", err)
+		}
+		if vmState["status"] == "stopped" {
+			return nil
+		}
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("VM didn't shut down within %s after running sysprep", c.GeneralizeTimeout)
+		case <-time.After(generalizePollInterval):
+		}
+	}
+}
+
+func (s *stepGeneralize) Cleanup(state multistep.StateBag) {}
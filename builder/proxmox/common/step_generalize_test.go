@@ -0,0 +1,174 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type generalizerMock struct {
+	// Number of state checks before the VM reports it stopped
+	runningChecks int
+
+	stateChecks    int
+	shutdownCalled bool
+}
+
+func (m *generalizerMock) GetVmState(*proxmox.VmRef) (map[string]interface{}, error) {
+	m.stateChecks++
+	if m.stateChecks <= m.runningChecks {
+		return map[string]interface{}{"status": "running"}, nil
+	}
+	return map[string]interface{}{"status": "stopped"}, nil
+}
+
+func (m *generalizerMock) ShutdownVm(*proxmox.VmRef) (string, error) {
+	m.shutdownCalled = true
+	return "", nil
+}
+
+var _ generalizer = &generalizerMock{}
+
+func TestGeneralize(t *testing.T) {
+	generalizePollInterval = 0
+
+	unattendFile := filepath.Join(t.TempDir(), "unattend.xml")
+	if err := os.WriteFile(unattendFile, []byte("<unattend/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := []struct {
+		name             string
+		config           *Config
+		exitCode         int
+		runningChecks    int
+		expectedAction   multistep.StepAction
+		expectedCommand  []string
+		expectShutdown   bool
+		expectUpload     bool
+		expectVMStopped  bool
+		expectedErrorMsg string
+	}{
+		{
+			name:           "disabled does nothing",
+			config:         &Config{},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "linux as root",
+			config: &Config{
+				Generalize:   true,
+				GeneralizeOS: "linux",
+				Comm:         communicator.Config{SSH: communicator.SSH{SSHUsername: "root"}},
+			},
+			expectedAction:  multistep.ActionContinue,
+			expectedCommand: []string{"sh -c '", "cloud-init clean --logs --seed", "truncate -s 0 /etc/machine-id", "rm -f /etc/ssh/ssh_host_*"},
+			expectShutdown:  true,
+			expectVMStopped: true,
+		},
+		{
+			name: "linux with sudo",
+			config: &Config{
+				Generalize:   true,
+				GeneralizeOS: "linux",
+				Comm:         communicator.Config{SSH: communicator.SSH{SSHUsername: "ubuntu"}},
+			},
+			expectedAction:  multistep.ActionContinue,
+			expectedCommand: []string{"sudo -n sh -c '"},
+			expectShutdown:  true,
+			expectVMStopped: true,
+		},
+		{
+			name: "failing linux script should halt",
+			config: &Config{
+				Generalize:   true,
+				GeneralizeOS: "linux",
+			},
+			exitCode:         1,
+			expectedAction:   multistep.ActionHalt,
+			expectedErrorMsg: "generalize script exited with 1",
+		},
+		{
+			name: "windows waits for sysprep to shut down",
+			config: &Config{
+				Generalize:             true,
+				GeneralizeOS:           "windows",
+				GeneralizeUnattendFile: unattendFile,
+				GeneralizeTimeout:      time.Minute,
+			},
+			runningChecks:   2,
+			expectedAction:  multistep.ActionContinue,
+			expectedCommand: []string{`sysprep.exe /generalize /oobe /shutdown /quiet /unattend:C:\Windows\Temp\packer-unattend.xml`},
+			expectUpload:    true,
+			expectVMStopped: true,
+		},
+		{
+			name: "windows VM not shutting down should halt",
+			config: &Config{
+				Generalize:        true,
+				GeneralizeOS:      "windows",
+				GeneralizeTimeout: time.Millisecond,
+			},
+			runningChecks:    1 << 30,
+			expectedAction:   multistep.ActionHalt,
+			expectedCommand:  []string{`sysprep.exe /generalize /oobe /shutdown /quiet`},
+			expectedErrorMsg: "VM didn't shut down within 1ms after running sysprep",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			comm := &packersdk.MockCommunicator{StartExitStatus: c.exitCode}
+			client := &generalizerMock{runningChecks: c.runningChecks}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", c.config)
+			state.Put("communicator", comm)
+			state.Put("proxmoxClient", client)
+			state.Put("vmRef", proxmox.NewVmRef(100))
+
+			step := &stepGeneralize{}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Fatalf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			for _, expected := range c.expectedCommand {
+				if !strings.Contains(comm.StartCmd.Command, expected) {
+					t.Errorf("Expected command to contain %q, got %q", expected, comm.StartCmd.Command)
+				}
+			}
+			if client.shutdownCalled != c.expectShutdown {
+				t.Errorf("Expected ShutdownVm to be called: %v, got: %v", c.expectShutdown, client.shutdownCalled)
+			}
+			if comm.UploadCalled != c.expectUpload {
+				t.Errorf("Expected the unattend file to be uploaded: %v, got: %v", c.expectUpload, comm.UploadCalled)
+			}
+			if c.expectUpload && (comm.UploadPath != windowsUnattendPath || comm.UploadData != "<unattend/>") {
+				t.Errorf("Unexpected upload of %q to %s", comm.UploadData, comm.UploadPath)
+			}
+			if stopped, _ := state.Get("vm_stopped").(bool); stopped != c.expectVMStopped {
+				t.Errorf("Expected vm_stopped to be %v, got %v", c.expectVMStopped, stopped)
+			}
+			if c.expectedErrorMsg != "" {
+				err := state.Get("error").(error)
+				if !strings.Contains(err.Error(), c.expectedErrorMsg) {
+					t.Errorf("Expected error to contain %q, got %q", c.expectedErrorMsg, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepGuestTrim runs fstrim in the guest after provisioning, so thin
+// provisioned storage releases the blocks of files deleted during the build.
+// The storage allocated by the disks of the VM is reported before and after.
+type stepGuestTrim struct{}
+
+type guestTrimmer interface {
+	CreateItemReturnStatus(params map[string]interface{}, url string) (string, error)
+	GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error)
+	GetItemListInterfaceArray(url string) ([]interface{}, error)
+}
+
+var _ guestTrimmer = &proxmox.Client{}
+
+func (s *stepGuestTrim) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+	client := state.Get("proxmoxClient").(guestTrimmer)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+
+	if !c.GuestTrim {
+		return multistep.ActionContinue
+	}
+
+	before, err := allocatedStorage(client, vmRef)
+	if err != nil {
+		log.Printf("[WARN] - can't determine allocated storage: %s", err)
+	} else {
+		ui.Say(fmt.Sprintf("Storage allocated by the disks before trimming: %s", formatSize(before)))
+	}
+
+	ui.Say(fmt.Sprintf("Trimming filesystems (using %s)", c.GuestTrimMethod))
+	switch c.GuestTrimMethod {
+	case guestCommandQemuAgent:
+		out, err := client.CreateItemReturnStatus(nil, fmt.Sprintf("/nodes/%s/qemu/%d/agent/fstrim", vmRef.Node(), vmRef.VmId()))
+		if err != nil {
+			err := fmt.Errorf("error trimming filesystems: %s: %s", err, out)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		log.Printf("guest agent fstrim returned: %s", out)
+	default:
+		exitCode, out, err := runGuestCommand(ctx, state, c.GuestTrimMethod, "fstrim -av")
+		if err == nil && exitCode != 0 {
+			err = fmt.Errorf("fstrim exited with %d: %s", exitCode, strings.TrimSpace(out))
+		}
+		if err != nil {
+			err := fmt.Errorf("error trimming filesystems: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Message(strings.TrimSpace(out))
+	}
+
+	after, err := allocatedStorage(client, vmRef)
+	if err != nil {
+		log.Printf("[WARN] - can't determine allocated storage: %s", err)
+		return multistep.ActionContinue
+	}
+	msg := fmt.Sprintf("Storage allocated by the disks after trimming: %s", formatSize(after))
+	if before > after {
+		msg += fmt.Sprintf(" (%s released)", formatSize(before-after))
+	}
+	ui.Say(msg)
+
+	return multistep.ActionContinue
+}
+
+// allocatedStorage returns the number of bytes actually used by the disks
+// of the VM on their storage, as reported by the storage content listing.
+func allocatedStorage(client guestTrimmer, vmRef *proxmox.VmRef) (int64, error) {
+	vmParams, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching config: %s", err)
+	}
+	volumes := map[string]bool{}
+	storages := map[string]bool{}
+	for k, v := range vmParams {
+		value, ok := v.(string)
+		if !ok || !rxStorageDisk.MatchString(k) || strings.Contains(value, "media=cdrom") {
+			continue
+		}
+		volume := strings.SplitN(value, ",", 2)[0]
+		storage, _, found := strings.Cut(volume, ":")
+		if !found {
+			continue
+		}
+		volumes[volume] = true
+		storages[storage] = true
+	}
+
+	var used int64
+	for storage := range storages {
+		content, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/storage/%s/content?vmid=%d", vmRef.Node(), storage, vmRef.VmId()))
+		if err != nil {
+			return 0, fmt.Errorf("error listing content of storage %s: %s", storage, err)
+		}
+		for _, item := range content {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			volid, _ := entry["volid"].(string)
+			if !volumes[volid] {
+				continue
+			}
+			// Storages not tracking the allocation report the full size
+			size, ok := entry["used"].(float64)
+			if !ok {
+				size, _ = entry["size"].(float64)
+			}
+			used += int64(size)
+		}
+	}
+	return used, nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func (s *stepGuestTrim) Cleanup(state multistep.StateBag) {}
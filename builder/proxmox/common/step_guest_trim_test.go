@@ -0,0 +1,150 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type guestTrimmerMock struct {
+	trimErr error
+	// Bytes used by scsi0 before and after trimming
+	used []float64
+
+	trimCalled bool
+	listings   int
+}
+
+func (m *guestTrimmerMock) CreateItemReturnStatus(params map[string]interface{}, url string) (string, error) {
+	if url != "/nodes/pve/qemu/100/agent/fstrim" {
+		return "", fmt.Errorf("unexpected url %s", url)
+	}
+	m.trimCalled = true
+	return `{"data":{"result":{"paths":[{"path":"/","trimmed":1073741824}]}}}`, m.trimErr
+}
+
+func (m *guestTrimmerMock) GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"scsi0": "local-lvm:vm-100-disk-0,discard=on,size=8G",
+		"ide2":  "local:iso/ubuntu.iso,media=cdrom",
+	}, nil
+}
+
+func (m *guestTrimmerMock) GetItemListInterfaceArray(url string) ([]interface{}, error) {
+	if url != "/nodes/pve/storage/local-lvm/content?vmid=100" {
+		return nil, fmt.Errorf("unexpected url %s", url)
+	}
+	used := m.used[min(m.listings, 1)]
+	m.listings++
+	return []interface{}{
+		map[string]interface{}{"volid": "local-lvm:vm-100-disk-0", "size": 8589934592.0, "used": used},
+		map[string]interface{}{"volid": "local-lvm:vm-100-disk-1", "size": 8589934592.0, "used": 1024.0},
+	}, nil
+}
+
+var _ guestTrimmer = &guestTrimmerMock{}
+
+func TestGuestTrim(t *testing.T) {
+	cs := []struct {
+		name           string
+		trim           bool
+		method         string
+		trimErr        error
+		exitCode       int
+		expectedAction multistep.StepAction
+		expectAgent    bool
+		expectComm     bool
+	}{
+		{
+			name:           "disabled does nothing",
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:           "guest agent",
+			trim:           true,
+			method:         guestCommandQemuAgent,
+			expectedAction: multistep.ActionContinue,
+			expectAgent:    true,
+		},
+		{
+			name:           "guest agent error should halt",
+			trim:           true,
+			method:         guestCommandQemuAgent,
+			trimErr:        fmt.Errorf("500 Internal Server Error"),
+			expectedAction: multistep.ActionHalt,
+			expectAgent:    true,
+		},
+		{
+			name:           "communicator",
+			trim:           true,
+			method:         guestCommandCommunicator,
+			expectedAction: multistep.ActionContinue,
+			expectComm:     true,
+		},
+		{
+			name:           "failing fstrim should halt",
+			trim:           true,
+			method:         guestCommandCommunicator,
+			exitCode:       32,
+			expectedAction: multistep.ActionHalt,
+			expectComm:     true,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			comm := &packersdk.MockCommunicator{
+				StartExitStatus: c.exitCode,
+				StartStdout:     "/: 1 GiB (1073741824 bytes) trimmed",
+			}
+			client := &guestTrimmerMock{
+				trimErr: c.trimErr,
+				used:    []float64{4 * 1024 * 1024 * 1024, 3 * 1024 * 1024 * 1024},
+			}
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+
+			var out bytes.Buffer
+			ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: &out}
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", ui)
+			state.Put("config", &Config{GuestTrim: c.trim, GuestTrimMethod: c.method})
+			state.Put("communicator", comm)
+			state.Put("proxmoxClient", client)
+			state.Put("vmRef", vmRef)
+
+			step := &stepGuestTrim{}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if client.trimCalled != c.expectAgent {
+				t.Errorf("Expected the guest agent to be used: %v, got: %v", c.expectAgent, client.trimCalled)
+			}
+			if comm.StartCalled != c.expectComm {
+				t.Errorf("Expected the communicator to be used: %v, got: %v", c.expectComm, comm.StartCalled)
+			}
+			if c.expectComm && comm.StartCmd.Command != "fstrim -av" {
+				t.Errorf("Expected fstrim -av to be run, got %q", comm.StartCmd.Command)
+			}
+			if c.expectedAction == multistep.ActionContinue && c.trim {
+				for _, expected := range []string{"before trimming: 4.0 GiB", "after trimming: 3.0 GiB (1.0 GiB released)"} {
+					if !strings.Contains(out.String(), expected) {
+						t.Errorf("Expected output to contain %q, got %q", expected, out.String())
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepMoveDisks moves all disks of the VM to `final_storage_pool` before it
+// is converted to a template, converting them to their `final_format`.
+//
+// The VM is stopped first, as not all disks (e.g. TPM state) can be moved
+// while it's running. The "vm_stopped" state key is set so the VM isn't
+// stopped again when converting it to a template, and "vm_stopped_for_move"
+// so stepFinalizeConfig starts a VM artifact again.
+type stepMoveDisks struct{}
+
+type diskMover interface {
+	GetVmState(*proxmox.VmRef) (map[string]interface{}, error)
+	ShutdownVm(*proxmox.VmRef) (string, error)
+	GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error)
+	PostWithTask(map[string]interface{}, string) (string, error)
+}
+
+var _ diskMover = &proxmox.Client{}
+
+// Disks of a VM stored on a storage, excluding unused disks
+var rxStorageDisk = regexp.MustCompile(`^(ide|sata|scsi|virtio|efidisk|tpmstate)\d+$`)
+
+func (s *stepMoveDisks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(diskMover)
+	c := state.Get("config").(*Config)
+	vmRef := state.Get("vmRef").(*proxmox.VmRef)
+
+	if c.FinalStoragePool == "" {
+		return multistep.ActionContinue
+	}
+
+	halt := func(err error) multistep.StepAction {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		return halt(fmt.Errorf("error getting VM state: %s", err))
+	}
+	if vmState["status"] == "running" {
+		ui.Say("Stopping VM to move its disks")
+		if _, err := client.ShutdownVm(vmRef); err != nil {
+			return halt(fmt.Errorf("error stopping VM: %s", err))
+		}
+		// A VM artifact is started again once it's finalized
+		state.Put("vm_stopped_for_move", true)
+	}
+	state.Put("vm_stopped", true)
+
+	vmParams, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return halt(fmt.Errorf("error fetching config: %s", err))
+	}
+
+	finalFormats := map[string]string{}
+	for _, disk := range c.Disks {
+		if disk.AssignedDeviceIndex != "" && disk.FinalFormat != "" {
+			finalFormats[disk.AssignedDeviceIndex] = disk.FinalFormat
+		}
+	}
+
+	var slots []string
+	for k, v := range vmParams {
+		value, ok := v.(string)
+		if ok && rxStorageDisk.MatchString(k) && !strings.Contains(value, "media=cdrom") {
+			slots = append(slots, k)
+		}
+	}
+	sort.Strings(slots)
+
+	var moved []string
+	for _, slot := range slots {
+		volume := strings.SplitN(vmParams[slot].(string), ",", 2)[0]
+		storage, _, _ := strings.Cut(volume, ":")
+		format := finalFormats[slot]
+		if storage == c.FinalStoragePool && (format == "" || format == volumeFormat(volume)) {
+			log.Printf("%s is already on %s, not moving it", slot, storage)
+			continue
+		}
+
+		params := map[string]interface{}{
+			"disk":    slot,
+			"storage": c.FinalStoragePool,
+			"delete":  1,
+		}
+		msg := fmt.Sprintf("Moving %s (%s) to %s", slot, volume, c.FinalStoragePool)
+		if format != "" {
+			params["format"] = format
+			msg += " as " + format
+		}
+		ui.Say(msg)
+		exitStatus, err := client.PostWithTask(params, fmt.Sprintf("/nodes/%s/qemu/%d/move_disk", vmRef.Node(), vmRef.VmId()))
+		if err != nil {
+			return halt(fmt.Errorf("error moving %s to %s: %s: %s", slot, c.FinalStoragePool, err, exitStatus))
+		}
+		moved = append(moved, volume)
+	}
+
+	if len(moved) == 0 {
+		return multistep.ActionContinue
+	}
+
+	// With delete set, the source volumes are removed once the disk has been
+	// copied. Make sure none of them were left behind as unused disks.
+	vmParams, err = client.GetVmConfig(vmRef)
+	if err != nil {
+		return halt(fmt.Errorf("error fetching config: %s", err))
+	}
+	var leftovers []string
+	for k, v := range vmParams {
+		value, ok := v.(string)
+		if !ok || !strings.HasPrefix(k, "unused") {
+			continue
+		}
+		for _, volume := range moved {
+			if strings.SplitN(value, ",", 2)[0] == volume {
+				leftovers = append(leftovers, fmt.Sprintf("%s (%s)", k, volume))
+			}
+		}
+	}
+	if len(leftovers) > 0 {
+		sort.Strings(leftovers)
+		return halt(fmt.Errorf("source volumes of moved disks were not removed: %s", strings.Join(leftovers, ", ")))
+	}
+
+	return multistep.ActionContinue
+}
+
+// volumeFormat returns the format of a volume, based on the extension of
+// volumes on file based storage. Other volumes are raw.
+func volumeFormat(volume string) string {
+	switch ext := strings.TrimPrefix(path.Ext(volume), "."); ext {
+	case "qcow2", "vmdk", "raw":
+		return ext
+	default:
+		return "raw"
+	}
+}
+
+func (s *stepMoveDisks) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,190 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type diskMoverMock struct {
+	status   string
+	vmConfig map[string]interface{}
+	// Don't remove the source volume of moved disks
+	keepSource bool
+
+	shutdownCalled bool
+	moves          []map[string]interface{}
+}
+
+func (m *diskMoverMock) GetVmState(*proxmox.VmRef) (map[string]interface{}, error) {
+	return map[string]interface{}{"status": m.status}, nil
+}
+
+func (m *diskMoverMock) ShutdownVm(*proxmox.VmRef) (string, error) {
+	m.shutdownCalled = true
+	m.status = "stopped"
+	return "", nil
+}
+
+func (m *diskMoverMock) GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error) {
+	vmConfig := map[string]interface{}{}
+	for k, v := range m.vmConfig {
+		vmConfig[k] = v
+	}
+	return vmConfig, nil
+}
+
+func (m *diskMoverMock) PostWithTask(params map[string]interface{}, url string) (string, error) {
+	if url != "/nodes/pve/qemu/100/move_disk" {
+		return "", fmt.Errorf("unexpected url %s", url)
+	}
+	m.moves = append(m.moves, params)
+	slot := params["disk"].(string)
+	volume := strings.SplitN(m.vmConfig[slot].(string), ",", 2)[0]
+	m.vmConfig[slot] = fmt.Sprintf("%s:vm-100-%s,size=8G", params["storage"], slot)
+	if m.keepSource {
+		m.vmConfig["unused0"] = volume
+	}
+	return "OK", nil
+}
+
+var _ diskMover = &diskMoverMock{}
+
+func TestMoveDisks(t *testing.T) {
+	cs := []struct {
+		name             string
+		config           *Config
+		status           string
+		vmConfig         map[string]interface{}
+		keepSource       bool
+		expectedAction   multistep.StepAction
+		expectShutdown   bool
+		expectVMStopped  bool
+		expectResume     bool
+		expectedMoves    []map[string]interface{}
+		expectedErrorMsg string
+	}{
+		{
+			name:           "no final storage pool does nothing",
+			config:         &Config{},
+			status:         "running",
+			vmConfig:       map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=8G"},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "all disks are moved",
+			config: &Config{
+				FinalStoragePool: "ceph",
+				Disks: []diskConfig{
+					{AssignedDeviceIndex: "scsi0", FinalFormat: "raw"},
+					{AssignedDeviceIndex: "virtio0"},
+				},
+			},
+			status: "running",
+			vmConfig: map[string]interface{}{
+				"scsi0":     "local-lvm:vm-100-disk-0,size=8G",
+				"virtio0":   "local-lvm:vm-100-disk-1,size=8G",
+				"efidisk0":  "local-lvm:vm-100-disk-2,efitype=4m,size=4M",
+				"tpmstate0": "local-lvm:vm-100-disk-3,size=4M,version=v2.0",
+				"ide2":      "local:iso/ubuntu.iso,media=cdrom",
+				"unused0":   "local-lvm:vm-100-disk-4",
+			},
+			expectedAction:  multistep.ActionContinue,
+			expectShutdown:  true,
+			expectVMStopped: true,
+			expectResume:    true,
+			expectedMoves: []map[string]interface{}{
+				{"disk": "efidisk0", "storage": "ceph", "delete": 1},
+				{"disk": "scsi0", "storage": "ceph", "delete": 1, "format": "raw"},
+				{"disk": "tpmstate0", "storage": "ceph", "delete": 1},
+				{"disk": "virtio0", "storage": "ceph", "delete": 1},
+			},
+		},
+		{
+			name: "disks already in place with the right format are skipped",
+			config: &Config{
+				FinalStoragePool: "nfs",
+				Disks: []diskConfig{
+					{AssignedDeviceIndex: "scsi0", FinalFormat: "qcow2"},
+					{AssignedDeviceIndex: "scsi1", FinalFormat: "qcow2"},
+				},
+			},
+			status: "stopped",
+			vmConfig: map[string]interface{}{
+				"scsi0": "nfs:100/vm-100-disk-0.qcow2,size=8G",
+				"scsi1": "nfs:100/vm-100-disk-1.raw,size=8G",
+			},
+			expectedAction:  multistep.ActionContinue,
+			expectVMStopped: true,
+			expectedMoves: []map[string]interface{}{
+				{"disk": "scsi1", "storage": "nfs", "delete": 1, "format": "qcow2"},
+			},
+		},
+		{
+			name:   "leftover source volumes halt",
+			config: &Config{FinalStoragePool: "ceph"},
+			status: "running",
+			vmConfig: map[string]interface{}{
+				"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+			},
+			keepSource:      true,
+			expectedAction:  multistep.ActionHalt,
+			expectShutdown:  true,
+			expectVMStopped: true,
+			expectResume:    true,
+			expectedMoves: []map[string]interface{}{
+				{"disk": "scsi0", "storage": "ceph", "delete": 1},
+			},
+			expectedErrorMsg: "source volumes of moved disks were not removed: unused0 (local-lvm:vm-100-disk-0)",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			vmRef := proxmox.NewVmRef(100)
+			vmRef.SetNode("pve")
+			mock := &diskMoverMock{status: c.status, vmConfig: c.vmConfig, keepSource: c.keepSource}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", c.config)
+			state.Put("vmRef", vmRef)
+			state.Put("proxmoxClient", mock)
+
+			step := stepMoveDisks{}
+			action := step.Run(context.TODO(), state)
+			if action != c.expectedAction {
+				t.Fatalf("Expected action %s, got %s", c.expectedAction, action)
+			}
+			if mock.shutdownCalled != c.expectShutdown {
+				t.Errorf("Expected ShutdownVm to be called: %v, got: %v", c.expectShutdown, mock.shutdownCalled)
+			}
+			if stopped, _ := state.Get("vm_stopped").(bool); stopped != c.expectVMStopped {
+				t.Errorf("Expected vm_stopped to be %v, got %v", c.expectVMStopped, stopped)
+			}
+			if resume, _ := state.Get("vm_stopped_for_move").(bool); resume != c.expectResume {
+				t.Errorf("Expected vm_stopped_for_move to be %v, got %v", c.expectResume, resume)
+			}
+			if len(mock.moves) != 0 || len(c.expectedMoves) != 0 {
+				if !reflect.DeepEqual(mock.moves, c.expectedMoves) {
+					t.Errorf("Expected moves %v, got %v", c.expectedMoves, mock.moves)
+				}
+			}
+			if c.expectedErrorMsg != "" {
+				err := state.Get("error").(error)
+				if err.Error() != c.expectedErrorMsg {
+					t.Errorf("Expected error %q, got %q", c.expectedErrorMsg, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepPrepareISOs runs the steps acquiring each ISO (generating, downloading
+// and uploading it) concurrently, so that slow downloads or uploads of one ISO
+// don't hold up the others. Each ISO has its own pipeline of steps, run in
+// order, and at most Concurrency pipelines run at the same time. The first
+// pipeline failing cancels the others.
+//
+// Every pipeline gets its own state, which falls back to the build state for
+// reading, so that steps like commonsteps.StepCreateCD writing to fixed keys
+// don't interfere with each other.
+type stepPrepareISOs struct {
+	Pipelines   [][]multistep.Step
+	Concurrency int
+
+	states []*isoPipelineState
+	ran    [][]multistep.Step
+}
+
+func (s *stepPrepareISOs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if len(s.Pipelines) == 0 {
+		return multistep.ActionContinue
+	}
+
+	limit := s.Concurrency
+	if limit <= 0 || limit > len(s.Pipelines) {
+		limit = len(s.Pipelines)
+	}
+	if len(s.Pipelines) > 1 {
+		ui.Say(fmt.Sprintf("Preparing %d ISOs, %d at a time", len(s.Pipelines), limit))
+	}
+
+	s.states = make([]*isoPipelineState, len(s.Pipelines))
+	s.ran = make([][]multistep.Step, len(s.Pipelines))
+	errs := make([]error, len(s.Pipelines))
+
+	// The build fails as soon as one ISO can't be prepared, stop the others
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for idx := range s.Pipelines {
+		s.states[idx] = &isoPipelineState{parent: state}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			err := s.acquireAndRun(pctx, sem, idx)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if pctx.Err() != nil && ctx.Err() == nil {
+				// Stopped because another ISO failed, which is reported instead
+				log.Printf("stopped preparing ISO %d: %s", idx, err)
+				return
+			}
+			errs[idx] = err
+			cancel()
+		}(idx)
+	}
+	wg.Wait()
+
+	var merr *packersdk.MultiError
+	for _, err := range errs {
+		if err != nil {
+			merr = packersdk.MultiErrorAppend(merr, err)
+		}
+	}
+	if merr != nil {
+		// The failing steps already reported their errors to the UI
+		state.Put("error", fmt.Errorf("failed to prepare ISOs: %s", merr))
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+// acquireAndRun runs a pipeline once one of the concurrency slots is free.
+func (s *stepPrepareISOs) acquireAndRun(ctx context.Context, sem chan struct{}, idx int) error {
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-sem }()
+	return s.runPipeline(ctx, idx)
+}
+
+// runPipeline runs the steps of a single pipeline until one of them halts.
+func (s *stepPrepareISOs) runPipeline(ctx context.Context, idx int) error {
+	pstate := s.states[idx]
+	for _, step := range s.Pipelines[idx] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.ran[idx] = append(s.ran[idx], step)
+		if action := step.Run(ctx, pstate); action == multistep.ActionHalt {
+			if err, ok := pstate.local.GetOk("error"); ok {
+				return err.(error)
+			}
+			return fmt.Errorf("step %T halted without an error", step)
+		}
+	}
+	return nil
+}
+
+func (s *stepPrepareISOs) Cleanup(state multistep.StateBag) {
+	for idx := range s.ran {
+		for i := len(s.ran[idx]) - 1; i >= 0; i-- {
+			s.ran[idx][i].Cleanup(s.states[idx])
+		}
+	}
+}
+
+// isoPipelineState is the state of a single pipeline of stepPrepareISOs.
+// Values are written to the pipeline itself, and read from the build state
+// if the pipeline didn't set them.
+type isoPipelineState struct {
+	parent multistep.StateBag
+	local  multistep.BasicStateBag
+}
+
+func (s *isoPipelineState) Get(k string) interface{} {
+	v, _ := s.GetOk(k)
+	return v
+}
+
+func (s *isoPipelineState) GetOk(k string) (interface{}, bool) {
+	if v, ok := s.local.GetOk(k); ok {
+		return v, ok
+	}
+	return s.parent.GetOk(k)
+}
+
+func (s *isoPipelineState) Put(k string, v interface{}) {
+	s.local.Put(k, v)
+}
+
+func (s *isoPipelineState) Remove(k string) {
+	s.local.Remove(k)
+}
+
+var _ multistep.StateBag = &isoPipelineState{}
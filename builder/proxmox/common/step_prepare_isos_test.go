@@ -0,0 +1,226 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// isoStepMock writes its name to a fixed state key, like
+// commonsteps.StepCreateCD does with cd_path, and checks it can read it back.
+type isoStepMock struct {
+	name    string
+	fail    bool
+	block   bool
+	running *int32
+	maxSeen *int32
+
+	mu        sync.Mutex
+	readBack  string
+	ran       bool
+	cleanedUp bool
+}
+
+func (s *isoStepMock) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.mu.Lock()
+	s.ran = true
+	s.mu.Unlock()
+
+	n := atomic.AddInt32(s.running, 1)
+	defer atomic.AddInt32(s.running, -1)
+	for {
+		m := atomic.LoadInt32(s.maxSeen)
+		if n <= m || atomic.CompareAndSwapInt32(s.maxSeen, m, n) {
+			break
+		}
+	}
+
+	state.Put("cd_path", s.name)
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	s.readBack = state.Get("cd_path").(string)
+	s.mu.Unlock()
+
+	if s.block {
+		// like a download, until it's cancelled
+		<-ctx.Done()
+		state.Put("error", ctx.Err())
+		return multistep.ActionHalt
+	}
+
+	if s.fail {
+		state.Put("error", fmt.Errorf("%s failed", s.name))
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *isoStepMock) Cleanup(state multistep.StateBag) {
+	s.cleanedUp = true
+}
+
+func TestPrepareISOs(t *testing.T) {
+	cs := []struct {
+		name           string
+		pipelines      int
+		stepsPerISO    int
+		concurrency    int
+		failing        map[string]bool
+		blocking       map[string]bool
+		expectedRuns   int
+		expectedMax    int32
+		expectedAction multistep.StepAction
+		expectedErrors []string
+	}{
+		{
+			name:           "no ISOs should continue",
+			pipelines:      0,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:           "all ISOs at the same time",
+			pipelines:      3,
+			stepsPerISO:    2,
+			concurrency:    0,
+			expectedMax:    3,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:           "concurrency limit is respected",
+			pipelines:      4,
+			stepsPerISO:    1,
+			concurrency:    2,
+			expectedMax:    2,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:           "one at a time",
+			pipelines:      3,
+			stepsPerISO:    1,
+			concurrency:    1,
+			expectedMax:    1,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:           "failing ISO stops the others",
+			pipelines:      3,
+			stepsPerISO:    2,
+			concurrency:    0,
+			failing:        map[string]bool{"iso0-step0": true, "iso2-step1": true},
+			expectedMax:    3,
+			expectedAction: multistep.ActionHalt,
+			expectedErrors: []string{"iso0-step0 failed"},
+		},
+		{
+			name:           "failing ISO cancels running ones",
+			pipelines:      2,
+			stepsPerISO:    1,
+			concurrency:    0,
+			failing:        map[string]bool{"iso0-step0": true},
+			blocking:       map[string]bool{"iso1-step0": true},
+			expectedMax:    2,
+			expectedAction: multistep.ActionHalt,
+			expectedErrors: []string{"iso0-step0 failed"},
+		},
+		{
+			name:           "waiting ISOs don't start after a failure",
+			pipelines:      3,
+			stepsPerISO:    1,
+			concurrency:    1,
+			failing:        map[string]bool{"iso0-step0": true, "iso1-step0": true, "iso2-step0": true},
+			expectedMax:    1,
+			expectedAction: multistep.ActionHalt,
+			expectedErrors: []string{"step0 failed"},
+			expectedRuns:   1,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			var running, maxSeen int32
+			var steps []*isoStepMock
+			var pipelines [][]multistep.Step
+			for i := 0; i < c.pipelines; i++ {
+				var pipeline []multistep.Step
+				for j := 0; j < c.stepsPerISO; j++ {
+					name := fmt.Sprintf("iso%d-step%d", i, j)
+					step := &isoStepMock{name: name, fail: c.failing[name], block: c.blocking[name], running: &running, maxSeen: &maxSeen}
+					steps = append(steps, step)
+					pipeline = append(pipeline, step)
+				}
+				pipelines = append(pipelines, pipeline)
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+
+			step := &stepPrepareISOs{Pipelines: pipelines, Concurrency: c.concurrency}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if maxSeen != c.expectedMax {
+				t.Errorf("Expected at most %d pipelines to run at once, got %d", c.expectedMax, maxSeen)
+			}
+
+			err, gotError := state.GetOk("error")
+			if gotError != (len(c.expectedErrors) > 0) {
+				t.Errorf("Expected error state to be: %v, got: %v", len(c.expectedErrors) > 0, gotError)
+			}
+			for _, e := range c.expectedErrors {
+				if !strings.Contains(err.(error).Error(), e) {
+					t.Errorf("Expected error to contain %q, got %q", e, err)
+				}
+			}
+			if gotError {
+				if strings.Contains(err.(error).Error(), "context canceled") {
+					t.Errorf("Expected cancelled ISOs not to be reported, got %q", err)
+				}
+			}
+			if _, ok := state.GetOk("cd_path"); ok {
+				t.Error("Expected pipeline state not to leak into the build state")
+			}
+
+			for _, s := range steps {
+				if s.ran && s.readBack != s.name {
+					t.Errorf("Step %s read back state written by %s", s.name, s.readBack)
+				}
+				if s.ran != s.cleanedUp {
+					t.Errorf("Expected step %s to be cleaned up: %v, got: %v", s.name, s.ran, s.cleanedUp)
+				}
+			}
+			if c.expectedRuns > 0 {
+				runs := 0
+				for _, s := range steps {
+					if s.ran {
+						runs++
+					}
+				}
+				if runs != c.expectedRuns {
+					t.Errorf("Expected %d steps to run, got %d", c.expectedRuns, runs)
+				}
+			}
+			// A failing step stops the rest of its own pipeline
+			for name := range c.failing {
+				for _, s := range steps {
+					if strings.HasPrefix(s.name, strings.Split(name, "-")[0]) && s.name > name && s.ran {
+						t.Errorf("Expected step %s not to run after %s failed", s.name, name)
+					}
+				}
+			}
+		})
+	}
+}
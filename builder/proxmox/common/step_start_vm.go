@@ -11,6 +11,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -33,6 +34,7 @@ type vmStarter interface {
 	CheckVmRef(vmr *proxmox.VmRef) (err error)
 	DeleteVm(vmr *proxmox.VmRef) (exitStatus string, err error)
 	GetNextID(int) (int, error)
+	GetResourceList(resourceType string) ([]interface{}, error)
 	GetVmConfig(vmr *proxmox.VmRef) (vmConfig map[string]interface{}, err error)
 	GetVmRefsByName(vmName string) (vmrs []*proxmox.VmRef, err error)
 	SetVmConfig(*proxmox.VmRef, map[string]interface{}) (interface{}, error)
@@ -48,6 +50,29 @@ var (
 // Check if the given builder configuration maps to an existing VM template on the Proxmox cluster.
 // Returns an empty *proxmox.VmRef when no matching ID or name is found.
 func getExistingTemplate(c *Config, client vmStarter) (*proxmox.VmRef, error) {
+	vmRef, err := findExistingVM(c, client)
+	if err != nil || vmRef.VmId() == 0 {
+		return vmRef, err
+	}
+	if c.SkipConvertToTemplate {
+		return vmRef, nil
+	}
+	log.Printf("check if VM %d is a template", vmRef.VmId())
+	vmConfig, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return &proxmox.VmRef{}, err
+	}
+	log.Printf("VM %d template: %d", vmRef.VmId(), vmConfig["template"])
+	if vmConfig["template"] == nil {
+		return &proxmox.VmRef{}, fmt.Errorf("found matching VM (ID: %d, name: %s), but it is not a template", vmRef.VmId(), vmConfig["name"])
+	}
+	return vmRef, nil
+}
+
+// findExistingVM looks up the VM the builder configuration maps to by its
+// ID, or by its name if no ID is given. Returns an empty *proxmox.VmRef
+// when no matching ID or name is found.
+func findExistingVM(c *Config, client vmStarter) (*proxmox.VmRef, error) {
 	vmRef := &proxmox.VmRef{}
 	if c.VMID > 0 {
 		log.Printf("looking up VM with ID %d", c.VMID)
@@ -64,6 +89,13 @@ func getExistingTemplate(c *Config, client vmStarter) (*proxmox.VmRef, error) {
 			return &proxmox.VmRef{}, err
 		}
 		log.Printf("found VM with ID %d", vmRef.VmId())
+		failed, err := isFailedBuildVM(client, vmRef)
+		if err != nil {
+			return &proxmox.VmRef{}, err
+		}
+		if failed {
+			return &proxmox.VmRef{}, fmt.Errorf("VM %d is a failed build kept by keep_vm_on_error, delete it manually", vmRef.VmId())
+		}
 	} else {
 		// Fall back to VMName when TemplateName is not set, matching the
 		// behaviour in stepFinalizeTemplateConfig where VMName is used as
@@ -84,6 +116,23 @@ func getExistingTemplate(c *Config, client vmStarter) (*proxmox.VmRef, error) {
 			}
 			return &proxmox.VmRef{}, err
 		}
+		// Failed builds kept by keep_vm_on_error are left alone
+		candidates := []*proxmox.VmRef{}
+		for _, vmr := range vmRefs {
+			failed, err := isFailedBuildVM(client, vmr)
+			if err != nil {
+				return &proxmox.VmRef{}, err
+			}
+			if failed {
+				log.Printf("skipping VM %d, it is a failed build", vmr.VmId())
+				continue
+			}
+			candidates = append(candidates, vmr)
+		}
+		vmRefs = candidates
+		if len(vmRefs) == 0 {
+			return &proxmox.VmRef{}, nil
+		}
 		if len(vmRefs) > 1 {
 			vmIDs := []int{}
 			for _, vmr := range vmRefs {
@@ -94,18 +143,6 @@ func getExistingTemplate(c *Config, client vmStarter) (*proxmox.VmRef, error) {
 		vmRef = vmRefs[0]
 		log.Printf("found VM with name '%s' (ID: %d)", templateName, vmRef.VmId())
 	}
-	if c.SkipConvertToTemplate {
-		return vmRef, nil
-	}
-	log.Printf("check if VM %d is a template", vmRef.VmId())
-	vmConfig, err := client.GetVmConfig(vmRef)
-	if err != nil {
-		return &proxmox.VmRef{}, err
-	}
-	log.Printf("VM %d template: %d", vmRef.VmId(), vmConfig["template"])
-	if vmConfig["template"] == nil {
-		return &proxmox.VmRef{}, fmt.Errorf("found matching VM (ID: %d, name: %s), but it is not a template", vmRef.VmId(), vmConfig["name"])
-	}
 	return vmRef, nil
 }
 
@@ -131,13 +168,14 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 		}
 	}
 
-	var description = "Packer ephemeral build VM"
+	started := time.Now()
+	description := buildVMDescription(c.PackerBuildName, started, started)
 
 	config := proxmox.ConfigQemu{
 		Name:    c.VMName,
 		Agent:   generateAgentConfig(c.Agent),
 		QemuKVM: &kvm,
-		Tags:    generateTags(c.Tags),
+		Tags:    generateTags(withTag(c.Tags, buildVMTag)),
 		Boot:    c.Boot, // Boot priority, example: "order=virtio0;ide2;net0", virtio0:Disk0 -> ide0:CDROM -> net0:Network
 		CPU: &proxmox.QemuCPU{
 			Cores:   (*proxmox.QemuCpuCores)(&c.Cores),
@@ -166,6 +204,10 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 		Pool:           (*proxmox.PoolName)(&c.Pool),
 	}
 
+	if c.CloudInitDuringBuild {
+		config.CloudInit = c.CloudInitConfig()
+	}
+
 	// 0 disables the ballooning device, which is useful for all VMs
 	// and should be kept enabled by default.
 	// See https://github.com/hashicorp/packer-plugin-proxmox/issues/127#issuecomment-1464030102
@@ -173,7 +215,26 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 		config.Memory.MinimumCapacityMiB = (*proxmox.QemuMemoryBalloonCapacity)(&c.BalloonMinimum)
 	}
 
-	if c.PackerForce {
+	if c.SnapshotName != "" {
+		// The VM getting the snapshots is long-lived, only create it if it
+		// doesn't exist yet, and never delete it
+		vmRef, err := findExistingVM(c, client)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if vmRef.VmId() != 0 {
+			if err := useSnapshotTarget(state, vmRef); err != nil {
+				err := fmt.Errorf("error preparing VM %d for snapshot %s: %s", vmRef.VmId(), c.SnapshotName, err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			return multistep.ActionContinue
+		}
+		ui.Say("No existing VM to snapshot found")
+	} else if c.PackerForce {
 		ui.Say("Force set, checking for existing artifact on PVE cluster")
 		vmRef, err := getExistingTemplate(c, client)
 		if err != nil {
@@ -182,6 +243,19 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 			return multistep.ActionHalt
 		}
 		if vmRef.VmId() != 0 {
+			// Deleting a template would break the VMs cloned from it
+			clones, err := linkedClones(client, vmRef)
+			if err != nil {
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			if len(clones) > 0 {
+				err := fmt.Errorf("existing resource with ID %d still has linked clones (VM IDs %v), refusing to delete it", vmRef.VmId(), clones)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
 			ui.Say(fmt.Sprintf("found existing resource with ID %d on PVE node %s, deleting it", vmRef.VmId(), vmRef.Node()))
 			// If building a VM artifact and c.PackerForce is true,
 			// running VMs can't be deleted. Stop before deleting.
@@ -251,6 +325,8 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 		return multistep.ActionHalt
 	}
 
+	startBuildVMHeartbeat(state, client, vmRef, c.PackerBuildName, started)
+
 	// The EFI disk doesn't get created reliably when using the clone builder,
 	// so let's make sure it's there.
 	if c.EFIConfig != (efiConfig{}) && c.Ctx.BuildType == "proxmox-clone" {
@@ -265,6 +341,15 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 		}
 	}
 
+	if c.CloudInitDuringBuild {
+		err := attachCloudInitDrive(c, client, vmRef, ui)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	// Store the vm id for later
 	state.Put("vmRef", vmRef)
 	// instance_id is the generic term used so that users can have access to the
@@ -273,6 +358,20 @@ func (s *stepStartVM) Run(ctx context.Context, state multistep.StateBag) multist
 	// info available in the vmref type.
 	state.Put("instance_id", vmRef.VmId())
 
+	if len(c.VMConfigOverrides) > 0 {
+		changes, deletes := configOverrideChanges(c.VMConfigOverrides)
+		if len(deletes) > 0 {
+			changes["delete"] = strings.Join(deletes, ",")
+		}
+		ui.Say("Applying vm_config_overrides")
+		if _, err := client.SetVmConfig(vmRef, changes); err != nil {
+			err := fmt.Errorf("error applying vm_config_overrides: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	ui.Say("Starting VM")
 	_, err := client.StartVm(vmRef)
 	if err != nil {
@@ -499,6 +598,7 @@ func generateProxmoxDisks(disks []diskConfig, isos []ISOsConfig, cloneSourceDisk
 						ValueOf(&ideDisks).Elem().
 						FieldByName(fmt.Sprintf("Disk_%d", ideCount)).
 						Set(reflect.ValueOf(&dev))
+					disks[idx].AssignedDeviceIndex = fmt.Sprintf("ide%d", ideCount)
 					ideCount++
 					break
 				}
@@ -534,6 +634,7 @@ func generateProxmoxDisks(disks []diskConfig, isos []ISOsConfig, cloneSourceDisk
 						ValueOf(&scsiDisks).Elem().
 						FieldByName(fmt.Sprintf("Disk_%d", scsiCount)).
 						Set(reflect.ValueOf(&dev))
+					disks[idx].AssignedDeviceIndex = fmt.Sprintf("scsi%d", scsiCount)
 					scsiCount++
 					break
 				}
@@ -567,6 +668,7 @@ func generateProxmoxDisks(disks []diskConfig, isos []ISOsConfig, cloneSourceDisk
 						ValueOf(&sataDisks).Elem().
 						FieldByName(fmt.Sprintf("Disk_%d", sataCount)).
 						Set(reflect.ValueOf(&dev))
+					disks[idx].AssignedDeviceIndex = fmt.Sprintf("sata%d", sataCount)
 					sataCount++
 					break
 				}
@@ -600,6 +702,7 @@ func generateProxmoxDisks(disks []diskConfig, isos []ISOsConfig, cloneSourceDisk
 						ValueOf(&virtIODisks).Elem().
 						FieldByName(fmt.Sprintf("Disk_%d", virtIOCount)).
 						Set(reflect.ValueOf(&dev))
+					disks[idx].AssignedDeviceIndex = fmt.Sprintf("virtio%d", virtIOCount)
 					virtIOCount++
 					break
 				}
@@ -811,14 +914,28 @@ func isDuplicateIDError(err error) bool {
 	return strings.Contains(err.Error(), "already exists")
 }
 
+// isFailedBuildVM returns whether the VM is a failed build kept by keep_vm_on_error.
+func isFailedBuildVM(client vmStarter, vmRef *proxmox.VmRef) (bool, error) {
+	vmConfig, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		return false, err
+	}
+	return hasTag(vmConfig, failedBuildTag), nil
+}
+
 type startedVMCleaner interface {
 	StopVm(*proxmox.VmRef) (string, error)
 	DeleteVm(*proxmox.VmRef) (string, error)
+	GetVmState(*proxmox.VmRef) (map[string]interface{}, error)
+	GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error)
+	SetVmConfig(*proxmox.VmRef, map[string]interface{}) (interface{}, error)
 }
 
 var _ startedVMCleaner = &proxmox.Client{}
 
 func (s *stepStartVM) Cleanup(state multistep.StateBag) {
+	stopBuildVMHeartbeat(state)
+
 	vmRefUntyped, ok := state.GetOk("vmRef")
 	// If not ok, we probably errored out before creating the VM
 	if !ok {
@@ -832,9 +949,22 @@ func (s *stepStartVM) Cleanup(state multistep.StateBag) {
 		return
 	}
 
+	// An existing VM the snapshot is built on is restored, not deleted
+	if reused, _ := state.Get("snapshot_target_reused").(bool); reused {
+		restoreSnapshotTarget(state, vmRef)
+		return
+	}
+
 	client := state.Get("proxmoxClient").(startedVMCleaner)
 	ui := state.Get("ui").(packersdk.Ui)
 
+	if c, ok := state.Get("config").(*Config); ok && c.KeepVMOnError {
+		if buildErr, ok := state.GetOk("error"); ok {
+			keepFailedVM(client, ui, vmRef, c, buildErr.(error))
+			return
+		}
+	}
+
 	// Destroy the server we just created
 	ui.Say("Stopping VM")
 	_, err := client.StopVm(vmRef)
@@ -850,3 +980,60 @@ func (s *stepStartVM) Cleanup(state multistep.StateBag) {
 		return
 	}
 }
+
+// keepFailedVM marks the VM of a failed build, so it can be told apart from
+// the VMs and templates of successful builds, and stops it unless asked not to.
+func keepFailedVM(client startedVMCleaner, ui packersdk.Ui, vmRef *proxmox.VmRef, c *Config, buildErr error) {
+	ui.Say(fmt.Sprintf("Keeping VM %d of the failed build", vmRef.VmId()))
+
+	// Mark it first, the orphan cleanup deletes VMs still tagged as build VM
+	markFailedVM(client, ui, vmRef, c, buildErr)
+
+	vmState, err := client.GetVmState(vmRef)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error getting VM state: %s", err))
+		return
+	}
+	if vmState["status"] == "running" && !c.KeepVMOnErrorRunning {
+		ui.Say("Stopping VM")
+		if _, err := client.StopVm(vmRef); err != nil {
+			ui.Error(fmt.Sprintf("Error stopping VM. Please stop it manually: %s", err))
+		}
+	}
+}
+
+// markFailedVM renames the VM of a failed build and replaces its build tag.
+// The tag is replaced even if the rest of the marking fails.
+func markFailedVM(client startedVMCleaner, ui packersdk.Ui, vmRef *proxmox.VmRef, c *Config, buildErr error) {
+	changes := map[string]interface{}{}
+	tags := c.Tags
+	vmConfig, err := client.GetVmConfig(vmRef)
+	if err != nil {
+		// Fall back to the tags the VM was created with
+		ui.Error(fmt.Sprintf("Error reading VM config: %s", err))
+	} else {
+		name, _ := vmConfig["name"].(string)
+		if name == "" {
+			name = fmt.Sprintf("VM%d", vmRef.VmId())
+		}
+		description, _ := vmConfig["description"].(string)
+		tags, _ = vmConfig["tags"].(string)
+		changes["name"] = name + "-failed"
+		changes["description"] = strings.TrimSpace(fmt.Sprintf("%s\n\nBuild failed: %s", description, buildErr))
+	}
+	changes["tags"] = strings.Join(append(withoutTag(splitTags(tags), buildVMTag), failedBuildTag), ";")
+
+	if _, err := client.SetVmConfig(vmRef, changes); err != nil {
+		ui.Error(fmt.Sprintf("Error marking VM %d as failed build: %s", vmRef.VmId(), err))
+		if len(changes) == 1 {
+			return
+		}
+		if _, err := client.SetVmConfig(vmRef, map[string]interface{}{"tags": changes["tags"]}); err != nil {
+			ui.Error(fmt.Sprintf("Error replacing the tags of VM %d, remove the %s tag manually or the VM may be deleted as orphan: %s", vmRef.VmId(), buildVMTag, err))
+		}
+		return
+	}
+	if name, ok := changes["name"]; ok {
+		ui.Say(fmt.Sprintf("Kept VM %d as %s", vmRef.VmId(), name))
+	}
+}
@@ -16,8 +16,12 @@ import (
 )
 
 type startedVMCleanerMock struct {
-	stopVm   func() (string, error)
-	deleteVm func() (string, error)
+	stopVm      func() (string, error)
+	deleteVm    func() (string, error)
+	vmState     map[string]interface{}
+	vmConfig    map[string]interface{}
+	vmConfigErr error
+	setVmConfig func(map[string]interface{}) (interface{}, error)
 }
 
 func (m startedVMCleanerMock) StopVm(*proxmox.VmRef) (string, error) {
@@ -26,6 +30,18 @@ func (m startedVMCleanerMock) StopVm(*proxmox.VmRef) (string, error) {
 func (m startedVMCleanerMock) DeleteVm(*proxmox.VmRef) (string, error) {
 	return m.deleteVm()
 }
+func (m startedVMCleanerMock) GetVmState(*proxmox.VmRef) (map[string]interface{}, error) {
+	return m.vmState, nil
+}
+func (m startedVMCleanerMock) GetVmConfig(*proxmox.VmRef) (map[string]interface{}, error) {
+	if m.vmConfigErr != nil {
+		return nil, m.vmConfigErr
+	}
+	return m.vmConfig, nil
+}
+func (m startedVMCleanerMock) SetVmConfig(_ *proxmox.VmRef, changes map[string]interface{}) (interface{}, error) {
+	return m.setVmConfig(changes)
+}
 
 var _ startedVMCleaner = &startedVMCleanerMock{}
 
@@ -113,6 +129,148 @@ func TestCleanupStartVM(t *testing.T) {
 	}
 }
 
+func TestCleanupStartVMKeepOnError(t *testing.T) {
+	cs := []struct {
+		name         string
+		config       *Config
+		buildErr     error
+		vmState      string
+		expectStop   bool
+		expectDelete bool
+		vmConfigErr  error
+		// Number of SetVmConfig calls failing before one succeeds
+		setVmConfigOK   int
+		expectedChanges []map[string]interface{}
+	}{
+		{
+			name:       "failed VM should be stopped and marked",
+			config:     &Config{KeepVMOnError: true},
+			buildErr:   fmt.Errorf("provisioner failed"),
+			vmState:    "running",
+			expectStop: true,
+			expectedChanges: []map[string]interface{}{{
+				"name":        "packer-build-failed",
+				"tags":        "debian;packer-failed",
+				"description": "Packer ephemeral build VM\n\nBuild failed: provisioner failed",
+			}},
+		},
+		{
+			name:     "failed VM should be left running",
+			config:   &Config{KeepVMOnError: true, KeepVMOnErrorRunning: true},
+			buildErr: fmt.Errorf("provisioner failed"),
+			vmState:  "running",
+			expectedChanges: []map[string]interface{}{{
+				"name":        "packer-build-failed",
+				"tags":        "debian;packer-failed",
+				"description": "Packer ephemeral build VM\n\nBuild failed: provisioner failed",
+			}},
+		},
+		{
+			name:     "stopped VM should not be stopped again",
+			config:   &Config{KeepVMOnError: true},
+			buildErr: fmt.Errorf("conversion failed"),
+			vmState:  "stopped",
+			expectedChanges: []map[string]interface{}{{
+				"name":        "packer-build-failed",
+				"tags":        "debian;packer-failed",
+				"description": "Packer ephemeral build VM\n\nBuild failed: conversion failed",
+			}},
+		},
+		{
+			name:        "unreadable config should still replace the build tag",
+			config:      &Config{KeepVMOnError: true, Tags: "debian"},
+			buildErr:    fmt.Errorf("provisioner failed"),
+			vmState:     "running",
+			vmConfigErr: fmt.Errorf("500 Internal Server Error"),
+			expectStop:  true,
+			expectedChanges: []map[string]interface{}{
+				{"tags": "debian;packer-failed"},
+			},
+		},
+		{
+			name:          "failed marking should still replace the build tag",
+			config:        &Config{KeepVMOnError: true},
+			buildErr:      fmt.Errorf("provisioner failed"),
+			vmState:       "stopped",
+			setVmConfigOK: 1,
+			expectedChanges: []map[string]interface{}{
+				{
+					"name":        "packer-build-failed",
+					"tags":        "debian;packer-failed",
+					"description": "Packer ephemeral build VM\n\nBuild failed: provisioner failed",
+				},
+				{"tags": "debian;packer-failed"},
+			},
+		},
+		{
+			name:         "cancelled build should delete the VM",
+			config:       &Config{KeepVMOnError: true},
+			vmState:      "running",
+			expectStop:   true,
+			expectDelete: true,
+		},
+		{
+			name:         "failed build without keep_vm_on_error should delete the VM",
+			config:       &Config{},
+			buildErr:     fmt.Errorf("provisioner failed"),
+			vmState:      "running",
+			expectStop:   true,
+			expectDelete: true,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			var stopped, deleted bool
+			var changes []map[string]interface{}
+			cleaner := startedVMCleanerMock{
+				stopVm: func() (string, error) {
+					stopped = true
+					return "", nil
+				},
+				deleteVm: func() (string, error) {
+					deleted = true
+					return "", nil
+				},
+				vmState: map[string]interface{}{"status": c.vmState},
+				vmConfig: map[string]interface{}{
+					"name":        "packer-build",
+					"tags":        "debian;packer-build",
+					"description": "Packer ephemeral build VM",
+				},
+				vmConfigErr: c.vmConfigErr,
+				setVmConfig: func(m map[string]interface{}) (interface{}, error) {
+					changes = append(changes, m)
+					if len(changes) <= c.setVmConfigOK {
+						return nil, fmt.Errorf("VM is locked")
+					}
+					return nil, nil
+				},
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("proxmoxClient", cleaner)
+			state.Put("config", c.config)
+			state.Put("vmRef", proxmox.NewVmRef(100))
+			if c.buildErr != nil {
+				state.Put("error", c.buildErr)
+			}
+
+			step := stepStartVM{}
+			step.Cleanup(state)
+
+			if stopped != c.expectStop {
+				t.Errorf("Expected StopVm to be called: %v, got: %v", c.expectStop, stopped)
+			}
+			if deleted != c.expectDelete {
+				t.Errorf("Expected DeleteVm to be called: %v, got: %v", c.expectDelete, deleted)
+			}
+			assert.Equal(t, c.expectedChanges, changes)
+		})
+	}
+}
+
 type startVMMock struct {
 	create      func(*proxmox.VmRef, proxmox.ConfigQemu, multistep.StateBag) error
 	startVm     func(*proxmox.VmRef) (string, error)
@@ -124,6 +282,8 @@ type startVMMock struct {
 	checkVmRef  func(vmr *proxmox.VmRef) (err error)
 	getVmByName func(vmName string) (vmrs []*proxmox.VmRef, err error)
 	deleteVm    func(vmr *proxmox.VmRef) (exitStatus string, err error)
+
+	getResourceList func(resourceType string) ([]interface{}, error)
 }
 
 func (m *startVMMock) Create(vmRef *proxmox.VmRef, config proxmox.ConfigQemu, state multistep.StateBag) error {
@@ -150,6 +310,12 @@ func (m *startVMMock) GetVmState(vmr *proxmox.VmRef) (map[string]interface{}, er
 func (m *startVMMock) CheckVmRef(vmr *proxmox.VmRef) (err error) {
 	return m.checkVmRef(vmr)
 }
+func (m *startVMMock) GetResourceList(resourceType string) ([]interface{}, error) {
+	if m.getResourceList == nil {
+		return nil, nil
+	}
+	return m.getResourceList(resourceType)
+}
 func (m *startVMMock) GetVmRefsByName(vmName string) (vmrs []*proxmox.VmRef, err error) {
 	return m.getVmByName(vmName)
 }
@@ -221,6 +387,52 @@ func TestStartVM(t *testing.T) {
 	}
 }
 
+func TestStartVMConfigOverrides(t *testing.T) {
+	var applied map[string]interface{}
+	started := false
+	mock := &startVMMock{
+		create: func(vmRef *proxmox.VmRef, config proxmox.ConfigQemu, state multistep.StateBag) error {
+			return nil
+		},
+		startVm: func(*proxmox.VmRef) (string, error) {
+			started = true
+			return "", nil
+		},
+		setVmConfig: func(vmRef *proxmox.VmRef, changes map[string]interface{}) (interface{}, error) {
+			if started {
+				t.Error("Expected vm_config_overrides to be applied before the VM is started")
+			}
+			applied = changes
+			return nil, nil
+		},
+		getNextID: func(id int) (int, error) {
+			return 1, nil
+		},
+	}
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", packersdk.TestUi(t))
+	state.Put("config", &Config{
+		VMConfigOverrides: map[string]string{
+			"protection": "1",
+			"startup":    "order=2,up=30",
+			"watchdog":   "",
+			"audio0":     "",
+		},
+	})
+	state.Put("proxmoxClient", mock)
+	s := stepStartVM{vmCreator: mock}
+
+	action := s.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Expected action %s, got %s", multistep.ActionContinue, action)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"protection": "1",
+		"startup":    "order=2,up=30",
+		"delete":     "audio0,watchdog",
+	}, applied)
+}
+
 func TestStartVMRetryOnDuplicateID(t *testing.T) {
 	newDuplicateError := func(id int) error {
 		return fmt.Errorf("unable to create VM %d - VM %d already exists on node 'test'", id, id)
@@ -320,6 +532,7 @@ func TestStartVMWithForce(t *testing.T) {
 		mockGetVmRefsByName  func(vmName string) (vmrs []*proxmox.VmRef, err error)
 		mockGetVmConfig      func(vmr *proxmox.VmRef) (map[string]interface{}, error)
 		mockGetVmState       func(vmr *proxmox.VmRef) (map[string]interface{}, error)
+		mockResources        []interface{}
 	}{
 		{
 			name: "Delete existing VM when it's a template and force is enabled",
@@ -339,6 +552,59 @@ func TestStartVMWithForce(t *testing.T) {
 				return map[string]interface{}{"status": "stopped"}, nil
 			},
 		},
+		{
+			name: "Don't delete a template that still has linked clones",
+			config: &Config{
+				PackerConfig: common.PackerConfig{
+					PackerForce: true,
+				},
+				VMID: 100,
+			},
+			expectedCallToDelete: false,
+			expectedAction:       multistep.ActionHalt,
+			mockGetVmConfig: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				switch vmr.VmId() {
+				case 101:
+					return map[string]interface{}{"scsi0": "local-lvm:base-100-disk-0/vm-101-disk-0,size=8G"}, nil
+				case 102:
+					return map[string]interface{}{"scsi0": "local-lvm:vm-102-disk-0,size=8G"}, nil
+				}
+				return map[string]interface{}{"template": 1.0, "scsi0": "local-lvm:base-100-disk-0,size=8G"}, nil
+			},
+			mockGetVmState: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				return map[string]interface{}{"status": "stopped"}, nil
+			},
+			mockResources: []interface{}{
+				map[string]interface{}{"type": "qemu", "vmid": 100.0, "node": "pve"},
+				map[string]interface{}{"type": "qemu", "vmid": 101.0, "node": "pve2"},
+				map[string]interface{}{"type": "qemu", "vmid": 102.0, "node": "pve"},
+			},
+		},
+		{
+			name: "Delete a template without linked clones",
+			config: &Config{
+				PackerConfig: common.PackerConfig{
+					PackerForce: true,
+				},
+				VMID: 100,
+			},
+			expectedCallToDelete: true,
+			expectedAction:       multistep.ActionContinue,
+			mockGetVmConfig: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				if vmr.VmId() == 102 {
+					return map[string]interface{}{"scsi0": "local:9000/base-9000-disk-0.qcow2/102/vm-102-disk-0.qcow2,size=8G"}, nil
+				}
+				return map[string]interface{}{"template": 1.0, "scsi0": "local-lvm:base-100-disk-0,size=8G"}, nil
+			},
+			mockGetVmState: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				return map[string]interface{}{"status": "stopped"}, nil
+			},
+			mockResources: []interface{}{
+				map[string]interface{}{"type": "qemu", "vmid": 100.0, "node": "pve"},
+				map[string]interface{}{"type": "qemu", "vmid": 102.0, "node": "pve"},
+				map[string]interface{}{"type": "lxc", "vmid": 103.0, "node": "pve"},
+			},
+		},
 		{
 			name: "Don't delete VM when it's not a template",
 			config: &Config{
@@ -412,6 +678,50 @@ func TestStartVMWithForce(t *testing.T) {
 				return map[string]interface{}{"status": "running"}, nil
 			},
 		},
+		{
+			name: "Don't delete a failed build kept by keep_vm_on_error",
+			config: &Config{
+				PackerConfig: common.PackerConfig{
+					PackerForce: true,
+				},
+				VMID:                  100,
+				SkipConvertToTemplate: true,
+			},
+			expectedCallToDelete: false,
+			expectedAction:       multistep.ActionHalt,
+			mockGetVmConfig: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				return map[string]interface{}{"name": "mockVM-failed", "tags": "debian;packer-failed"}, nil
+			},
+		},
+		{
+			name: "failed builds are left out of the name lookup",
+			config: &Config{
+				PackerConfig: common.PackerConfig{
+					PackerForce: true,
+				},
+				VMName: "mockVM",
+			},
+			expectedCallToDelete: true,
+			expectedAction:       multistep.ActionContinue,
+			mockGetVmRefsByName: func(vmName string) (vmrs []*proxmox.VmRef, err error) {
+				return []*proxmox.VmRef{
+					proxmox.NewVmRef(100),
+					proxmox.NewVmRef(101),
+				}, nil
+			},
+			mockGetVmConfig: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				if vmr.VmId() == 100 {
+					return map[string]interface{}{"tags": "packer-failed"}, nil
+				}
+				return map[string]interface{}{"template": 1.0}, nil
+			},
+			mockGetVmState: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+				if vmr.VmId() != 101 {
+					return nil, fmt.Errorf("expected VM 101 to be deleted, got %d", vmr.VmId())
+				}
+				return map[string]interface{}{"status": "stopped"}, nil
+			},
+		},
 		{
 			name: "delete VM when template_name is empty, falls back to vm_name",
 			config: &Config{
@@ -475,6 +785,9 @@ func TestStartVMWithForce(t *testing.T) {
 					deleteWasCalled = true
 					return "", nil
 				},
+				getResourceList: func(resourceType string) ([]interface{}, error) {
+					return c.mockResources, nil
+				},
 			}
 			state := new(multistep.BasicStateBag)
 			state.Put("ui", packersdk.TestUi(t))
@@ -1362,3 +1675,121 @@ func TestGenerateProxmoxDisks(t *testing.T) {
 		})
 	}
 }
+
+func TestStartVMCloudInitDuringBuild(t *testing.T) {
+	cs := []struct {
+		name               string
+		config             *Config
+		vmConfig           map[string]interface{}
+		expectedAction     multistep.StepAction
+		expectedCloudInit  bool
+		expectedController string
+		expectedDrive      string
+	}{
+		{
+			name: "disabled, no cloud-init",
+			config: &Config{
+				Disks: []diskConfig{{Type: "scsi", Size: "10G", StoragePool: "local-lvm"}},
+			},
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name: "drive on the storage pool of the first disk",
+			config: &Config{
+				CloudInitDuringBuild: true,
+				CloudInitDiskType:    "ide",
+				Disks:                []diskConfig{{Type: "scsi", Size: "10G", StoragePool: "local-lvm"}},
+			},
+			vmConfig:           map[string]interface{}{"ide0": "local:iso/debian.iso,media=cdrom"},
+			expectedAction:     multistep.ActionContinue,
+			expectedCloudInit:  true,
+			expectedController: "ide1",
+			expectedDrive:      "local-lvm:cloudinit",
+		},
+		{
+			name: "explicit storage pool and disk type",
+			config: &Config{
+				CloudInitDuringBuild: true,
+				CloudInitStoragePool: "ceph",
+				CloudInitDiskType:    "sata",
+				Disks:                []diskConfig{{Type: "scsi", Size: "10G", StoragePool: "local-lvm"}},
+			},
+			vmConfig:           map[string]interface{}{},
+			expectedAction:     multistep.ActionContinue,
+			expectedCloudInit:  true,
+			expectedController: "sata0",
+			expectedDrive:      "ceph:cloudinit",
+		},
+		{
+			name: "existing drive is kept",
+			config: &Config{
+				CloudInitDuringBuild: true,
+				CloudInitDiskType:    "ide",
+			},
+			vmConfig:          map[string]interface{}{"ide2": "local-lvm:vm-100-cloudinit,media=cdrom"},
+			expectedAction:    multistep.ActionContinue,
+			expectedCloudInit: true,
+		},
+		{
+			name: "no storage pool, fail",
+			config: &Config{
+				CloudInitDuringBuild: true,
+				CloudInitDiskType:    "ide",
+			},
+			vmConfig:          map[string]interface{}{},
+			expectedAction:    multistep.ActionHalt,
+			expectedCloudInit: true,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			var cloudInit *proxmox.CloudInit
+			changes := map[string]interface{}{}
+			mock := &startVMMock{
+				create: func(vmRef *proxmox.VmRef, config proxmox.ConfigQemu, state multistep.StateBag) error {
+					cloudInit = config.CloudInit
+					return nil
+				},
+				startVm: func(*proxmox.VmRef) (string, error) {
+					return "", nil
+				},
+				setVmConfig: func(vmRef *proxmox.VmRef, config map[string]interface{}) (interface{}, error) {
+					for k, v := range config {
+						changes[k] = v
+					}
+					return nil, nil
+				},
+				getNextID: func(id int) (int, error) {
+					return 100, nil
+				},
+				getVmConfig: func(vmr *proxmox.VmRef) (map[string]interface{}, error) {
+					return c.vmConfig, nil
+				},
+			}
+			c.config.Comm.SSHUsername = "packer"
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", c.config)
+			state.Put("proxmoxClient", mock)
+			s := stepStartVM{vmCreator: mock}
+
+			action := s.Run(context.TODO(), state)
+			if action != c.expectedAction {
+				t.Errorf("Expected action %s, got %s", c.expectedAction, action)
+			}
+			if (cloudInit != nil) != c.expectedCloudInit {
+				t.Fatalf("Expected cloud-init settings: %v, got: %v", c.expectedCloudInit, cloudInit != nil)
+			}
+			if cloudInit != nil && *cloudInit.Username != "packer" {
+				t.Errorf("Expected cloud-init user packer, got %s", *cloudInit.Username)
+			}
+			if c.expectedController == "" && len(changes) > 0 {
+				t.Errorf("Expected no drive to be added, got %v", changes)
+			}
+			if c.expectedController != "" && changes[c.expectedController] != c.expectedDrive {
+				t.Errorf("Expected %s to be %q, got %v", c.expectedController, c.expectedDrive, changes)
+			}
+		})
+	}
+}
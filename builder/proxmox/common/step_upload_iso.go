@@ -4,15 +4,25 @@
 package proxmox
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	proxmoxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/go-getter/v2"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/retry"
 )
 
 // stepUploadISO uploads an ISO file
@@ -21,12 +31,21 @@ type stepUploadISO struct {
 }
 
 type uploader interface {
-	Upload(node string, storage string, contentType string, filename string, file io.Reader) error
+	UploadLargeFile(node string, storage string, contentType string, filename string, filesize int64, file io.Reader) error
 	DeleteVolume(vmr *proxmoxapi.VmRef, storageName string, volumeName string) (exitStatus interface{}, err error)
+	GetItemListInterfaceArray(url string) ([]interface{}, error)
 }
 
 var _ uploader = &proxmoxapi.Client{}
 
+// storageContentLister is the part of uploader needed by getStorageVolumeSize
+type storageContentLister interface {
+	GetItemListInterfaceArray(url string) ([]interface{}, error)
+}
+
+// uploadRetryDelay is the time to wait before retrying a failed upload
+var uploadRetryDelay = 10 * time.Second
+
 func (s *stepUploadISO) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packersdk.Ui)
 	client := state.Get("proxmoxClient").(uploader)
@@ -36,6 +55,10 @@ func (s *stepUploadISO) Run(ctx context.Context, state multistep.StateBag) multi
 		return multistep.ActionContinue
 	}
 
+	if s.ISO.ISOUploadStream {
+		return s.streamISO(ctx, state)
+	}
+
 	if len(s.ISO.CDFiles) > 0 || len(s.ISO.CDContent) > 0 {
 		// output from commonsteps.StepCreateCD should have populate cd_path
 		if cdPath, ok := state.GetOk("cd_path"); ok {
@@ -64,7 +87,7 @@ func (s *stepUploadISO) Run(ctx context.Context, state multistep.StateBag) multi
 		return multistep.ActionHalt
 	}
 
-	r, err := os.Open(isoPath)
+	fi, err := os.Stat(isoPath)
 	if err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -72,20 +95,347 @@ func (s *stepUploadISO) Run(ctx context.Context, state multistep.StateBag) multi
 	}
 
 	filename := filepath.Base(isoPath)
-	err = client.Upload(c.Node, s.ISO.ISOStoragePool, "iso", filename, r)
+	isoStoragePath := fmt.Sprintf("%s:iso/%s", s.ISO.ISOStoragePool, filename)
+
+	// Generated ISOs get a fresh name on every build, so there is nothing to reuse
+	generated := len(s.ISO.CDFiles) > 0 || len(s.ISO.CDContent) > 0
+	var checksum *getter.FileChecksum
+	if !generated {
+		// The downloaded ISO was verified against iso_checksum already
+		if len(s.ISO.ISOUrls) > 0 {
+			checksum, err = resolveISOChecksum(ctx, s.ISO.ISOUrls[0], s.ISO.ISOChecksum)
+			if err != nil {
+				log.Printf("can't resolve checksum of %s, an existing ISO won't be reused: %s", filename, err)
+			}
+		}
+		reuse, err := s.reuseExistingISO(client, c.Node, filename, fi.Size(), checksum, ui)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if reuse {
+			s.ISO.ISOFile = isoStoragePath
+			return multistep.ActionContinue
+		}
+	}
+
+	err = uploadWithRetry(ctx, ui, client, c, s.ISO.ISOStoragePool, filename, fi.Size(), func() (io.ReadCloser, error) {
+		return os.Open(isoPath)
+	})
 	if err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	isoStoragePath := fmt.Sprintf("%s:iso/%s", s.ISO.ISOStoragePool, filename)
+	if !generated {
+		if err := recordISOChecksum(client, c.Node, s.ISO.ISOStoragePool, filename, checksum); err != nil {
+			ui.Error(fmt.Sprintf("Error recording checksum of %s, it won't be reused by later builds: %s", isoStoragePath, err))
+		}
+	}
+
 	s.ISO.ISOFile = isoStoragePath
 	ui.Message(fmt.Sprintf("Uploaded ISO to %s", isoStoragePath))
 
 	return multistep.ActionContinue
 }
 
+// streamISO uploads the ISO straight from one of its URLs to the storage pool,
+// without storing it on the Packer host. The checksum is computed on the fly
+// and the uploaded file is removed again if it doesn't match.
+func (s *stepUploadISO) streamISO(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	client := state.Get("proxmoxClient").(uploader)
+	c := state.Get("config").(*Config)
+
+	var errs *packersdk.MultiError
+	for _, isoURL := range s.ISO.ISOUrls {
+		u, err := url.Parse(isoURL)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+			continue
+		}
+		filename := path.Base(u.Path)
+		isoStoragePath := fmt.Sprintf("%s:iso/%s", s.ISO.ISOStoragePool, filename)
+
+		checksum, err := resolveISOChecksum(ctx, isoURL, s.ISO.ISOChecksum)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("error reading checksum for %s: %s", isoURL, err))
+			continue
+		}
+
+		size, err := getRemoteFileSize(ctx, isoURL)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+			continue
+		}
+
+		reuse, err := s.reuseExistingISO(client, c.Node, filename, size, checksum, ui)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if reuse {
+			s.ISO.ISOFile = isoStoragePath
+			return multistep.ActionContinue
+		}
+
+		ui.Say(fmt.Sprintf("Streaming ISO from %s to %s", isoURL, isoStoragePath))
+		err = uploadWithRetry(ctx, ui, client, c, s.ISO.ISOStoragePool, filename, size, func() (io.ReadCloser, error) {
+			body, err := openRemoteFile(ctx, isoURL)
+			if err != nil {
+				return nil, err
+			}
+			if checksum == nil {
+				return body, nil
+			}
+			// Hash from scratch on every attempt, as each one restarts the download
+			checksum.Hash.Reset()
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(body, checksum.Hash), body}, nil
+		})
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("error streaming %s: %s", isoURL, err))
+			continue
+		}
+
+		if checksum != nil && !bytes.Equal(checksum.Hash.Sum(nil), checksum.Value) {
+			err := fmt.Errorf("checksum of ISO streamed from %s didn't match, expected %s:%x, got %s:%x", isoURL, checksum.Type, checksum.Value, checksum.Type, checksum.Hash.Sum(nil))
+			// Fake a VM reference, DeleteVolume just needs the node to be valid
+			vmRef := &proxmoxapi.VmRef{}
+			vmRef.SetNode(c.Node)
+			vmRef.SetVmType("qemu")
+			if _, derr := client.DeleteVolume(vmRef, s.ISO.ISOStoragePool, isoStoragePath); derr != nil {
+				ui.Error(fmt.Sprintf("delete volume failed, please delete %s manually: %s", isoStoragePath, derr))
+			}
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if err := recordISOChecksum(client, c.Node, s.ISO.ISOStoragePool, filename, checksum); err != nil {
+			ui.Error(fmt.Sprintf("Error recording checksum of %s, it won't be reused by later builds: %s", isoStoragePath, err))
+		}
+
+		s.ISO.ISOFile = isoStoragePath
+		ui.Message(fmt.Sprintf("Uploaded ISO to %s", isoStoragePath))
+		return multistep.ActionContinue
+	}
+
+	err := fmt.Errorf("failed to stream ISO from any of the provided URLs: %s", errs)
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+// reuseExistingISO checks whether the ISO is already present on the storage pool.
+// It returns true when the existing file can be used instead of uploading the ISO,
+// and an error when a conflicting file exists and the iso_overwrite policy is fail.
+// Only files with the same size and a checksum recorded by a previous build
+// matching the checksum of the ISO are reused.
+func (s *stepUploadISO) reuseExistingISO(client uploader, node string, filename string, size int64, checksum *getter.FileChecksum, ui packersdk.Ui) (bool, error) {
+	if s.ISO.ISOOverwrite == "always" {
+		return false, nil
+	}
+	isoStoragePath := fmt.Sprintf("%s:iso/%s", s.ISO.ISOStoragePool, filename)
+	existingSize, found, err := getStorageVolumeSize(client, node, s.ISO.ISOStoragePool, "iso", isoStoragePath)
+	if err != nil {
+		return false, fmt.Errorf("error listing content of storage %s: %s", s.ISO.ISOStoragePool, err)
+	}
+	if !found {
+		return false, nil
+	}
+
+	var conflict string
+	switch {
+	case existingSize != size:
+		conflict = fmt.Sprintf("a different size (%d bytes, expected %d bytes)", existingSize, size)
+	case checksum == nil:
+		conflict = "no iso_checksum to verify it against"
+	default:
+		verified, err := hasISOChecksum(client, node, s.ISO.ISOStoragePool, filename, checksum)
+		if err != nil {
+			return false, fmt.Errorf("error listing content of storage %s: %s", s.ISO.ISOStoragePool, err)
+		}
+		if verified {
+			ui.Message(fmt.Sprintf("ISO already present at %s with matching checksum, skipping upload", isoStoragePath))
+			return true, nil
+		}
+		conflict = "no record of a matching checksum"
+	}
+	if s.ISO.ISOOverwrite == "fail" {
+		return false, fmt.Errorf("%s already exists with %s and iso_overwrite is set to fail", isoStoragePath, conflict)
+	}
+	ui.Say(fmt.Sprintf("%s already exists with %s, replacing it", isoStoragePath, conflict))
+	return false, nil
+}
+
+// uploadWithRetry uploads the file returned by open to the storage pool, reporting
+// progress through the UI. Failed uploads are retried up to iso_upload_attempts times.
+// Proxmox can't resume uploads, so every attempt starts from the beginning of the file.
+func uploadWithRetry(ctx context.Context, ui packersdk.Ui, client uploader, c *Config, storage string, filename string, size int64, open func() (io.ReadCloser, error)) error {
+	attempts := c.ISOUploadAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	try := 0
+	return retry.Config{
+		Tries:      attempts,
+		RetryDelay: func() time.Duration { return uploadRetryDelay },
+	}.Run(ctx, func(ctx context.Context) error {
+		try++
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		body := ui.TrackProgress(filename, 0, size, r)
+		defer body.Close()
+
+		err = client.UploadLargeFile(c.Node, storage, "iso", filename, size, body)
+		if err != nil {
+			log.Printf("upload attempt %d of %d for %s failed: %s", try, attempts, filename, err)
+			if try < attempts {
+				ui.Say(fmt.Sprintf("Upload of %s failed, retrying: %s", filename, err))
+			}
+		}
+		return err
+	})
+}
+
+// getRemoteFileSize returns the size reported by the server for the given URL.
+// The size has to be known upfront to stream the file to Proxmox.
+func getRemoteFileSize(ctx context.Context, isoURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, isoURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status fetching %s: %s", isoURL, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("server did not report the size of %s, it can't be streamed", isoURL)
+	}
+	return resp.ContentLength, nil
+}
+
+// CheckUploadStreamURLs returns an error if the ISO can't be streamed from
+// one of the URLs, only HTTP and HTTPS are supported.
+func CheckUploadStreamURLs(isoURLs []string) error {
+	for _, isoURL := range isoURLs {
+		u, err := url.Parse(isoURL)
+		if err != nil {
+			return fmt.Errorf("invalid iso_url %q: %s", isoURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("iso_upload_stream only supports http and https URLs, got %q", isoURL)
+		}
+	}
+	return nil
+}
+
+func openRemoteFile(ctx context.Context, isoURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, isoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", isoURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// getStorageVolumeSize looks up volumeID (for example `local:iso/debian.iso`) in the
+// content of the given storage and returns its size in bytes, and whether it was found.
+func getStorageVolumeSize(client storageContentLister, node string, storage string, contentType string, volumeID string) (int64, bool, error) {
+	items, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/storage/%s/content?content=%s", node, storage, contentType))
+	if err != nil {
+		return 0, false, err
+	}
+	for _, item := range items {
+		volume, ok := item.(map[string]interface{})
+		if !ok || volume["volid"] != volumeID {
+			continue
+		}
+		size, _ := volume["size"].(float64)
+		return int64(size), true, nil
+	}
+	return 0, false, nil
+}
+
+// resolveISOChecksum returns the checksum the ISO at isoURL is expected to
+// have, resolving checksum files. It returns nil when iso_checksum is none.
+func resolveISOChecksum(ctx context.Context, isoURL string, isoChecksum string) (*getter.FileChecksum, error) {
+	if isoChecksum == "" || isoChecksum == "none" {
+		return nil, nil
+	}
+	gc := getter.Client{}
+	return gc.GetChecksum(ctx, &getter.Request{
+		Src: isoURL + "?checksum=" + isoChecksum,
+	})
+}
+
+// Proxmox can neither hash nor read files on a storage, so the checksum of
+// an ISO placed there by Packer is recorded in the name of a small image
+// next to it, e.g. `debian.iso.sha256-<hex>.img`, listed with the storage
+// content. Later builds only reuse the ISO if the record matches.
+var rxISOChecksumRecord = regexp.MustCompile(`^\.[a-z0-9]+-[0-9a-f]+\.img$`)
+
+func isoChecksumRecordName(filename string, checksum *getter.FileChecksum) string {
+	return fmt.Sprintf("%s.%s-%x.img", filename, checksum.Type, checksum.Value)
+}
+
+// hasISOChecksum reports whether the checksum recorded for the ISO on the
+// storage is the given one.
+func hasISOChecksum(client storageContentLister, node string, storage string, filename string, checksum *getter.FileChecksum) (bool, error) {
+	_, found, err := getStorageVolumeSize(client, node, storage, "iso", fmt.Sprintf("%s:iso/%s", storage, isoChecksumRecordName(filename, checksum)))
+	return found, err
+}
+
+// recordISOChecksum replaces the checksum recorded for the ISO on the storage.
+// Without a checksum, only the outdated records are removed.
+func recordISOChecksum(client uploader, node string, storage string, filename string, checksum *getter.FileChecksum) error {
+	items, err := client.GetItemListInterfaceArray(fmt.Sprintf("/nodes/%s/storage/%s/content?content=iso", node, storage))
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("%s:iso/%s", storage, filename)
+	// Fake a VM reference, DeleteVolume just needs the node to be valid
+	vmRef := &proxmoxapi.VmRef{}
+	vmRef.SetNode(node)
+	vmRef.SetVmType("qemu")
+	for _, item := range items {
+		volume, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		volid, _ := volume["volid"].(string)
+		if !strings.HasPrefix(volid, prefix) || !rxISOChecksumRecord.MatchString(strings.TrimPrefix(volid, prefix)) {
+			continue
+		}
+		if _, err := client.DeleteVolume(vmRef, storage, volid); err != nil {
+			return err
+		}
+	}
+	if checksum == nil {
+		return nil
+	}
+	record := []byte(fmt.Sprintf("%s:%x  %s\n", checksum.Type, checksum.Value, filename))
+	return client.UploadLargeFile(node, storage, "iso", isoChecksumRecordName(filename, checksum), int64(len(record)), bytes.NewReader(record))
+}
+
 func (s *stepUploadISO) Cleanup(state multistep.StateBag) {
 	c := state.Get("config").(*Config)
 	ui := state.Get("ui").(packersdk.Ui)
@@ -5,8 +5,14 @@ package proxmox
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
@@ -16,15 +22,25 @@ import (
 )
 
 type uploaderMock struct {
-	uploadFail      bool
+	uploadFailures  int
+	uploadAttempts  int
 	deleteFail      bool
+	listFail        bool
 	uploadWasCalled bool
 	deleteWasCalled bool
+	storageContent  []interface{}
+	uploaded        []string
+	deleted         []string
 }
 
-func (m *uploaderMock) Upload(node string, storage string, contentType string, filename string, file io.Reader) error {
+func (m *uploaderMock) UploadLargeFile(node string, storage string, contentType string, filename string, filesize int64, file io.Reader) error {
 	m.uploadWasCalled = true
-	if m.uploadFail {
+	m.uploadAttempts++
+	m.uploaded = append(m.uploaded, filename)
+	if _, err := io.Copy(io.Discard, file); err != nil {
+		return err
+	}
+	if m.uploadAttempts <= m.uploadFailures {
 		return fmt.Errorf("Testing induced Upload failure")
 	}
 	return nil
@@ -32,15 +48,38 @@ func (m *uploaderMock) Upload(node string, storage string, contentType string, f
 
 func (m *uploaderMock) DeleteVolume(vmr *proxmox.VmRef, storageName string, volumeName string) (exitStatus interface{}, err error) {
 	m.deleteWasCalled = true
+	m.deleted = append(m.deleted, volumeName)
 	if m.deleteFail {
 		return nil, fmt.Errorf("Testing induced DeleteVolume failure")
 	}
 	return
 }
 
+func (m *uploaderMock) GetItemListInterfaceArray(url string) ([]interface{}, error) {
+	if m.listFail {
+		return nil, fmt.Errorf("Testing induced GetItemListInterfaceArray failure")
+	}
+	return m.storageContent, nil
+}
+
 var _ uploader = &uploaderMock{}
 
+// testISOChecksum is the SHA256 checksum of ../iso/testdata/test.iso
+const testISOChecksum = "fd922654b5c6cbcdefa876f4443832982627ae52db9cbefd4d89ee589d86bab9"
+
+var testISOConfig = commonsteps.ISOConfig{
+	ISOUrls:     []string{"../iso/testdata/test.iso"},
+	ISOChecksum: "sha256:" + testISOChecksum,
+}
+
 func TestUploadISO(t *testing.T) {
+	fi, err := os.Stat("../iso/testdata/test.iso")
+	if err != nil {
+		t.Fatalf("failed to stat test ISO: %s", err)
+	}
+	testISOSize := fi.Size()
+	uploadRetryDelay = 0
+
 	cs := []struct {
 		name               string
 		builderConfig      *Config
@@ -48,11 +87,15 @@ func TestUploadISO(t *testing.T) {
 		testAssert         func(m *uploaderMock, action multistep.StepAction)
 		downloadPath       string
 		generatedISOPath   string
-		failUpload         bool
+		storageContent     []interface{}
+		uploadFailures     int
 		failDelete         bool
+		failList           bool
 		expectError        bool
 		expectUploadCalled bool
 		expectDeleteCalled bool
+		expectedUploads    []string
+		expectedDeletes    []string
 		expectedISOPath    string
 		expectedAction     multistep.StepAction
 	}{
@@ -177,17 +220,205 @@ func TestUploadISO(t *testing.T) {
 				},
 			},
 			downloadPath:       "../iso/testdata/test.iso",
-			failUpload:         true,
+			uploadFailures:     1,
+			expectError:        true,
+			expectedAction:     multistep.ActionHalt,
+			expectUploadCalled: true,
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "downloaded ISO upload retried after failure",
+			builderConfig: &Config{ISOUploadAttempts: 2},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath:       "../iso/testdata/test.iso",
+			uploadFailures:     1,
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
+			expectUploadCalled: true,
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO with matching checksum should not be uploaded",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "replace",
+					DownloadPathKey: "../iso/testdata/test.iso",
+					ISOConfig:       testISOConfig,
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/other.iso", "size": float64(1)},
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(testISOSize)},
+				map[string]interface{}{"volid": "local:iso/test.iso.sha256-" + testISOChecksum + ".img", "size": float64(1)},
+			},
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
+			expectUploadCalled: false,
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO with another checksum should be replaced",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "replace",
+					DownloadPathKey: "../iso/testdata/test.iso",
+					ISOConfig:       testISOConfig,
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(testISOSize)},
+				map[string]interface{}{"volid": "local:iso/test.iso.sha256-0123.img", "size": float64(1)},
+			},
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
+			expectUploadCalled: true,
+			expectedUploads:    []string{"test.iso", "test.iso.sha256-" + testISOChecksum + ".img"},
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: true,
+			expectedDeletes:    []string{"local:iso/test.iso.sha256-0123.img"},
+		},
+		{
+			name:          "existing ISO without iso_checksum should be replaced",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "replace",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(testISOSize)},
+			},
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
+			expectUploadCalled: true,
+			expectedUploads:    []string{"test.iso"},
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO without checksum record should halt when iso_overwrite is fail",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "fail",
+					DownloadPathKey: "../iso/testdata/test.iso",
+					ISOConfig:       testISOConfig,
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(testISOSize)},
+			},
 			expectError:        true,
 			expectedAction:     multistep.ActionHalt,
+			expectUploadCalled: false,
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO with different size should be replaced",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "replace",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(1)},
+			},
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
 			expectUploadCalled: true,
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO with different size should halt when iso_overwrite is fail",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "fail",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath: "../iso/testdata/test.iso",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/test.iso", "size": float64(1)},
+			},
+			expectError:        true,
+			expectedAction:     multistep.ActionHalt,
+			expectUploadCalled: false,
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "existing ISO should be uploaded anyway when iso_overwrite is always",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "always",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath:       "../iso/testdata/test.iso",
+			failList:           true,
+			expectError:        false,
+			expectedAction:     multistep.ActionContinue,
+			expectUploadCalled: true,
+			expectedISOPath:    "local:iso/test.iso",
+			expectDeleteCalled: false,
+		},
+		{
+			name:          "failing to list storage content should halt",
+			builderConfig: &Config{},
+			step: &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOStoragePool:  "local",
+					ISOOverwrite:    "replace",
+					DownloadPathKey: "../iso/testdata/test.iso",
+				},
+			},
+			downloadPath:       "../iso/testdata/test.iso",
+			failList:           true,
+			expectError:        true,
+			expectedAction:     multistep.ActionHalt,
+			expectUploadCalled: false,
 			expectDeleteCalled: false,
 		},
 	}
 
 	for _, c := range cs {
 		t.Run(c.name, func(t *testing.T) {
-			m := &uploaderMock{uploadFail: c.failUpload, deleteFail: c.failDelete}
+			m := &uploaderMock{uploadFailures: c.uploadFailures, deleteFail: c.failDelete, listFail: c.failList, storageContent: c.storageContent}
 
 			state := new(multistep.BasicStateBag)
 			state.Put("ui", packersdk.TestUi(t))
@@ -209,6 +440,12 @@ func TestUploadISO(t *testing.T) {
 			if m.deleteWasCalled != c.expectDeleteCalled {
 				t.Errorf("Expected mock delete to be called: %v, got: %v", c.expectDeleteCalled, m.deleteWasCalled)
 			}
+			if c.expectedUploads != nil && !reflect.DeepEqual(m.uploaded, c.expectedUploads) {
+				t.Errorf("Expected uploads %v, got %v", c.expectedUploads, m.uploaded)
+			}
+			if c.expectedDeletes != nil && !reflect.DeepEqual(m.deleted, c.expectedDeletes) {
+				t.Errorf("Expected deletes %v, got %v", c.expectedDeletes, m.deleted)
+			}
 			err, gotError := state.GetOk("error")
 			if gotError != c.expectError {
 				t.Errorf("Expected error state to be: %v, got: %v", c.expectError, gotError)
@@ -221,3 +458,123 @@ func TestUploadISO(t *testing.T) {
 		})
 	}
 }
+
+func TestUploadISOStream(t *testing.T) {
+	content := []byte("streamed iso content")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+	uploadRetryDelay = 0
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	cs := []struct {
+		name               string
+		checksum           string
+		storageContent     []interface{}
+		uploadFailures     int
+		expectError        bool
+		expectDeleteCalled bool
+		expectReuse        bool
+		expectedUploads    []string
+		expectedAction     multistep.StepAction
+	}{
+		{
+			name:            "matching checksum should continue and be recorded",
+			checksum:        "sha256:" + checksum,
+			expectedUploads: []string{"stream.iso", "stream.iso.sha256-" + checksum + ".img"},
+			expectedAction:  multistep.ActionContinue,
+		},
+		{
+			name:     "existing ISO with matching checksum record should be reused",
+			checksum: "sha256:" + checksum,
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/stream.iso", "size": float64(len(content))},
+				map[string]interface{}{"volid": "local:iso/stream.iso.sha256-" + checksum + ".img", "size": float64(1)},
+			},
+			expectReuse:    true,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:     "existing ISO without checksum record should be streamed again",
+			checksum: "sha256:" + checksum,
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/stream.iso", "size": float64(len(content))},
+			},
+			expectedUploads: []string{"stream.iso", "stream.iso.sha256-" + checksum + ".img"},
+			expectedAction:  multistep.ActionContinue,
+		},
+		{
+			name:     "existing ISO should be streamed again when iso_checksum is none",
+			checksum: "none",
+			storageContent: []interface{}{
+				map[string]interface{}{"volid": "local:iso/stream.iso", "size": float64(len(content))},
+				map[string]interface{}{"volid": "local:iso/stream.iso.sha256-" + checksum + ".img", "size": float64(1)},
+			},
+			expectDeleteCalled: true,
+			expectedUploads:    []string{"stream.iso"},
+			expectedAction:     multistep.ActionContinue,
+		},
+		{
+			name:           "matching checksum after a failed attempt should continue",
+			checksum:       fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+			uploadFailures: 1,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:               "mismatching checksum should delete the upload and halt",
+			checksum:           fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("something else"))),
+			expectError:        true,
+			expectDeleteCalled: true,
+			expectedAction:     multistep.ActionHalt,
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			m := &uploaderMock{uploadFailures: c.uploadFailures, storageContent: c.storageContent}
+			step := &stepUploadISO{
+				ISO: &ISOsConfig{
+					ShouldUploadISO: true,
+					ISOUploadStream: true,
+					ISOStoragePool:  "local",
+					ISOConfig: commonsteps.ISOConfig{
+						ISOUrls:     []string{srv.URL + "/stream.iso"},
+						ISOChecksum: c.checksum,
+					},
+				},
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", &Config{ISOUploadAttempts: 2})
+			state.Put("proxmoxClient", m)
+
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+			if m.deleteWasCalled != c.expectDeleteCalled {
+				t.Errorf("Expected mock delete to be called: %v, got: %v", c.expectDeleteCalled, m.deleteWasCalled)
+			}
+			if m.uploadWasCalled == c.expectReuse {
+				t.Errorf("Expected mock upload to be called: %v, got: %v", !c.expectReuse, m.uploadWasCalled)
+			}
+			if c.expectedUploads != nil && !reflect.DeepEqual(m.uploaded, c.expectedUploads) {
+				t.Errorf("Expected uploads %v, got %v", c.expectedUploads, m.uploaded)
+			}
+			if _, gotError := state.GetOk("error"); gotError != c.expectError {
+				t.Errorf("Expected error state to be: %v, got: %v", c.expectError, gotError)
+			}
+			if !c.expectError && step.ISO.ISOFile != "local:iso/stream.iso" {
+				t.Errorf("Expected ISO file to be %q, got %q", "local:iso/stream.iso", step.ISO.ISOFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepWaitForCloudInit waits for cloud-init in the guest to finish before
+// provisioning starts, so provisioners don't race with cloud-init (for
+// example for the package manager lock).
+type stepWaitForCloudInit struct{}
+
+// cloudInitLogsCommand collects what is needed to debug a failed cloud-init run
+const cloudInitLogsCommand = "cloud-init status --long; tail -n 100 /var/log/cloud-init-output.log"
+
+func (s *stepWaitForCloudInit) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	c := state.Get("config").(*Config)
+
+	if !c.CloudInitWait {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Waiting for cloud-init to finish (using %s)", c.CloudInitWaitMethod))
+	waitCtx, cancel := context.WithTimeout(ctx, c.CloudInitWaitTimeout)
+	defer cancel()
+
+	exitCode, out, err := runGuestCommand(waitCtx, state, c.CloudInitWaitMethod, "cloud-init status --wait")
+	if err != nil {
+		err := fmt.Errorf("error waiting for cloud-init: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	log.Printf("cloud-init status exited with %d: %s", exitCode, out)
+
+	switch exitCode {
+	case 0:
+		ui.Message("cloud-init finished")
+		return multistep.ActionContinue
+	case 2:
+		// Recent cloud-init versions report recoverable errors (deprecations,
+		// warnings) with exit code 2, the instance is still usable
+		ui.Say(fmt.Sprintf("cloud-init finished with recoverable errors: %s", strings.TrimSpace(out)))
+		return multistep.ActionContinue
+	}
+
+	_, logs, logErr := runGuestCommand(ctx, state, c.CloudInitWaitMethod, cloudInitLogsCommand)
+	if logErr != nil {
+		logs = fmt.Sprintf("failed to collect cloud-init logs: %s", logErr)
+	}
+	err = fmt.Errorf("cloud-init failed with exit code %d:\n%s", exitCode, strings.TrimSpace(logs))
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+func (s *stepWaitForCloudInit) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,176 @@
+// Copyright IBM Corp. 2019, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type guestAgentExecutorMock struct {
+	exitCodes []int
+	output    string
+	polls     int
+	commands  []string
+}
+
+func (m *guestAgentExecutorMock) QemuAgentExec(vmr *proxmox.VmRef, params map[string]interface{}) (map[string]interface{}, error) {
+	command := params["command"].([]string)
+	m.commands = append(m.commands, command[len(command)-1])
+	return map[string]interface{}{"pid": float64(len(m.commands))}, nil
+}
+
+func (m *guestAgentExecutorMock) GetExecStatus(vmr *proxmox.VmRef, pid string) (map[string]interface{}, error) {
+	m.polls++
+	// Report the command as still running on the first poll
+	if m.polls == 1 {
+		return map[string]interface{}{"exited": float64(0)}, nil
+	}
+	exitCode := 0
+	if idx := len(m.commands) - 1; idx < len(m.exitCodes) {
+		exitCode = m.exitCodes[idx]
+	}
+	return map[string]interface{}{
+		"exited":   float64(1),
+		"exitcode": float64(exitCode),
+		"out-data": m.output,
+	}, nil
+}
+
+var _ guestAgentExecutor = &guestAgentExecutorMock{}
+
+func TestWaitForCloudInit(t *testing.T) {
+	guestCommandPollInterval = 0
+
+	cs := []struct {
+		name             string
+		wait             bool
+		method           string
+		exitCode         int
+		output           string
+		expectedAction   multistep.StepAction
+		expectedCommands int
+		expectedError    string
+	}{
+		{
+			name:           "disabled should do nothing",
+			wait:           false,
+			method:         guestCommandCommunicator,
+			expectedAction: multistep.ActionContinue,
+		},
+		{
+			name:             "communicator, done",
+			wait:             true,
+			method:           guestCommandCommunicator,
+			exitCode:         0,
+			output:           "status: done",
+			expectedAction:   multistep.ActionContinue,
+			expectedCommands: 1,
+		},
+		{
+			name:             "communicator, recoverable errors should continue",
+			wait:             true,
+			method:           guestCommandCommunicator,
+			exitCode:         2,
+			output:           "status: done",
+			expectedAction:   multistep.ActionContinue,
+			expectedCommands: 1,
+		},
+		{
+			name:             "communicator, error should halt with logs",
+			wait:             true,
+			method:           guestCommandCommunicator,
+			exitCode:         1,
+			output:           "status: error",
+			expectedAction:   multistep.ActionHalt,
+			expectedCommands: 2,
+			expectedError:    "status: error",
+		},
+		{
+			name:             "guest agent, done",
+			wait:             true,
+			method:           guestCommandQemuAgent,
+			exitCode:         0,
+			output:           "status: done",
+			expectedAction:   multistep.ActionContinue,
+			expectedCommands: 1,
+		},
+		{
+			name:             "guest agent, error should halt with logs",
+			wait:             true,
+			method:           guestCommandQemuAgent,
+			exitCode:         1,
+			output:           "status: error",
+			expectedAction:   multistep.ActionHalt,
+			expectedCommands: 2,
+			expectedError:    "status: error",
+		},
+	}
+
+	for _, c := range cs {
+		t.Run(c.name, func(t *testing.T) {
+			comm := &packersdk.MockCommunicator{
+				StartExitStatus: c.exitCode,
+				StartStdout:     c.output,
+			}
+			agent := &guestAgentExecutorMock{
+				exitCodes: []int{c.exitCode},
+				output:    c.output,
+			}
+
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packersdk.TestUi(t))
+			state.Put("config", &Config{
+				CloudInitWait:        c.wait,
+				CloudInitWaitMethod:  c.method,
+				CloudInitWaitTimeout: time.Minute,
+			})
+			state.Put("communicator", comm)
+			state.Put("proxmoxClient", agent)
+			state.Put("vmRef", proxmox.NewVmRef(1))
+
+			step := &stepWaitForCloudInit{}
+			action := step.Run(context.TODO(), state)
+			step.Cleanup(state)
+
+			if action != c.expectedAction {
+				t.Errorf("Expected action to be %v, got %v", c.expectedAction, action)
+			}
+
+			if c.method == guestCommandCommunicator {
+				if len(agent.commands) > 0 {
+					t.Error("Expected the guest agent not to be used")
+				}
+				if comm.StartCalled != (c.expectedCommands > 0) {
+					t.Errorf("Expected the communicator to be used: %v, got: %v", c.expectedCommands > 0, comm.StartCalled)
+				}
+			} else {
+				if comm.StartCalled {
+					t.Error("Expected the communicator not to be used")
+				}
+				if len(agent.commands) != c.expectedCommands {
+					t.Errorf("Expected %d commands to be run, got %d", c.expectedCommands, len(agent.commands))
+				}
+				if len(agent.commands) > 0 && agent.commands[0] != "cloud-init status --wait" {
+					t.Errorf("Unexpected command %q", agent.commands[0])
+				}
+			}
+
+			err, gotError := state.GetOk("error")
+			if gotError != (c.expectedAction == multistep.ActionHalt) {
+				t.Errorf("Expected error state to be: %v, got: %v", c.expectedAction == multistep.ActionHalt, gotError)
+			}
+			if c.expectedError != "" && !strings.Contains(fmt.Sprint(err), c.expectedError) {
+				t.Errorf("Expected error to contain %q, got %q", c.expectedError, err)
+			}
+		})
+	}
+}
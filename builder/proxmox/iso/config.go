@@ -169,6 +169,44 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, []string, error) {
 	if len(c.BootISO.ISOConfig.ISOUrls) == 0 && c.BootISO.ISOConfig.RawSingleISOUrl == "" && c.BootISO.ISODownloadPVE {
 		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_download_pve can only be used together with iso_url"))
 	}
+	if c.BootISO.ISOUploadStream {
+		if len(c.BootISO.ISOConfig.ISOUrls) == 0 && c.BootISO.ISOConfig.RawSingleISOUrl == "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream can only be used together with iso_url"))
+		} else if err := common.CheckUploadStreamURLs(c.BootISO.ISOConfig.ISOUrls); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+		}
+		if c.BootISO.ISODownloadPVE {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream and iso_download_pve cannot both be set"))
+		}
+		if len(c.BootISO.CDFiles) > 0 || len(c.BootISO.CDContent) > 0 {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_upload_stream can't be combined with cd_files or cd_content"))
+		}
+	}
+	if !c.BootISO.ISODownloadPVE {
+		if c.BootISO.ISOTargetFilename != "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("iso_target_filename can only be used together with iso_download_pve"))
+		}
+		if c.BootISO.DecompressionAlgorithm != "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("decompression_algorithm can only be used together with iso_download_pve"))
+		}
+	}
+	switch c.BootISO.DecompressionAlgorithm {
+	case "", "gz", "lzo", "zst", "bz2", "xz":
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for boot_iso decompression_algorithm %q: only one of 'gz', 'lzo', 'zst', 'bz2', 'xz' is valid", c.BootISO.DecompressionAlgorithm))
+	}
+	switch c.BootISO.ISOOverwrite {
+	case "replace", "fail", "always":
+	case "":
+		c.BootISO.ISOOverwrite = "replace"
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("invalid value for boot_iso iso_overwrite %q: only one of 'replace', 'fail', 'always' is valid", c.BootISO.ISOOverwrite))
+	}
+
+	// Snapshots are taken of a long-lived VM cloned from an existing one
+	if c.SnapshotName != "" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("snapshot_name is only supported by the proxmox-clone builder"))
+	}
 
 	if errs != nil && len(errs.Errors) > 0 {
 		return nil, warnings, errs
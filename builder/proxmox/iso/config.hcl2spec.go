@@ -11,128 +11,156 @@ import (
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName                 *string                       `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType               *string                       `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion               *string                       `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug                     *bool                         `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce                     *bool                         `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError                   *string                       `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars                  map[string]string             `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars             []string                      `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	HTTPDir                         *string                       `mapstructure:"http_directory" cty:"http_directory" hcl:"http_directory"`
-	HTTPContent                     map[string]string             `mapstructure:"http_content" cty:"http_content" hcl:"http_content"`
-	HTTPPortMin                     *int                          `mapstructure:"http_port_min" cty:"http_port_min" hcl:"http_port_min"`
-	HTTPPortMax                     *int                          `mapstructure:"http_port_max" cty:"http_port_max" hcl:"http_port_max"`
-	HTTPAddress                     *string                       `mapstructure:"http_bind_address" cty:"http_bind_address" hcl:"http_bind_address"`
-	HTTPInterface                   *string                       `mapstructure:"http_interface" undocumented:"true" cty:"http_interface" hcl:"http_interface"`
-	HTTPNetworkProtocol             *string                       `mapstructure:"http_network_protocol" cty:"http_network_protocol" hcl:"http_network_protocol"`
-	BootGroupInterval               *string                       `mapstructure:"boot_keygroup_interval" cty:"boot_keygroup_interval" hcl:"boot_keygroup_interval"`
-	BootWait                        *string                       `mapstructure:"boot_wait" cty:"boot_wait" hcl:"boot_wait"`
-	BootCommand                     []string                      `mapstructure:"boot_command" cty:"boot_command" hcl:"boot_command"`
-	BootKeyInterval                 *string                       `mapstructure:"boot_key_interval" cty:"boot_key_interval" hcl:"boot_key_interval"`
-	Type                            *string                       `mapstructure:"communicator" cty:"communicator" hcl:"communicator"`
-	PauseBeforeConnect              *string                       `mapstructure:"pause_before_connecting" cty:"pause_before_connecting" hcl:"pause_before_connecting"`
-	SSHHost                         *string                       `mapstructure:"ssh_host" cty:"ssh_host" hcl:"ssh_host"`
-	SSHPort                         *int                          `mapstructure:"ssh_port" cty:"ssh_port" hcl:"ssh_port"`
-	SSHUsername                     *string                       `mapstructure:"ssh_username" cty:"ssh_username" hcl:"ssh_username"`
-	SSHPassword                     *string                       `mapstructure:"ssh_password" cty:"ssh_password" hcl:"ssh_password"`
-	SSHKeyPairName                  *string                       `mapstructure:"ssh_keypair_name" undocumented:"true" cty:"ssh_keypair_name" hcl:"ssh_keypair_name"`
-	SSHTemporaryKeyPairName         *string                       `mapstructure:"temporary_key_pair_name" undocumented:"true" cty:"temporary_key_pair_name" hcl:"temporary_key_pair_name"`
-	SSHTemporaryKeyPairType         *string                       `mapstructure:"temporary_key_pair_type" cty:"temporary_key_pair_type" hcl:"temporary_key_pair_type"`
-	SSHTemporaryKeyPairBits         *int                          `mapstructure:"temporary_key_pair_bits" cty:"temporary_key_pair_bits" hcl:"temporary_key_pair_bits"`
-	SSHCiphers                      []string                      `mapstructure:"ssh_ciphers" cty:"ssh_ciphers" hcl:"ssh_ciphers"`
-	SSHClearAuthorizedKeys          *bool                         `mapstructure:"ssh_clear_authorized_keys" cty:"ssh_clear_authorized_keys" hcl:"ssh_clear_authorized_keys"`
-	SSHKEXAlgos                     []string                      `mapstructure:"ssh_key_exchange_algorithms" cty:"ssh_key_exchange_algorithms" hcl:"ssh_key_exchange_algorithms"`
-	SSHPrivateKeyFile               *string                       `mapstructure:"ssh_private_key_file" undocumented:"true" cty:"ssh_private_key_file" hcl:"ssh_private_key_file"`
-	SSHCertificateFile              *string                       `mapstructure:"ssh_certificate_file" cty:"ssh_certificate_file" hcl:"ssh_certificate_file"`
-	SSHPty                          *bool                         `mapstructure:"ssh_pty" cty:"ssh_pty" hcl:"ssh_pty"`
-	SSHTimeout                      *string                       `mapstructure:"ssh_timeout" cty:"ssh_timeout" hcl:"ssh_timeout"`
-	SSHWaitTimeout                  *string                       `mapstructure:"ssh_wait_timeout" undocumented:"true" cty:"ssh_wait_timeout" hcl:"ssh_wait_timeout"`
-	SSHAgentAuth                    *bool                         `mapstructure:"ssh_agent_auth" undocumented:"true" cty:"ssh_agent_auth" hcl:"ssh_agent_auth"`
-	SSHDisableAgentForwarding       *bool                         `mapstructure:"ssh_disable_agent_forwarding" cty:"ssh_disable_agent_forwarding" hcl:"ssh_disable_agent_forwarding"`
-	SSHHandshakeAttempts            *int                          `mapstructure:"ssh_handshake_attempts" cty:"ssh_handshake_attempts" hcl:"ssh_handshake_attempts"`
-	SSHBastionHost                  *string                       `mapstructure:"ssh_bastion_host" cty:"ssh_bastion_host" hcl:"ssh_bastion_host"`
-	SSHBastionPort                  *int                          `mapstructure:"ssh_bastion_port" cty:"ssh_bastion_port" hcl:"ssh_bastion_port"`
-	SSHBastionAgentAuth             *bool                         `mapstructure:"ssh_bastion_agent_auth" cty:"ssh_bastion_agent_auth" hcl:"ssh_bastion_agent_auth"`
-	SSHBastionUsername              *string                       `mapstructure:"ssh_bastion_username" cty:"ssh_bastion_username" hcl:"ssh_bastion_username"`
-	SSHBastionPassword              *string                       `mapstructure:"ssh_bastion_password" cty:"ssh_bastion_password" hcl:"ssh_bastion_password"`
-	SSHBastionInteractive           *bool                         `mapstructure:"ssh_bastion_interactive" cty:"ssh_bastion_interactive" hcl:"ssh_bastion_interactive"`
-	SSHBastionPrivateKeyFile        *string                       `mapstructure:"ssh_bastion_private_key_file" cty:"ssh_bastion_private_key_file" hcl:"ssh_bastion_private_key_file"`
-	SSHBastionCertificateFile       *string                       `mapstructure:"ssh_bastion_certificate_file" cty:"ssh_bastion_certificate_file" hcl:"ssh_bastion_certificate_file"`
-	SSHFileTransferMethod           *string                       `mapstructure:"ssh_file_transfer_method" cty:"ssh_file_transfer_method" hcl:"ssh_file_transfer_method"`
-	SSHProxyHost                    *string                       `mapstructure:"ssh_proxy_host" cty:"ssh_proxy_host" hcl:"ssh_proxy_host"`
-	SSHProxyPort                    *int                          `mapstructure:"ssh_proxy_port" cty:"ssh_proxy_port" hcl:"ssh_proxy_port"`
-	SSHProxyUsername                *string                       `mapstructure:"ssh_proxy_username" cty:"ssh_proxy_username" hcl:"ssh_proxy_username"`
-	SSHProxyPassword                *string                       `mapstructure:"ssh_proxy_password" cty:"ssh_proxy_password" hcl:"ssh_proxy_password"`
-	SSHKeepAliveInterval            *string                       `mapstructure:"ssh_keep_alive_interval" cty:"ssh_keep_alive_interval" hcl:"ssh_keep_alive_interval"`
-	SSHReadWriteTimeout             *string                       `mapstructure:"ssh_read_write_timeout" cty:"ssh_read_write_timeout" hcl:"ssh_read_write_timeout"`
-	SSHRemoteTunnels                []string                      `mapstructure:"ssh_remote_tunnels" cty:"ssh_remote_tunnels" hcl:"ssh_remote_tunnels"`
-	SSHLocalTunnels                 []string                      `mapstructure:"ssh_local_tunnels" cty:"ssh_local_tunnels" hcl:"ssh_local_tunnels"`
-	SSHPublicKey                    []byte                        `mapstructure:"ssh_public_key" undocumented:"true" cty:"ssh_public_key" hcl:"ssh_public_key"`
-	SSHPrivateKey                   []byte                        `mapstructure:"ssh_private_key" undocumented:"true" cty:"ssh_private_key" hcl:"ssh_private_key"`
-	WinRMUser                       *string                       `mapstructure:"winrm_username" cty:"winrm_username" hcl:"winrm_username"`
-	WinRMPassword                   *string                       `mapstructure:"winrm_password" cty:"winrm_password" hcl:"winrm_password"`
-	WinRMHost                       *string                       `mapstructure:"winrm_host" cty:"winrm_host" hcl:"winrm_host"`
-	WinRMNoProxy                    *bool                         `mapstructure:"winrm_no_proxy" cty:"winrm_no_proxy" hcl:"winrm_no_proxy"`
-	WinRMPort                       *int                          `mapstructure:"winrm_port" cty:"winrm_port" hcl:"winrm_port"`
-	WinRMTimeout                    *string                       `mapstructure:"winrm_timeout" cty:"winrm_timeout" hcl:"winrm_timeout"`
-	WinRMUseSSL                     *bool                         `mapstructure:"winrm_use_ssl" cty:"winrm_use_ssl" hcl:"winrm_use_ssl"`
-	WinRMInsecure                   *bool                         `mapstructure:"winrm_insecure" cty:"winrm_insecure" hcl:"winrm_insecure"`
-	WinRMUseNTLM                    *bool                         `mapstructure:"winrm_use_ntlm" cty:"winrm_use_ntlm" hcl:"winrm_use_ntlm"`
-	ProxmoxURLRaw                   *string                       `mapstructure:"proxmox_url" required:"true" cty:"proxmox_url" hcl:"proxmox_url"`
-	SkipCertValidation              *bool                         `mapstructure:"insecure_skip_tls_verify" cty:"insecure_skip_tls_verify" hcl:"insecure_skip_tls_verify"`
-	Username                        *string                       `mapstructure:"username" required:"true" cty:"username" hcl:"username"`
-	Password                        *string                       `mapstructure:"password" cty:"password" hcl:"password"`
-	Token                           *string                       `mapstructure:"token" cty:"token" hcl:"token"`
-	Node                            *string                       `mapstructure:"node" required:"true" cty:"node" hcl:"node"`
-	Pool                            *string                       `mapstructure:"pool" cty:"pool" hcl:"pool"`
-	TaskTimeout                     *string                       `mapstructure:"task_timeout" cty:"task_timeout" hcl:"task_timeout"`
-	VMName                          *string                       `mapstructure:"vm_name" cty:"vm_name" hcl:"vm_name"`
-	VMID                            *int                          `mapstructure:"vm_id" cty:"vm_id" hcl:"vm_id"`
-	Tags                            *string                       `mapstructure:"tags" cty:"tags" hcl:"tags"`
-	Boot                            *string                       `mapstructure:"boot" cty:"boot" hcl:"boot"`
-	Memory                          *uint32                       `mapstructure:"memory" cty:"memory" hcl:"memory"`
-	BalloonMinimum                  *uint32                       `mapstructure:"ballooning_minimum" cty:"ballooning_minimum" hcl:"ballooning_minimum"`
-	Cores                           *uint8                        `mapstructure:"cores" cty:"cores" hcl:"cores"`
-	CPUType                         *string                       `mapstructure:"cpu_type" cty:"cpu_type" hcl:"cpu_type"`
-	Sockets                         *uint8                        `mapstructure:"sockets" cty:"sockets" hcl:"sockets"`
-	Numa                            *bool                         `mapstructure:"numa" cty:"numa" hcl:"numa"`
-	OS                              *string                       `mapstructure:"os" cty:"os" hcl:"os"`
-	BIOS                            *string                       `mapstructure:"bios" cty:"bios" hcl:"bios"`
-	EFIConfig                       *proxmox.FlatefiConfig        `mapstructure:"efi_config" cty:"efi_config" hcl:"efi_config"`
-	EFIDisk                         *string                       `mapstructure:"efidisk" cty:"efidisk" hcl:"efidisk"`
-	Machine                         *string                       `mapstructure:"machine" cty:"machine" hcl:"machine"`
-	Rng0                            *proxmox.Flatrng0Config       `mapstructure:"rng0" cty:"rng0" hcl:"rng0"`
-	TPMConfig                       *proxmox.FlattpmConfig        `mapstructure:"tpm_config" cty:"tpm_config" hcl:"tpm_config"`
-	VGA                             *proxmox.FlatvgaConfig        `mapstructure:"vga" cty:"vga" hcl:"vga"`
-	NICs                            []proxmox.FlatNICConfig       `mapstructure:"network_adapters" cty:"network_adapters" hcl:"network_adapters"`
-	Disks                           []proxmox.FlatdiskConfig      `mapstructure:"disks" cty:"disks" hcl:"disks"`
-	PCIDevices                      []proxmox.FlatpciDeviceConfig `mapstructure:"pci_devices" cty:"pci_devices" hcl:"pci_devices"`
-	Serials                         []string                      `mapstructure:"serials" cty:"serials" hcl:"serials"`
-	Agent                           *bool                         `mapstructure:"qemu_agent" cty:"qemu_agent" hcl:"qemu_agent"`
-	SCSIController                  *string                       `mapstructure:"scsi_controller" cty:"scsi_controller" hcl:"scsi_controller"`
-	Onboot                          *bool                         `mapstructure:"onboot" cty:"onboot" hcl:"onboot"`
-	DisableKVM                      *bool                         `mapstructure:"disable_kvm" cty:"disable_kvm" hcl:"disable_kvm"`
-	TemplateName                    *string                       `mapstructure:"template_name" cty:"template_name" hcl:"template_name"`
-	TemplateDescription             *string                       `mapstructure:"template_description" cty:"template_description" hcl:"template_description"`
-	SkipConvertToTemplate           *bool                         `mapstructure:"skip_convert_to_template" cty:"skip_convert_to_template" hcl:"skip_convert_to_template"`
-	CloudInit                       *bool                         `mapstructure:"cloud_init" cty:"cloud_init" hcl:"cloud_init"`
-	CloudInitStoragePool            *string                       `mapstructure:"cloud_init_storage_pool" cty:"cloud_init_storage_pool" hcl:"cloud_init_storage_pool"`
-	CloudInitDiskType               *string                       `mapstructure:"cloud_init_disk_type" cty:"cloud_init_disk_type" hcl:"cloud_init_disk_type"`
-	CloudInitDisableUpgradePackages *bool                         `mapstructure:"cloud_init_disable_upgrade_packages" cty:"cloud_init_disable_upgrade_packages" hcl:"cloud_init_disable_upgrade_packages"`
-	ISOs                            []proxmox.FlatISOsConfig      `mapstructure:"additional_iso_files" cty:"additional_iso_files" hcl:"additional_iso_files"`
-	VMInterface                     *string                       `mapstructure:"vm_interface" cty:"vm_interface" hcl:"vm_interface"`
-	AdditionalArgs                  *string                       `mapstructure:"qemu_additional_args" cty:"qemu_additional_args" hcl:"qemu_additional_args"`
-	ISOChecksum                     *string                       `mapstructure:"iso_checksum" required:"true" cty:"iso_checksum" hcl:"iso_checksum"`
-	RawSingleISOUrl                 *string                       `mapstructure:"iso_url" required:"true" cty:"iso_url" hcl:"iso_url"`
-	ISOUrls                         []string                      `mapstructure:"iso_urls" cty:"iso_urls" hcl:"iso_urls"`
-	TargetPath                      *string                       `mapstructure:"iso_target_path" cty:"iso_target_path" hcl:"iso_target_path"`
-	TargetExtension                 *string                       `mapstructure:"iso_target_extension" cty:"iso_target_extension" hcl:"iso_target_extension"`
-	ISOFile                         *string                       `mapstructure:"iso_file" cty:"iso_file" hcl:"iso_file"`
-	ISOStoragePool                  *string                       `mapstructure:"iso_storage_pool" cty:"iso_storage_pool" hcl:"iso_storage_pool"`
-	ISODownloadPVE                  *bool                         `mapstructure:"iso_download_pve" cty:"iso_download_pve" hcl:"iso_download_pve"`
-	UnmountISO                      *bool                         `mapstructure:"unmount_iso" cty:"unmount_iso" hcl:"unmount_iso"`
-	BootISO                         *proxmox.FlatISOsConfig       `mapstructure:"boot_iso" required:"true" cty:"boot_iso" hcl:"boot_iso"`
+	PackerBuildName                 *string                              `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType               *string                              `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion               *string                              `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug                     *bool                                `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce                     *bool                                `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError                   *string                              `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars                  map[string]string                    `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars             []string                             `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	HTTPDir                         *string                              `mapstructure:"http_directory" cty:"http_directory" hcl:"http_directory"`
+	HTTPContent                     map[string]string                    `mapstructure:"http_content" cty:"http_content" hcl:"http_content"`
+	HTTPPortMin                     *int                                 `mapstructure:"http_port_min" cty:"http_port_min" hcl:"http_port_min"`
+	HTTPPortMax                     *int                                 `mapstructure:"http_port_max" cty:"http_port_max" hcl:"http_port_max"`
+	HTTPAddress                     *string                              `mapstructure:"http_bind_address" cty:"http_bind_address" hcl:"http_bind_address"`
+	HTTPInterface                   *string                              `mapstructure:"http_interface" undocumented:"true" cty:"http_interface" hcl:"http_interface"`
+	HTTPNetworkProtocol             *string                              `mapstructure:"http_network_protocol" cty:"http_network_protocol" hcl:"http_network_protocol"`
+	BootGroupInterval               *string                              `mapstructure:"boot_keygroup_interval" cty:"boot_keygroup_interval" hcl:"boot_keygroup_interval"`
+	BootWait                        *string                              `mapstructure:"boot_wait" cty:"boot_wait" hcl:"boot_wait"`
+	BootCommand                     []string                             `mapstructure:"boot_command" cty:"boot_command" hcl:"boot_command"`
+	BootKeyInterval                 *string                              `mapstructure:"boot_key_interval" cty:"boot_key_interval" hcl:"boot_key_interval"`
+	Type                            *string                              `mapstructure:"communicator" cty:"communicator" hcl:"communicator"`
+	PauseBeforeConnect              *string                              `mapstructure:"pause_before_connecting" cty:"pause_before_connecting" hcl:"pause_before_connecting"`
+	SSHHost                         *string                              `mapstructure:"ssh_host" cty:"ssh_host" hcl:"ssh_host"`
+	SSHPort                         *int                                 `mapstructure:"ssh_port" cty:"ssh_port" hcl:"ssh_port"`
+	SSHUsername                     *string                              `mapstructure:"ssh_username" cty:"ssh_username" hcl:"ssh_username"`
+	SSHPassword                     *string                              `mapstructure:"ssh_password" cty:"ssh_password" hcl:"ssh_password"`
+	SSHKeyPairName                  *string                              `mapstructure:"ssh_keypair_name" undocumented:"true" cty:"ssh_keypair_name" hcl:"ssh_keypair_name"`
+	SSHTemporaryKeyPairName         *string                              `mapstructure:"temporary_key_pair_name" undocumented:"true" cty:"temporary_key_pair_name" hcl:"temporary_key_pair_name"`
+	SSHTemporaryKeyPairType         *string                              `mapstructure:"temporary_key_pair_type" cty:"temporary_key_pair_type" hcl:"temporary_key_pair_type"`
+	SSHTemporaryKeyPairBits         *int                                 `mapstructure:"temporary_key_pair_bits" cty:"temporary_key_pair_bits" hcl:"temporary_key_pair_bits"`
+	SSHCiphers                      []string                             `mapstructure:"ssh_ciphers" cty:"ssh_ciphers" hcl:"ssh_ciphers"`
+	SSHClearAuthorizedKeys          *bool                                `mapstructure:"ssh_clear_authorized_keys" cty:"ssh_clear_authorized_keys" hcl:"ssh_clear_authorized_keys"`
+	SSHKEXAlgos                     []string                             `mapstructure:"ssh_key_exchange_algorithms" cty:"ssh_key_exchange_algorithms" hcl:"ssh_key_exchange_algorithms"`
+	SSHPrivateKeyFile               *string                              `mapstructure:"ssh_private_key_file" undocumented:"true" cty:"ssh_private_key_file" hcl:"ssh_private_key_file"`
+	SSHCertificateFile              *string                              `mapstructure:"ssh_certificate_file" cty:"ssh_certificate_file" hcl:"ssh_certificate_file"`
+	SSHPty                          *bool                                `mapstructure:"ssh_pty" cty:"ssh_pty" hcl:"ssh_pty"`
+	SSHTimeout                      *string                              `mapstructure:"ssh_timeout" cty:"ssh_timeout" hcl:"ssh_timeout"`
+	SSHWaitTimeout                  *string                              `mapstructure:"ssh_wait_timeout" undocumented:"true" cty:"ssh_wait_timeout" hcl:"ssh_wait_timeout"`
+	SSHAgentAuth                    *bool                                `mapstructure:"ssh_agent_auth" undocumented:"true" cty:"ssh_agent_auth" hcl:"ssh_agent_auth"`
+	SSHDisableAgentForwarding       *bool                                `mapstructure:"ssh_disable_agent_forwarding" cty:"ssh_disable_agent_forwarding" hcl:"ssh_disable_agent_forwarding"`
+	SSHHandshakeAttempts            *int                                 `mapstructure:"ssh_handshake_attempts" cty:"ssh_handshake_attempts" hcl:"ssh_handshake_attempts"`
+	SSHBastionHost                  *string                              `mapstructure:"ssh_bastion_host" cty:"ssh_bastion_host" hcl:"ssh_bastion_host"`
+	SSHBastionPort                  *int                                 `mapstructure:"ssh_bastion_port" cty:"ssh_bastion_port" hcl:"ssh_bastion_port"`
+	SSHBastionAgentAuth             *bool                                `mapstructure:"ssh_bastion_agent_auth" cty:"ssh_bastion_agent_auth" hcl:"ssh_bastion_agent_auth"`
+	SSHBastionUsername              *string                              `mapstructure:"ssh_bastion_username" cty:"ssh_bastion_username" hcl:"ssh_bastion_username"`
+	SSHBastionPassword              *string                              `mapstructure:"ssh_bastion_password" cty:"ssh_bastion_password" hcl:"ssh_bastion_password"`
+	SSHBastionInteractive           *bool                                `mapstructure:"ssh_bastion_interactive" cty:"ssh_bastion_interactive" hcl:"ssh_bastion_interactive"`
+	SSHBastionPrivateKeyFile        *string                              `mapstructure:"ssh_bastion_private_key_file" cty:"ssh_bastion_private_key_file" hcl:"ssh_bastion_private_key_file"`
+	SSHBastionCertificateFile       *string                              `mapstructure:"ssh_bastion_certificate_file" cty:"ssh_bastion_certificate_file" hcl:"ssh_bastion_certificate_file"`
+	SSHFileTransferMethod           *string                              `mapstructure:"ssh_file_transfer_method" cty:"ssh_file_transfer_method" hcl:"ssh_file_transfer_method"`
+	SSHProxyHost                    *string                              `mapstructure:"ssh_proxy_host" cty:"ssh_proxy_host" hcl:"ssh_proxy_host"`
+	SSHProxyPort                    *int                                 `mapstructure:"ssh_proxy_port" cty:"ssh_proxy_port" hcl:"ssh_proxy_port"`
+	SSHProxyUsername                *string                              `mapstructure:"ssh_proxy_username" cty:"ssh_proxy_username" hcl:"ssh_proxy_username"`
+	SSHProxyPassword                *string                              `mapstructure:"ssh_proxy_password" cty:"ssh_proxy_password" hcl:"ssh_proxy_password"`
+	SSHKeepAliveInterval            *string                              `mapstructure:"ssh_keep_alive_interval" cty:"ssh_keep_alive_interval" hcl:"ssh_keep_alive_interval"`
+	SSHReadWriteTimeout             *string                              `mapstructure:"ssh_read_write_timeout" cty:"ssh_read_write_timeout" hcl:"ssh_read_write_timeout"`
+	SSHRemoteTunnels                []string                             `mapstructure:"ssh_remote_tunnels" cty:"ssh_remote_tunnels" hcl:"ssh_remote_tunnels"`
+	SSHLocalTunnels                 []string                             `mapstructure:"ssh_local_tunnels" cty:"ssh_local_tunnels" hcl:"ssh_local_tunnels"`
+	SSHPublicKey                    []byte                               `mapstructure:"ssh_public_key" undocumented:"true" cty:"ssh_public_key" hcl:"ssh_public_key"`
+	SSHPrivateKey                   []byte                               `mapstructure:"ssh_private_key" undocumented:"true" cty:"ssh_private_key" hcl:"ssh_private_key"`
+	WinRMUser                       *string                              `mapstructure:"winrm_username" cty:"winrm_username" hcl:"winrm_username"`
+	WinRMPassword                   *string                              `mapstructure:"winrm_password" cty:"winrm_password" hcl:"winrm_password"`
+	WinRMHost                       *string                              `mapstructure:"winrm_host" cty:"winrm_host" hcl:"winrm_host"`
+	WinRMNoProxy                    *bool                                `mapstructure:"winrm_no_proxy" cty:"winrm_no_proxy" hcl:"winrm_no_proxy"`
+	WinRMPort                       *int                                 `mapstructure:"winrm_port" cty:"winrm_port" hcl:"winrm_port"`
+	WinRMTimeout                    *string                              `mapstructure:"winrm_timeout" cty:"winrm_timeout" hcl:"winrm_timeout"`
+	WinRMUseSSL                     *bool                                `mapstructure:"winrm_use_ssl" cty:"winrm_use_ssl" hcl:"winrm_use_ssl"`
+	WinRMInsecure                   *bool                                `mapstructure:"winrm_insecure" cty:"winrm_insecure" hcl:"winrm_insecure"`
+	WinRMUseNTLM                    *bool                                `mapstructure:"winrm_use_ntlm" cty:"winrm_use_ntlm" hcl:"winrm_use_ntlm"`
+	ProxmoxURLRaw                   *string                              `mapstructure:"proxmox_url" required:"true" cty:"proxmox_url" hcl:"proxmox_url"`
+	SkipCertValidation              *bool                                `mapstructure:"insecure_skip_tls_verify" cty:"insecure_skip_tls_verify" hcl:"insecure_skip_tls_verify"`
+	Username                        *string                              `mapstructure:"username" required:"true" cty:"username" hcl:"username"`
+	Password                        *string                              `mapstructure:"password" cty:"password" hcl:"password"`
+	Token                           *string                              `mapstructure:"token" cty:"token" hcl:"token"`
+	Node                            *string                              `mapstructure:"node" required:"true" cty:"node" hcl:"node"`
+	Pool                            *string                              `mapstructure:"pool" cty:"pool" hcl:"pool"`
+	TaskTimeout                     *string                              `mapstructure:"task_timeout" cty:"task_timeout" hcl:"task_timeout"`
+	VMName                          *string                              `mapstructure:"vm_name" cty:"vm_name" hcl:"vm_name"`
+	VMID                            *int                                 `mapstructure:"vm_id" cty:"vm_id" hcl:"vm_id"`
+	Tags                            *string                              `mapstructure:"tags" cty:"tags" hcl:"tags"`
+	Boot                            *string                              `mapstructure:"boot" cty:"boot" hcl:"boot"`
+	Memory                          *uint32                              `mapstructure:"memory" cty:"memory" hcl:"memory"`
+	BalloonMinimum                  *uint32                              `mapstructure:"ballooning_minimum" cty:"ballooning_minimum" hcl:"ballooning_minimum"`
+	Cores                           *uint8                               `mapstructure:"cores" cty:"cores" hcl:"cores"`
+	CPUType                         *string                              `mapstructure:"cpu_type" cty:"cpu_type" hcl:"cpu_type"`
+	Sockets                         *uint8                               `mapstructure:"sockets" cty:"sockets" hcl:"sockets"`
+	Numa                            *bool                                `mapstructure:"numa" cty:"numa" hcl:"numa"`
+	OS                              *string                              `mapstructure:"os" cty:"os" hcl:"os"`
+	BIOS                            *string                              `mapstructure:"bios" cty:"bios" hcl:"bios"`
+	EFIConfig                       *proxmox.FlatefiConfig               `mapstructure:"efi_config" cty:"efi_config" hcl:"efi_config"`
+	EFIDisk                         *string                              `mapstructure:"efidisk" cty:"efidisk" hcl:"efidisk"`
+	Machine                         *string                              `mapstructure:"machine" cty:"machine" hcl:"machine"`
+	Rng0                            *proxmox.Flatrng0Config              `mapstructure:"rng0" cty:"rng0" hcl:"rng0"`
+	TPMConfig                       *proxmox.FlattpmConfig               `mapstructure:"tpm_config" cty:"tpm_config" hcl:"tpm_config"`
+	VGA                             *proxmox.FlatvgaConfig               `mapstructure:"vga" cty:"vga" hcl:"vga"`
+	NICs                            []proxmox.FlatNICConfig              `mapstructure:"network_adapters" cty:"network_adapters" hcl:"network_adapters"`
+	Disks                           []proxmox.FlatdiskConfig             `mapstructure:"disks" cty:"disks" hcl:"disks"`
+	PCIDevices                      []proxmox.FlatpciDeviceConfig        `mapstructure:"pci_devices" cty:"pci_devices" hcl:"pci_devices"`
+	Serials                         []string                             `mapstructure:"serials" cty:"serials" hcl:"serials"`
+	Agent                           *bool                                `mapstructure:"qemu_agent" cty:"qemu_agent" hcl:"qemu_agent"`
+	SCSIController                  *string                              `mapstructure:"scsi_controller" cty:"scsi_controller" hcl:"scsi_controller"`
+	Onboot                          *bool                                `mapstructure:"onboot" cty:"onboot" hcl:"onboot"`
+	DisableKVM                      *bool                                `mapstructure:"disable_kvm" cty:"disable_kvm" hcl:"disable_kvm"`
+	VMConfigOverrides               map[string]string                    `mapstructure:"vm_config_overrides" cty:"vm_config_overrides" hcl:"vm_config_overrides"`
+	TemplateConfigOverrides         map[string]string                    `mapstructure:"template_config_overrides" cty:"template_config_overrides" hcl:"template_config_overrides"`
+	TemplateName                    *string                              `mapstructure:"template_name" cty:"template_name" hcl:"template_name"`
+	TemplateDescription             *string                              `mapstructure:"template_description" cty:"template_description" hcl:"template_description"`
+	NotesMetadata                   *bool                                `mapstructure:"notes_metadata" cty:"notes_metadata" hcl:"notes_metadata"`
+	NotesMetadataValues             map[string]string                    `mapstructure:"notes_metadata_values" cty:"notes_metadata_values" hcl:"notes_metadata_values"`
+	TemplateOverrides               *proxmox.FlattemplateOverridesConfig `mapstructure:"template_overrides" cty:"template_overrides" hcl:"template_overrides"`
+	SkipConvertToTemplate           *bool                                `mapstructure:"skip_convert_to_template" cty:"skip_convert_to_template" hcl:"skip_convert_to_template"`
+	SnapshotName                    *string                              `mapstructure:"snapshot_name" cty:"snapshot_name" hcl:"snapshot_name"`
+	SnapshotIncludeRAM              *bool                                `mapstructure:"snapshot_include_ram" cty:"snapshot_include_ram" hcl:"snapshot_include_ram"`
+	FinalStoragePool                *string                              `mapstructure:"final_storage_pool" cty:"final_storage_pool" hcl:"final_storage_pool"`
+	KeepVMOnError                   *bool                                `mapstructure:"keep_vm_on_error" cty:"keep_vm_on_error" hcl:"keep_vm_on_error"`
+	KeepVMOnErrorRunning            *bool                                `mapstructure:"keep_vm_on_error_running" cty:"keep_vm_on_error_running" hcl:"keep_vm_on_error_running"`
+	CleanupOrphanedVMsOlderThan     *string                              `mapstructure:"cleanup_orphaned_vms_older_than" cty:"cleanup_orphaned_vms_older_than" hcl:"cleanup_orphaned_vms_older_than"`
+	CloudInit                       *bool                                `mapstructure:"cloud_init" cty:"cloud_init" hcl:"cloud_init"`
+	CloudInitStoragePool            *string                              `mapstructure:"cloud_init_storage_pool" cty:"cloud_init_storage_pool" hcl:"cloud_init_storage_pool"`
+	CloudInitDiskType               *string                              `mapstructure:"cloud_init_disk_type" cty:"cloud_init_disk_type" hcl:"cloud_init_disk_type"`
+	CloudInitDisableUpgradePackages *bool                                `mapstructure:"cloud_init_disable_upgrade_packages" cty:"cloud_init_disable_upgrade_packages" hcl:"cloud_init_disable_upgrade_packages"`
+	CloudInitDuringBuild            *bool                                `mapstructure:"cloud_init_during_build" cty:"cloud_init_during_build" hcl:"cloud_init_during_build"`
+	Nameserver                      *string                              `mapstructure:"nameserver" required:"false" cty:"nameserver" hcl:"nameserver"`
+	Searchdomain                    *string                              `mapstructure:"searchdomain" required:"false" cty:"searchdomain" hcl:"searchdomain"`
+	Ipconfigs                       []proxmox.FlatcloudInitIpconfig      `mapstructure:"ipconfig" required:"false" cty:"ipconfig" hcl:"ipconfig"`
+	CloudInitWait                   *bool                                `mapstructure:"cloud_init_wait" cty:"cloud_init_wait" hcl:"cloud_init_wait"`
+	CloudInitWaitMethod             *string                              `mapstructure:"cloud_init_wait_method" cty:"cloud_init_wait_method" hcl:"cloud_init_wait_method"`
+	CloudInitWaitTimeout            *string                              `mapstructure:"cloud_init_wait_timeout" cty:"cloud_init_wait_timeout" hcl:"cloud_init_wait_timeout"`
+	SnapshotBeforeProvisioning      *bool                                `mapstructure:"snapshot_before_provisioning" cty:"snapshot_before_provisioning" hcl:"snapshot_before_provisioning"`
+	GuestTrim                       *bool                                `mapstructure:"guest_trim" cty:"guest_trim" hcl:"guest_trim"`
+	GuestTrimMethod                 *string                              `mapstructure:"guest_trim_method" cty:"guest_trim_method" hcl:"guest_trim_method"`
+	Generalize                      *bool                                `mapstructure:"generalize" cty:"generalize" hcl:"generalize"`
+	GeneralizeOS                    *string                              `mapstructure:"generalize_os" cty:"generalize_os" hcl:"generalize_os"`
+	GeneralizeUnattendFile          *string                              `mapstructure:"generalize_unattend_file" cty:"generalize_unattend_file" hcl:"generalize_unattend_file"`
+	GeneralizeTimeout               *string                              `mapstructure:"generalize_timeout" cty:"generalize_timeout" hcl:"generalize_timeout"`
+	CloudInitSeed                   *proxmox.FlatcloudInitSeedConfig     `mapstructure:"cloud_init_seed" cty:"cloud_init_seed" hcl:"cloud_init_seed"`
+	ISOs                            []proxmox.FlatISOsConfig             `mapstructure:"additional_iso_files" cty:"additional_iso_files" hcl:"additional_iso_files"`
+	ISOUploadAttempts               *int                                 `mapstructure:"iso_upload_attempts" cty:"iso_upload_attempts" hcl:"iso_upload_attempts"`
+	ISOConcurrency                  *int                                 `mapstructure:"iso_concurrency" cty:"iso_concurrency" hcl:"iso_concurrency"`
+	VMInterface                     *string                              `mapstructure:"vm_interface" cty:"vm_interface" hcl:"vm_interface"`
+	AdditionalArgs                  *string                              `mapstructure:"qemu_additional_args" cty:"qemu_additional_args" hcl:"qemu_additional_args"`
+	ISOChecksum                     *string                              `mapstructure:"iso_checksum" required:"true" cty:"iso_checksum" hcl:"iso_checksum"`
+	RawSingleISOUrl                 *string                              `mapstructure:"iso_url" required:"true" cty:"iso_url" hcl:"iso_url"`
+	ISOUrls                         []string                             `mapstructure:"iso_urls" cty:"iso_urls" hcl:"iso_urls"`
+	TargetPath                      *string                              `mapstructure:"iso_target_path" cty:"iso_target_path" hcl:"iso_target_path"`
+	TargetExtension                 *string                              `mapstructure:"iso_target_extension" cty:"iso_target_extension" hcl:"iso_target_extension"`
+	ISOFile                         *string                              `mapstructure:"iso_file" cty:"iso_file" hcl:"iso_file"`
+	ISOStoragePool                  *string                              `mapstructure:"iso_storage_pool" cty:"iso_storage_pool" hcl:"iso_storage_pool"`
+	ISODownloadPVE                  *bool                                `mapstructure:"iso_download_pve" cty:"iso_download_pve" hcl:"iso_download_pve"`
+	UnmountISO                      *bool                                `mapstructure:"unmount_iso" cty:"unmount_iso" hcl:"unmount_iso"`
+	BootISO                         *proxmox.FlatISOsConfig              `mapstructure:"boot_iso" required:"true" cty:"boot_iso" hcl:"boot_iso"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -249,14 +277,42 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"scsi_controller":                     &hcldec.AttrSpec{Name: "scsi_controller", Type: cty.String, Required: false},
 		"onboot":                              &hcldec.AttrSpec{Name: "onboot", Type: cty.Bool, Required: false},
 		"disable_kvm":                         &hcldec.AttrSpec{Name: "disable_kvm", Type: cty.Bool, Required: false},
+		"vm_config_overrides":                 &hcldec.AttrSpec{Name: "vm_config_overrides", Type: cty.Map(cty.String), Required: false},
+		"template_config_overrides":           &hcldec.AttrSpec{Name: "template_config_overrides", Type: cty.Map(cty.String), Required: false},
 		"template_name":                       &hcldec.AttrSpec{Name: "template_name", Type: cty.String, Required: false},
 		"template_description":                &hcldec.AttrSpec{Name: "template_description", Type: cty.String, Required: false},
+		"notes_metadata":                      &hcldec.AttrSpec{Name: "notes_metadata", Type: cty.Bool, Required: false},
+		"notes_metadata_values":               &hcldec.AttrSpec{Name: "notes_metadata_values", Type: cty.Map(cty.String), Required: false},
+		"template_overrides":                  &hcldec.BlockSpec{TypeName: "template_overrides", Nested: hcldec.ObjectSpec((*proxmox.FlattemplateOverridesConfig)(nil).HCL2Spec())},
 		"skip_convert_to_template":            &hcldec.AttrSpec{Name: "skip_convert_to_template", Type: cty.Bool, Required: false},
+		"snapshot_name":                       &hcldec.AttrSpec{Name: "snapshot_name", Type: cty.String, Required: false},
+		"snapshot_include_ram":                &hcldec.AttrSpec{Name: "snapshot_include_ram", Type: cty.Bool, Required: false},
+		"final_storage_pool":                  &hcldec.AttrSpec{Name: "final_storage_pool", Type: cty.String, Required: false},
+		"keep_vm_on_error":                    &hcldec.AttrSpec{Name: "keep_vm_on_error", Type: cty.Bool, Required: false},
+		"keep_vm_on_error_running":            &hcldec.AttrSpec{Name: "keep_vm_on_error_running", Type: cty.Bool, Required: false},
+		"cleanup_orphaned_vms_older_than":     &hcldec.AttrSpec{Name: "cleanup_orphaned_vms_older_than", Type: cty.String, Required: false},
 		"cloud_init":                          &hcldec.AttrSpec{Name: "cloud_init", Type: cty.Bool, Required: false},
 		"cloud_init_storage_pool":             &hcldec.AttrSpec{Name: "cloud_init_storage_pool", Type: cty.String, Required: false},
 		"cloud_init_disk_type":                &hcldec.AttrSpec{Name: "cloud_init_disk_type", Type: cty.String, Required: false},
 		"cloud_init_disable_upgrade_packages": &hcldec.AttrSpec{Name: "cloud_init_disable_upgrade_packages", Type: cty.Bool, Required: false},
+		"cloud_init_during_build":             &hcldec.AttrSpec{Name: "cloud_init_during_build", Type: cty.Bool, Required: false},
+		"nameserver":                          &hcldec.AttrSpec{Name: "nameserver", Type: cty.String, Required: false},
+		"searchdomain":                        &hcldec.AttrSpec{Name: "searchdomain", Type: cty.String, Required: false},
+		"ipconfig":                            &hcldec.BlockListSpec{TypeName: "ipconfig", Nested: hcldec.ObjectSpec((*proxmox.FlatcloudInitIpconfig)(nil).HCL2Spec())},
+		"cloud_init_wait":                     &hcldec.AttrSpec{Name: "cloud_init_wait", Type: cty.Bool, Required: false},
+		"cloud_init_wait_method":              &hcldec.AttrSpec{Name: "cloud_init_wait_method", Type: cty.String, Required: false},
+		"cloud_init_wait_timeout":             &hcldec.AttrSpec{Name: "cloud_init_wait_timeout", Type: cty.String, Required: false},
+		"snapshot_before_provisioning":        &hcldec.AttrSpec{Name: "snapshot_before_provisioning", Type: cty.Bool, Required: false},
+		"guest_trim":                          &hcldec.AttrSpec{Name: "guest_trim", Type: cty.Bool, Required: false},
+		"guest_trim_method":                   &hcldec.AttrSpec{Name: "guest_trim_method", Type: cty.String, Required: false},
+		"generalize":                          &hcldec.AttrSpec{Name: "generalize", Type: cty.Bool, Required: false},
+		"generalize_os":                       &hcldec.AttrSpec{Name: "generalize_os", Type: cty.String, Required: false},
+		"generalize_unattend_file":            &hcldec.AttrSpec{Name: "generalize_unattend_file", Type: cty.String, Required: false},
+		"generalize_timeout":                  &hcldec.AttrSpec{Name: "generalize_timeout", Type: cty.String, Required: false},
+		"cloud_init_seed":                     &hcldec.BlockSpec{TypeName: "cloud_init_seed", Nested: hcldec.ObjectSpec((*proxmox.FlatcloudInitSeedConfig)(nil).HCL2Spec())},
 		"additional_iso_files":                &hcldec.BlockListSpec{TypeName: "additional_iso_files", Nested: hcldec.ObjectSpec((*proxmox.FlatISOsConfig)(nil).HCL2Spec())},
+		"iso_upload_attempts":                 &hcldec.AttrSpec{Name: "iso_upload_attempts", Type: cty.Number, Required: false},
+		"iso_concurrency":                     &hcldec.AttrSpec{Name: "iso_concurrency", Type: cty.Number, Required: false},
 		"vm_interface":                        &hcldec.AttrSpec{Name: "vm_interface", Type: cty.String, Required: false},
 		"qemu_additional_args":                &hcldec.AttrSpec{Name: "qemu_additional_args", Type: cty.String, Required: false},
 		"iso_checksum":                        &hcldec.AttrSpec{Name: "iso_checksum", Type: cty.String, Required: false},
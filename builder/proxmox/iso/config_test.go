@@ -184,6 +184,57 @@ func TestAgentSetToFalse(t *testing.T) {
 	}
 }
 
+func TestSnapshotNameNotSupported(t *testing.T) {
+	cfg := mandatoryConfig(t)
+	cfg["snapshot_name"] = "build-1"
+	cfg["template_name"] = "golden"
+
+	var c Config
+	_, _, err := c.Prepare(cfg)
+	if err == nil {
+		t.Fatal("expected snapshot_name to be rejected by the ISO builder")
+	}
+}
+
+func TestUploadStreamWithCDFiles(t *testing.T) {
+	cfg := mandatoryConfig(t)
+	cfg["boot_iso"] = map[string]interface{}{
+		"type":              "sata",
+		"cd_files":          []string{"config_test.go"},
+		"iso_storage_pool":  "local",
+		"iso_upload_stream": true,
+	}
+
+	var c Config
+	_, _, err := c.Prepare(cfg)
+	if err == nil {
+		t.Fatal("expected iso_upload_stream to be rejected together with cd_files")
+	}
+	if !strings.Contains(err.Error(), "iso_upload_stream can't be combined with cd_files or cd_content") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestUploadStreamWithLocalFile(t *testing.T) {
+	cfg := mandatoryConfig(t)
+	cfg["boot_iso"] = map[string]interface{}{
+		"type":              "sata",
+		"iso_url":           "file:///tmp/debian.iso",
+		"iso_checksum":      "none",
+		"iso_storage_pool":  "local",
+		"iso_upload_stream": true,
+	}
+
+	var c Config
+	_, _, err := c.Prepare(cfg)
+	if err == nil {
+		t.Fatal("expected iso_upload_stream to reject file URLs")
+	}
+	if !strings.Contains(err.Error(), "iso_upload_stream only supports http and https URLs") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
 func TestPacketQueueSupportForNetworkAdapters(t *testing.T) {
 	drivertests := []struct {
 		expectedToFail bool